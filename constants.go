@@ -27,7 +27,18 @@ const (
 	lockNVHandle     tpm2.Handle = 0x01801100 // Global NV handle for locking access to sealed key objects
 	lockNVDataHandle tpm2.Handle = 0x01801101 // NV index containing policy data for lockNVHandle
 
-	// SHA-256 is mandatory to exist on every PC-Client TPM
-	// XXX: Maybe dynamically select algorithms based on what's available on the device?
+	// SHA-256 is mandatory to exist on every PC-Client TPM. Sealed key objects can use a different algorithm for the sessions
+	// that protect them via KeyCreationParams.SessionAlgorithm.
 	defaultSessionHashAlgorithm tpm2.HashAlgorithmId = tpm2.HashAlgorithmSHA256
+
+	// The name algorithm for sealed key objects if one isn't specified via KeyCreationParams.NameAlgorithm.
+	defaultSealedKeyNameAlgorithm tpm2.HashAlgorithmId = tpm2.HashAlgorithmSHA256
+)
+
+var (
+	// paramEncryptionSymmetric is the symmetric algorithm used for parameter encryption with HMAC sessions.
+	paramEncryptionSymmetric = tpm2.SymDef{
+		Algorithm: tpm2.SymAlgorithmAES,
+		KeyBits:   tpm2.SymKeyBitsU{Data: uint16(128)},
+		Mode:      tpm2.SymModeU{Data: tpm2.SymModeCFB}}
 )
@@ -347,9 +347,92 @@ func isLockAccessError(err error) bool {
 	return xerrors.As(err, &e)
 }
 
-func activateWithTPMKey(tpm *TPMConnection, volumeName, sourceDevicePath, keyPath string, pinReader io.Reader, pinTries int, lock bool, activateOptions []string) error {
+// keyDataSource corresponds to a location from which a sealed key object can be read, such as a key data file or a LUKS2 token.
+type keyDataSource struct {
+	name string
+	read func() (*SealedKeyObject, error)
+}
+
+// makeKeyDataSources returns the sources of the sealed key objects used to activate the volume at sourceDevicePath. If keyPaths
+// is empty, the sources are the tokens of type LUKS2KeyDataTokenType in the LUKS2 header of the volume, ordered by token ID.
+func makeKeyDataSources(sourceDevicePath string, keyPaths []string) ([]*keyDataSource, error) {
+	var sources []*keyDataSource
+
+	if len(keyPaths) > 0 {
+		for _, path := range keyPaths {
+			path := path
+			sources = append(sources, &keyDataSource{
+				name: path,
+				read: func() (*SealedKeyObject, error) { return ReadSealedKeyObject(path) }})
+		}
+		return sources, nil
+	}
+
+	tokens, err := ReadLUKS2KeyDataTokens(sourceDevicePath)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read LUKS2 tokens: %w", err)
+	}
+	if len(tokens) == 0 {
+		return nil, InvalidKeyFileError{"no sealed key data token found in LUKS2 header"}
+	}
+	for _, token := range tokens {
+		token := token
+		sources = append(sources, &keyDataSource{
+			name: fmt.Sprintf("LUKS2 token %d", token.ID),
+			read: func() (*SealedKeyObject, error) { return ReadSealedKeyObjectFromReader(bytes.NewReader(token.KeyData)) }})
+	}
+	return sources, nil
+}
+
+// unsealKeyFromSource reads the sealed key object from the supplied source and unseals the key from it, using getPIN to obtain
+// the PIN if one is required.
+func unsealKeyFromSource(tpm *TPMConnection, source *keyDataSource, pinTries int, getPIN func() (string, error)) ([]byte, error) {
+	k, err := source.read()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read sealed key object: %w", err)
+	}
+	if k.IsEnvelope() {
+		// The unsealed payload of an envelope mode sealed key object isn't necessarily a disk encryption key.
+		return nil, InvalidKeyFileError{"sealed key object was created by SealPayloadToTPM and cannot be used for volume activation"}
+	}
+
+	switch {
+	case pinTries == 0 && k.AuthMode2F() == AuthModePIN:
+		return nil, requiresPinErr
+	case pinTries == 0:
+		pinTries = 1
+	}
+
+	var key []byte
+
+	for ; pinTries > 0; pinTries-- {
+		var pin string
+		if k.AuthMode2F() == AuthModePIN {
+			pin, err = getPIN()
+			if err != nil {
+				return nil, xerrors.Errorf("cannot obtain PIN: %w", err)
+			}
+		}
+
+		key, err = unsealKeyFromTPM(tpm, k, pin)
+		if err != nil && (err != ErrPINFail || k.AuthMode2F() != AuthModePIN) {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, xerrors.Errorf("cannot unseal key: %w", err)
+	}
+	return key, nil
+}
+
+// activateWithTPMKeys tries to unseal a key from each of the supplied sources in order until one succeeds, and then activates the
+// volume with it. On success, it returns the name of the source that was used. It also returns the errors for each source that
+// failed. If no source could be used to activate the volume, the returned error is the error for the first source.
+func activateWithTPMKeys(tpm *TPMConnection, volumeName, sourceDevicePath string, sources []*keyDataSource, pinReader io.Reader, pinTries int, lock bool, activateOptions []string) (string, []*SealedKeyObjectError, error) {
+	var errs []*SealedKeyObjectError
 	var lockErr error
-	key, err := func() ([]byte, error) {
+	source, key := func() (*keyDataSource, []byte) {
 		defer func() {
 			if !lock {
 				return
@@ -357,55 +440,36 @@ func activateWithTPMKey(tpm *TPMConnection, volumeName, sourceDevicePath, keyPat
 			lockErr = LockAccessToSealedKeys(tpm)
 		}()
 
-		k, err := ReadSealedKeyObject(keyPath)
-		if err != nil {
-			return nil, xerrors.Errorf("cannot read sealed key object: %w", err)
+		// Only the first request for a PIN is read from pinReader.
+		getPIN := func() (string, error) {
+			r := pinReader
+			pinReader = nil
+			return getPassword(sourceDevicePath, "PIN", r)
 		}
 
-		switch {
-		case pinTries == 0 && k.AuthMode2F() == AuthModePIN:
-			return nil, requiresPinErr
-		case pinTries == 0:
-			pinTries = 1
-		}
-
-		var key []byte
-
-		for ; pinTries > 0; pinTries-- {
-			var pin string
-			if k.AuthMode2F() == AuthModePIN {
-				r := pinReader
-				pinReader = nil
-				pin, err = getPassword(sourceDevicePath, "PIN", r)
-				if err != nil {
-					return nil, xerrors.Errorf("cannot obtain PIN: %w", err)
-				}
-			}
-
-			key, err = unsealKeyFromTPM(tpm, k, pin)
-			if err != nil && (err != ErrPINFail || k.AuthMode2F() != AuthModePIN) {
-				break
+		for _, source := range sources {
+			key, err := unsealKeyFromSource(tpm, source, pinTries, getPIN)
+			if err == nil {
+				return source, key
 			}
+			errs = append(errs, &SealedKeyObjectError{Source: source.name, Err: err})
 		}
-
-		if err != nil {
-			return nil, xerrors.Errorf("cannot unseal key: %w", err)
-		}
-		return key, nil
+		return nil, nil
 	}()
 
 	switch {
 	case lockErr != nil:
-		return lockAccessError{err}
-	case err != nil:
-		return err
+		return "", errs, lockAccessError{lockErr}
+	case source == nil:
+		return "", errs, errs[0].Err
 	}
 
 	if err := activate(volumeName, sourceDevicePath, key, activateOptions); err != nil {
-		return xerrors.Errorf("cannot activate volume: %w", err)
+		errs = append(errs, &SealedKeyObjectError{Source: source.name, Err: xerrors.Errorf("cannot activate volume: %w", err)})
+		return "", errs, errs[0].Err
 	}
 
-	return nil
+	return source.name, errs, nil
 }
 
 func makeActivateOptions(in []string) ([]string, error) {
@@ -443,6 +507,14 @@ type ActivateWithTPMSealedKeyOptions struct {
 // ActivateVolumeWithTPMSealedKey attempts to activate the LUKS encrypted volume at sourceDevicePath and create a mapping with the
 // name volumeName, using the TPM sealed key object at the specified keyPath. This makes use of systemd-cryptsetup.
 //
+// If keyPath is empty, the TPM sealed key objects are read from the tokens of type LUKS2KeyDataTokenType in the LUKS2 header of
+// the volume at sourceDevicePath - see WriteLUKS2KeyDataToken. If there is more than one of these, they are tried in order as
+// described for ActivateVolumeWithMultipleTPMSealedKeys. If there are none, activation with the TPM sealed key object fails with a
+// InvalidKeyFileError error.
+//
+// Sealed key objects created by SealPayloadToTPM or SealPayloadToTPMWithWriters cannot be used with this function. Activation with
+// one of these fails with a InvalidKeyFileError error.
+//
 // If the TPM sealed key object has a PIN defined, then this function will use systemd-ask-password to request it. If pinReader is not
 // nil, then an attempt to read the PIN from this will be made instead by reading all characters until the first newline. The PINTries
 // field of options defines how many attempts should be made to obtain the correct PIN before failing.
@@ -474,6 +546,37 @@ type ActivateWithTPMSealedKeyOptions struct {
 // If the volume is successfully activated, either with the TPM sealed key or the fallback recovery key, this function returns true.
 // If it is not successfully activated, then this function returns false.
 func ActivateVolumeWithTPMSealedKey(tpm *TPMConnection, volumeName, sourceDevicePath, keyPath string, pinReader io.Reader, options *ActivateWithTPMSealedKeyOptions) (bool, error) {
+	var keyPaths []string
+	if keyPath != "" {
+		keyPaths = []string{keyPath}
+	}
+	return ActivateVolumeWithMultipleTPMSealedKeys(tpm, volumeName, sourceDevicePath, keyPaths, pinReader, options)
+}
+
+// ActivateVolumeWithMultipleTPMSealedKeys attempts to activate the LUKS encrypted volume at sourceDevicePath and create a mapping
+// with the name volumeName, using one of the TPM sealed key objects at the specified keyPaths. This behaves the same as
+// ActivateVolumeWithTPMSealedKey, except that the sealed key objects are tried in the order in which they are supplied until a key
+// is successfully unsealed from one of them, before falling back to the recovery key. This is useful for keeping more than one
+// sealed key object for a volume, each with a different PCR protection profile - such as one for the current boot configuration
+// and one for the boot configuration that will be used after an update. If keyPaths is empty, the sealed key objects are read from
+// the tokens of type LUKS2KeyDataTokenType in the LUKS2 header of the volume at sourceDevicePath, ordered by token ID.
+//
+// Only the first request for a PIN is read from pinReader. Subsequent requests use systemd-ask-password. The PINTries field of
+// options applies to each sealed key object individually.
+//
+// The LockSealedKeyAccess field of options causes LockAccessToSealedKeys to be called once a key has been unsealed from one of
+// the sealed key objects or after they have all failed, and before activating the LUKS volume. Sealed key objects after the one
+// that a key was successfully unsealed from are not tried, even if activation with that key fails.
+//
+// If the volume is activated with a sealed key object other than the first one, this function returns true and a
+// *ActivateWithTPMSealedKeyError error. In this case, the ActivatedWith field of the returned error contains the path of the sealed
+// key object that was used (or a description of the LUKS2 token that it was read from), the TPMErr and RecoveryKeyUsageErr fields
+// are nil and the SealedKeyErrs field contains details of the errors encountered with the preceding sealed key objects.
+//
+// If activation fails with all of the sealed key objects, then the TPMErr field of the returned *ActivateWithTPMSealedKeyError
+// contains the error for the first one, which is also used to determine the RecoveryKeyUsageReason if activation with the
+// recovery key is successful. The SealedKeyErrs field contains details of the errors encountered with all of them.
+func ActivateVolumeWithMultipleTPMSealedKeys(tpm *TPMConnection, volumeName, sourceDevicePath string, keyPaths []string, pinReader io.Reader, options *ActivateWithTPMSealedKeyOptions) (bool, error) {
 	if options.PINTries < 0 {
 		return false, errors.New("invalid PINTries")
 	}
@@ -486,31 +589,41 @@ func ActivateVolumeWithTPMSealedKey(tpm *TPMConnection, volumeName, sourceDevice
 		return false, err
 	}
 
-	if err := activateWithTPMKey(tpm, volumeName, sourceDevicePath, keyPath, pinReader, options.PINTries, options.LockSealedKeyAccess, activateOptions); err != nil {
-		reason := RecoveryKeyUsageReasonUnexpectedError
-		switch {
-		case isLockAccessError(err):
-			return false, LockAccessToSealedKeysError(err.Error())
-		case xerrors.Is(err, ErrTPMLockout):
-			reason = RecoveryKeyUsageReasonTPMLockout
-		case xerrors.Is(err, ErrTPMProvisioning):
-			reason = RecoveryKeyUsageReasonTPMProvisioningError
-		case isInvalidKeyFileError(err):
-			reason = RecoveryKeyUsageReasonInvalidKeyFile
-		case xerrors.Is(err, requiresPinErr):
-			reason = RecoveryKeyUsageReasonPINFail
-		case xerrors.Is(err, ErrPINFail):
-			reason = RecoveryKeyUsageReasonPINFail
-		case isExecError(err, systemdCryptsetupPath):
-			// systemd-cryptsetup only provides 2 exit codes - success or fail - so we don't know the reason it failed yet. If activation
-			// with the recovery key is successful, then it's safe to assume that it failed because the key unsealed from the TPM is incorrect.
-			reason = RecoveryKeyUsageReasonInvalidKeyFile
-		}
-		rErr := activateWithRecoveryKey(volumeName, sourceDevicePath, nil, options.RecoveryKeyTries, reason, activateOptions)
-		return rErr == nil, &ActivateWithTPMSealedKeyError{err, rErr}
+	var activatedWith string
+	var keyErrs []*SealedKeyObjectError
+	sources, err := makeKeyDataSources(sourceDevicePath, keyPaths)
+	if err == nil {
+		activatedWith, keyErrs, err = activateWithTPMKeys(tpm, volumeName, sourceDevicePath, sources, pinReader, options.PINTries, options.LockSealedKeyAccess, activateOptions)
 	}
 
-	return true, nil
+	switch {
+	case err == nil && len(keyErrs) > 0:
+		return true, &ActivateWithTPMSealedKeyError{SealedKeyErrs: keyErrs, ActivatedWith: activatedWith}
+	case err == nil:
+		return true, nil
+	}
+
+	reason := RecoveryKeyUsageReasonUnexpectedError
+	switch {
+	case isLockAccessError(err):
+		return false, LockAccessToSealedKeysError(err.Error())
+	case xerrors.Is(err, ErrTPMLockout):
+		reason = RecoveryKeyUsageReasonTPMLockout
+	case xerrors.Is(err, ErrTPMProvisioning):
+		reason = RecoveryKeyUsageReasonTPMProvisioningError
+	case isInvalidKeyFileError(err):
+		reason = RecoveryKeyUsageReasonInvalidKeyFile
+	case xerrors.Is(err, requiresPinErr):
+		reason = RecoveryKeyUsageReasonPINFail
+	case xerrors.Is(err, ErrPINFail):
+		reason = RecoveryKeyUsageReasonPINFail
+	case isExecError(err, systemdCryptsetupPath):
+		// systemd-cryptsetup only provides 2 exit codes - success or fail - so we don't know the reason it failed yet. If activation
+		// with the recovery key is successful, then it's safe to assume that it failed because the key unsealed from the TPM is incorrect.
+		reason = RecoveryKeyUsageReasonInvalidKeyFile
+	}
+	rErr := activateWithRecoveryKey(volumeName, sourceDevicePath, nil, options.RecoveryKeyTries, reason, activateOptions)
+	return rErr == nil, &ActivateWithTPMSealedKeyError{TPMErr: err, RecoveryKeyUsageErr: rErr, SealedKeyErrs: keyErrs}
 }
 
 // ActivateWithRecoveryKeyOptions provides options to ActivateVolumeWithRecoveryKey.
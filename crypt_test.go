@@ -357,6 +357,132 @@ func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyNo2FA6(c *C) {
 	})
 }
 
+func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyFromLUKS2Token(c *C) {
+	// Test that the sealed key object is read from the LUKS2 header when no key path is supplied.
+	keyData, err := ioutil.ReadFile(s.keyFile)
+	c.Assert(err, IsNil)
+	devicePath := filepath.Join(c.MkDir(), "luks2")
+	writeMockLUKS2Container(c, devicePath, map[int]interface{}{0: makeMockLUKS2KeyDataToken(0, keyData)})
+
+	options := ActivateWithTPMSealedKeyOptions{}
+	success, err := ActivateVolumeWithTPMSealedKey(s.TPM, "data", devicePath, "", nil, &options)
+	c.Check(success, Equals, true)
+	c.Check(err, IsNil)
+
+	c.Check(len(s.mockSdAskPassword.Calls()), Equals, 0)
+	c.Assert(len(s.mockSdCryptsetup.Calls()), Equals, 1)
+	c.Assert(len(s.mockSdCryptsetup.Calls()[0]), Equals, 6)
+	c.Check(s.mockSdCryptsetup.Calls()[0][0:4], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", devicePath})
+}
+
+func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyFromLUKS2TokenMissing(c *C) {
+	// Test that activation falls back to the recovery key if the LUKS2 header doesn't contain a sealed key object.
+	devicePath := filepath.Join(c.MkDir(), "luks2")
+	writeMockLUKS2Container(c, devicePath, nil)
+	c.Assert(ioutil.WriteFile(s.passwordFile, []byte(strings.Join(s.recoveryKeyAscii, "-")+"\n"), 0644), IsNil)
+
+	options := ActivateWithTPMSealedKeyOptions{RecoveryKeyTries: 1}
+	success, err := ActivateVolumeWithTPMSealedKey(s.TPM, "data", devicePath, "", nil, &options)
+	c.Check(success, Equals, true)
+	c.Check(err, ErrorMatches, "cannot activate with TPM sealed key \\(invalid key data file: no sealed key data token found in LUKS2 "+
+		"header\\) but activation with recovery key was successful")
+
+	c.Check(len(s.mockSdAskPassword.Calls()), Equals, 1)
+	c.Check(len(s.mockSdCryptsetup.Calls()), Equals, 1)
+	s.checkRecoveryKeyKeyringEntry(c, RecoveryKeyUsageReasonInvalidKeyFile)
+}
+
+// sealKeyWithUnsatisfiedPolicy creates a sealed key object for the test key with a PCR policy that can't be satisfied.
+func (s *cryptTPMSuite) sealKeyWithUnsatisfiedPolicy(c *C) string {
+	path := filepath.Join(c.MkDir(), "keydata")
+	profile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 23, make(tpm2.Digest, 32))
+	profile.ExtendPCR(tpm2.HashAlgorithmSHA256, 23, make(tpm2.Digest, 32))
+	c.Assert(SealKeyToTPM(s.TPM, s.tpmKey, path, "", &KeyCreationParams{PCRProfile: profile, PINHandle: 0x0181fff1}), IsNil)
+	pinIndex, err := s.TPM.CreateResourceContextFromTPM(0x0181fff1)
+	c.Assert(err, IsNil)
+	s.AddCleanupNVSpace(c, s.TPM.OwnerHandleContext(), pinIndex)
+	return path
+}
+
+func (s *cryptTPMSuite) TestActivateVolumeWithMultipleTPMSealedKeys(c *C) {
+	// Test that the volume is activated with the first sealed key object that can be unsealed, and that the errors for the
+	// preceding ones are reported.
+	badKeyFile := s.sealKeyWithUnsatisfiedPolicy(c)
+
+	options := ActivateWithTPMSealedKeyOptions{}
+	success, err := ActivateVolumeWithMultipleTPMSealedKeys(s.TPM, "data", "/dev/sda1", []string{badKeyFile, s.keyFile}, nil, &options)
+	c.Check(success, Equals, true)
+	c.Assert(err, FitsTypeOf, &ActivateWithTPMSealedKeyError{})
+	e := err.(*ActivateWithTPMSealedKeyError)
+	c.Check(e.ActivatedWith, Equals, s.keyFile)
+	c.Check(e.TPMErr, IsNil)
+	c.Check(e.RecoveryKeyUsageErr, IsNil)
+	c.Assert(e.SealedKeyErrs, HasLen, 1)
+	c.Check(e.SealedKeyErrs[0].Source, Equals, badKeyFile)
+	c.Check(e.SealedKeyErrs[0].Err, ErrorMatches, "cannot unseal key: .*")
+
+	c.Check(len(s.mockSdAskPassword.Calls()), Equals, 0)
+	c.Assert(len(s.mockSdCryptsetup.Calls()), Equals, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0][0:4], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1"})
+}
+
+func (s *cryptTPMSuite) TestActivateVolumeWithMultipleTPMSealedKeysFirstSucceeds(c *C) {
+	// Test that later sealed key objects aren't tried if the first one succeeds.
+	options := ActivateWithTPMSealedKeyOptions{}
+	success, err := ActivateVolumeWithMultipleTPMSealedKeys(s.TPM, "data", "/dev/sda1", []string{s.keyFile, "/path/to/nothing"}, nil, &options)
+	c.Check(success, Equals, true)
+	c.Check(err, IsNil)
+	c.Check(len(s.mockSdCryptsetup.Calls()), Equals, 1)
+}
+
+func (s *cryptTPMSuite) TestActivateVolumeWithMultipleTPMSealedKeysAllFail(c *C) {
+	// Test that activation falls back to the recovery key if all of the sealed key objects fail, and that the recovery reason is
+	// determined by the first one.
+	badKeyFile := filepath.Join(c.MkDir(), "keydata")
+	c.Assert(ioutil.WriteFile(badKeyFile, []byte("foo"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(s.passwordFile, []byte(strings.Join(s.recoveryKeyAscii, "-")+"\n"), 0644), IsNil)
+
+	options := ActivateWithTPMSealedKeyOptions{RecoveryKeyTries: 1}
+	success, err := ActivateVolumeWithMultipleTPMSealedKeys(s.TPM, "data", "/dev/sda1", []string{badKeyFile, "/path/to/nothing"}, nil, &options)
+	c.Check(success, Equals, true)
+	c.Assert(err, FitsTypeOf, &ActivateWithTPMSealedKeyError{})
+	e := err.(*ActivateWithTPMSealedKeyError)
+	c.Check(e.ActivatedWith, Equals, "")
+	c.Check(e.RecoveryKeyUsageErr, IsNil)
+	c.Assert(e.SealedKeyErrs, HasLen, 2)
+	c.Check(e.SealedKeyErrs[0].Source, Equals, badKeyFile)
+	c.Check(e.SealedKeyErrs[1].Source, Equals, "/path/to/nothing")
+	c.Check(e.TPMErr, Equals, e.SealedKeyErrs[0].Err)
+	c.Check(err, ErrorMatches, "cannot activate with TPM sealed key \\("+badKeyFile+": cannot read sealed key object: invalid key data file: .*; "+
+		"/path/to/nothing: cannot read sealed key object: cannot open key data file: .*\\) but activation with recovery key was successful")
+
+	c.Check(len(s.mockSdAskPassword.Calls()), Equals, 1)
+	c.Check(len(s.mockSdCryptsetup.Calls()), Equals, 1)
+	s.checkRecoveryKeyKeyringEntry(c, RecoveryKeyUsageReasonInvalidKeyFile)
+}
+
+func (s *cryptTPMSuite) TestActivateVolumeWithMultipleTPMSealedKeysFromLUKS2Tokens(c *C) {
+	// Test that each of the sealed key objects in the LUKS2 header is tried in order.
+	badKeyData, err := ioutil.ReadFile(s.sealKeyWithUnsatisfiedPolicy(c))
+	c.Assert(err, IsNil)
+	keyData, err := ioutil.ReadFile(s.keyFile)
+	c.Assert(err, IsNil)
+	devicePath := filepath.Join(c.MkDir(), "luks2")
+	writeMockLUKS2Container(c, devicePath, map[int]interface{}{
+		2: makeMockLUKS2KeyDataToken(0, keyData),
+		1: makeMockLUKS2KeyDataToken(1, badKeyData)})
+
+	options := ActivateWithTPMSealedKeyOptions{}
+	success, err := ActivateVolumeWithTPMSealedKey(s.TPM, "data", devicePath, "", nil, &options)
+	c.Check(success, Equals, true)
+	c.Assert(err, FitsTypeOf, &ActivateWithTPMSealedKeyError{})
+	e := err.(*ActivateWithTPMSealedKeyError)
+	c.Check(e.ActivatedWith, Equals, "LUKS2 token 2")
+	c.Assert(e.SealedKeyErrs, HasLen, 1)
+	c.Check(e.SealedKeyErrs[0].Source, Equals, "LUKS2 token 1")
+	c.Check(len(s.mockSdCryptsetup.Calls()), Equals, 1)
+}
+
 type testActivateVolumeWithTPMSealedKeyAndPINData struct {
 	pins     []string
 	pinTries int
@@ -684,6 +810,26 @@ func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyErrorHandling10(c *C)
 	})
 }
 
+func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyErrorHandling11(c *C) {
+	// Test that recovery fallback works if the sealed key object was created by SealPayloadToTPM.
+	s.keyFile = filepath.Join(c.MkDir(), "keydata")
+	c.Assert(SealPayloadToTPM(s.TPM, s.tpmKey, s.keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff1}), IsNil)
+	pinIndex, err := s.TPM.CreateResourceContextFromTPM(0x0181fff1)
+	c.Assert(err, IsNil)
+	s.AddCleanupNVSpace(c, s.TPM.OwnerHandleContext(), pinIndex)
+
+	s.testActivateVolumeWithTPMSealedKeyErrorHandling(c, &testActivateVolumeWithTPMSealedKeyErrorHandlingData{
+		recoveryKeyTries:  1,
+		passphrases:       []string{strings.Join(s.recoveryKeyAscii, "-")},
+		sdCryptsetupCalls: 1,
+		success:           true,
+		recoveryReason:    RecoveryKeyUsageReasonInvalidKeyFile,
+		errChecker:        ErrorMatches,
+		errCheckerArgs: []interface{}{"cannot activate with TPM sealed key \\(invalid key data file: sealed key object was created by " +
+			"SealPayloadToTPM and cannot be used for volume activation\\) but activation with recovery key was successful"},
+	})
+}
+
 type cryptTPMSimulatorSuite struct {
 	testutil.TPMSimulatorTestBase
 	cryptTPMTestBase
@@ -20,10 +20,22 @@
 package secboot
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"github.com/snapcore/snapd/snap"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/chrisccoulson/tcglog-parser"
+	"github.com/snapcore/secboot/internal/efi"
+	"github.com/snapcore/snapd/snap"
+
+	"golang.org/x/xerrors"
 )
 
 const (
@@ -113,6 +125,23 @@ func (p FileEFIImage) Open() (interface {
 	return &fileEFIImageHandle{f}, nil
 }
 
+// computeEFIImageFileDigest computes a digest of the entire contents of the supplied image, as opposed to the Authenticode digest
+// computed by computePeImageDigest. This is used for files that are measured as a flat binary blob, which don't need to be PE
+// images. The contents are read until EOF, as not all EFIImage implementations can determine the size of the image.
+func computeEFIImageFileDigest(alg tpm2.HashAlgorithmId, image EFIImage) (tpm2.Digest, error) {
+	r, err := image.Open()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open image: %w", err)
+	}
+	defer r.Close()
+
+	h := alg.NewHash()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, math.MaxInt64)); err != nil {
+		return nil, xerrors.Errorf("cannot read image: %w", err)
+	}
+	return h.Sum(nil), nil
+}
+
 // EFIImageLoadEventSource corresponds to the source of a EFIImageLoadEvent.
 type EFIImageLoadEventSource int
 
@@ -134,3 +163,62 @@ type EFIImageLoadEvent struct {
 	Image  EFIImage                // The image
 	Next   []*EFIImageLoadEvent    // A list of possible subsequent EFIImageLoadEvents
 }
+
+// HostEnvironment provides access to the TCG event log and EFI variables of the environment that a PCR profile is being computed
+// for. This makes it possible to compute a PCR profile for an environment other than the one that the current process is running
+// in, such as for a device image on a build server.
+type HostEnvironment interface {
+	// ReadVar returns the data and attributes associated with the EFI variable with the specified name and GUID. If the variable
+	// does not exist, the returned error should satisfy os.IsNotExist.
+	ReadVar(name string, guid *tcglog.EFIGUID) ([]byte, uint32, error)
+
+	// OpenEventLog opens the TCG event log, in binary form.
+	OpenEventLog() (interface {
+		io.ReadSeeker
+		io.Closer
+	}, error)
+}
+
+// efiVarFilename returns the name of the file in efivarfs that corresponds to the EFI variable with the specified name and GUID.
+func efiVarFilename(name string, guid *tcglog.EFIGUID) string {
+	var b [16]byte
+	w := bytes.NewBuffer(b[:0])
+	binary.Write(w, binary.LittleEndian, guid)
+	return fmt.Sprintf("%s-%08x-%04x-%04x-%04x-%012x", name, binary.LittleEndian.Uint32(b[0:4]), binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]), binary.BigEndian.Uint16(b[8:10]), b[10:16])
+}
+
+// FileHostEnvironment is an implementation of HostEnvironment that reads the TCG event log from a file and EFI variables from a
+// directory laid out in the same way as efivarfs. It can be used to compute PCR profiles from a captured event log and a copy of
+// the EFI variables of another device.
+type FileHostEnvironment struct {
+	EventLogPath string // Path of the TCG event log, in binary form
+	EFIVarsPath  string // Path of the directory containing EFI variables, in the same format as efivarfs
+}
+
+func (e *FileHostEnvironment) ReadVar(name string, guid *tcglog.EFIGUID) ([]byte, uint32, error) {
+	data, err := ioutil.ReadFile(filepath.Join(e.EFIVarsPath, efiVarFilename(name, guid)))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < 4 {
+		return nil, 0, errors.New("variable data is too short")
+	}
+	return data[4:], binary.LittleEndian.Uint32(data), nil
+}
+
+func (e *FileHostEnvironment) OpenEventLog() (interface {
+	io.ReadSeeker
+	io.Closer
+}, error) {
+	f, err := os.Open(e.EventLogPath)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// defaultHostEnvironment returns the HostEnvironment for the environment that the current process is running in.
+func defaultHostEnvironment() HostEnvironment {
+	return &FileHostEnvironment{EventLogPath: efi.EventLogPath, EFIVarsPath: efi.EFIVarsPath}
+}
@@ -25,12 +25,10 @@ import (
 	"fmt"
 	"hash"
 	"io"
-	"os"
 	"sort"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/chrisccoulson/tcglog-parser"
-	"github.com/snapcore/secboot/internal/efi"
 	"github.com/snapcore/secboot/internal/pe1.14"
 
 	"golang.org/x/xerrors"
@@ -229,6 +227,10 @@ type EFIBootManagerProfileParams struct {
 
 	// LoadSequences is a list of EFI image load sequences for which to compute PCR digests for.
 	LoadSequences []*EFIImageLoadEvent
+
+	// Environment is an optional parameter that allows the caller to provide a TCG event log from an environment other than the
+	// current one. If not set, the event log of the current host is used.
+	Environment HostEnvironment
 }
 
 // AddEFIBootManagerProfile adds the UEFI boot manager code and boot attempts profile to the provided PCR protection profile, in order
@@ -252,15 +254,24 @@ type EFIBootManagerProfileParams struct {
 // applications that load additional pre-OS environment code that isn't otherwise authenticated via the secure boot mechanism,
 // and will generate PCR profiles that aren't correct for applications that do this.
 //
+// By default, the TCG event log is read from the current host. A PCR profile can be computed for a different environment by
+// supplying a HostEnvironment via the Environment field of params (see FileHostEnvironment).
+//
 // If the EV_OMIT_BOOT_DEVICE_EVENTS is not recorded to PCR 4, the platform firmware will perform meaurements of all boot attempts,
 // even if they fail. The generated PCR policy will not be satisfied if the platform firmware performs boot attempts that fail,
 // even if the successful boot attempt is of a sequence of binaries included in this PCR profile.
 func AddEFIBootManagerProfile(profile *PCRProtectionProfile, params *EFIBootManagerProfileParams) error {
+	env := params.Environment
+	if env == nil {
+		env = defaultHostEnvironment()
+	}
+
 	// Load event log
-	eventLog, err := os.Open(efi.EventLogPath)
+	eventLog, err := env.OpenEventLog()
 	if err != nil {
 		return xerrors.Errorf("cannot open TCG event log: %w", err)
 	}
+	defer eventLog.Close()
 	log, err := tcglog.NewLog(eventLog, tcglog.LogOptions{})
 	if err != nil {
 		return xerrors.Errorf("cannot parse TCG event log header: %w", err)
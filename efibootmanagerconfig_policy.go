@@ -0,0 +1,299 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/chrisccoulson/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	bootManagerConfigPCR = 5 // Boot Manager Code Configuration and Data (and GPT/Partition Table) PCR
+
+	gptHeaderSignature = "EFI PART"
+	gptHeaderSize      = 92 // Size of EFI_PARTITION_TABLE_HEADER, which is what the firmware measures
+)
+
+// EFIBootManagerConfig describes a boot manager configuration for which to compute PCR 5 digests for. A zero value corresponds to
+// the configuration recorded in the TCG event log.
+type EFIBootManagerConfig struct {
+	// BootOrder is the expected contents of the BootOrder variable. If this is nil, the measurements of the BootOrder and
+	// Boot#### variables recorded in the TCG event log are used.
+	BootOrder []uint16
+
+	// BootOptions contains the expected contents of the Boot#### variables, keyed by option number. There must be an entry for
+	// every option in BootOrder. This is ignored if BootOrder is nil.
+	BootOptions map[uint16][]byte
+
+	// BootDisk is the path of the disk (or disk image) containing the GUID partition table from which the boot manager loads
+	// the OS loader. If this is empty, the measurement of the GUID partition table recorded in the TCG event log is used.
+	BootDisk string
+}
+
+// computeGPTEventData computes the UEFI_GPT_DATA structure that the firmware measures for the GUID partition table of the disk
+// at the specified path. This consists of the partition table header followed by the number of partitions and every partition
+// entry that is in use, in the order that they appear in the partition entry array.
+func computeGPTEventData(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// The header is in LBA 1. Try the common logical block sizes.
+	var hdr [gptHeaderSize]byte
+	var blockSize int64
+	for _, sz := range []int64{512, 4096} {
+		if _, err := f.ReadAt(hdr[:], sz); err != nil {
+			if err == io.EOF {
+				continue
+			}
+			return nil, xerrors.Errorf("cannot read partition table header: %w", err)
+		}
+		if string(hdr[0:8]) == gptHeaderSignature {
+			blockSize = sz
+			break
+		}
+	}
+	if blockSize == 0 {
+		return nil, errors.New("no GUID partition table header found")
+	}
+
+	entriesLBA := int64(binary.LittleEndian.Uint64(hdr[72:]))
+	numEntries := binary.LittleEndian.Uint32(hdr[80:])
+	entrySize := binary.LittleEndian.Uint32(hdr[84:])
+	if entrySize < 16 {
+		return nil, fmt.Errorf("invalid partition entry size %d", entrySize)
+	}
+
+	var entries bytes.Buffer
+	var numPartitions uint64
+	entry := make([]byte, entrySize)
+	zeroGuid := make([]byte, 16)
+	for i := uint32(0); i < numEntries; i++ {
+		if _, err := f.ReadAt(entry, entriesLBA*blockSize+int64(i)*int64(entrySize)); err != nil {
+			return nil, xerrors.Errorf("cannot read partition entry %d: %w", i, err)
+		}
+		if bytes.Equal(entry[0:16], zeroGuid) {
+			// This entry is unused
+			continue
+		}
+		entries.Write(entry)
+		numPartitions++
+	}
+
+	var data bytes.Buffer
+	data.Write(hdr[:])
+	binary.Write(&data, binary.LittleEndian, numPartitions)
+	data.Write(entries.Bytes())
+	return data.Bytes(), nil
+}
+
+// computeBootVariableDigests computes the digests of the events that the firmware measures for the BootOrder and Boot####
+// variables in the specified configuration. The firmware measures the contents of BootOrder followed by the contents of each
+// Boot#### variable in the order in which they appear in BootOrder. Note that whilst the "TCG PC Client Platform Firmware Profile
+// Specification" says that the entire UEFI_VARIABLE_DATA structure is measured for these events, EDK2 based firmware only
+// measures the variable contents.
+func computeBootVariableDigests(alg tpm2.HashAlgorithmId, config *EFIBootManagerConfig) (tpm2.DigestList, error) {
+	var digests tpm2.DigestList
+
+	var bootOrder bytes.Buffer
+	binary.Write(&bootOrder, binary.LittleEndian, config.BootOrder)
+	h := alg.NewHash()
+	h.Write(bootOrder.Bytes())
+	digests = append(digests, h.Sum(nil))
+
+	for _, n := range config.BootOrder {
+		option, ok := config.BootOptions[n]
+		if !ok {
+			return nil, fmt.Errorf("no contents supplied for Boot%04X", n)
+		}
+		h := alg.NewHash()
+		h.Write(option)
+		digests = append(digests, h.Sum(nil))
+	}
+
+	return digests, nil
+}
+
+// bootManagerConfigEvent corresponds to a measurement (or sequence of measurements) to PCR 5 recorded in the TCG event log.
+type bootManagerConfigEvent struct {
+	eventType tcglog.EventType
+	digests   tpm2.DigestList
+}
+
+// EFIBootManagerConfigProfileParams provide the arguments to AddEFIBootManagerConfigProfile.
+type EFIBootManagerConfigProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// Environment is an optional parameter that allows the caller to provide a TCG event log from an environment other than the
+	// current one. If not set, the event log of the current host is used.
+	Environment HostEnvironment
+
+	// Configs is an optional list of boot manager configurations for which to compute PCR digests for. If this is empty, PCR
+	// digests are computed for the configuration recorded in the TCG event log.
+	Configs []*EFIBootManagerConfig
+}
+
+// AddEFIBootManagerConfigProfile adds the UEFI boot manager configuration profile to the provided PCR protection profile, in order
+// to generate a PCR policy that restricts access to a sealed key to a specific boot manager configuration and boot disk partition
+// table, which are measured to PCR 5. Events that are measured to this PCR are detailed in section 2.3.4.6 of the "TCG PC Client
+// Platform Firmware Profile Specification".
+//
+// The PCR values are computed by replaying the events recorded to PCR 5 in the TCG event log. This includes the events measured
+// when ExitBootServices is called.
+//
+// The effect of changes to the boot manager configuration can be predicted by supplying one or more configurations via the Configs
+// field of params, in which case a PCR profile is generated that permits access to the sealed key with any of the supplied
+// configurations. A zero value EFIBootManagerConfig corresponds to the current configuration, so including one in the list allows
+// a change to be rolled out atomically. Each configuration can override the contents of the BootOrder and Boot#### variables and
+// the GUID partition table of the boot disk. The partition table is read from the disk or disk image at the path supplied via the
+// BootDisk field of EFIBootManagerConfig, and must be the one that the firmware loads the OS loader from.
+//
+// Firmware that is compliant with the "TCG PC Client Platform Firmware Profile Specification" measures the BootOrder and Boot####
+// variables to PCR 1 rather than PCR 5, and firmware compliant with the older "TCG EFI Platform Specification" measures them to
+// PCR 5. It is an error to override the boot variables in a configuration if the TCG event log indicates that these are not
+// measured to PCR 5. Similarly, it is an error to override the partition table if the TCG event log does not contain a measurement
+// of it.
+//
+// By default, the TCG event log is read from the current host. A PCR profile can be computed for a different environment by
+// supplying a HostEnvironment via the Environment field of params (see FileHostEnvironment).
+func AddEFIBootManagerConfigProfile(profile *PCRProtectionProfile, params *EFIBootManagerConfigProfileParams) error {
+	env := params.Environment
+	if env == nil {
+		env = defaultHostEnvironment()
+	}
+
+	// Load event log
+	eventLog, err := env.OpenEventLog()
+	if err != nil {
+		return xerrors.Errorf("cannot open TCG event log: %w", err)
+	}
+	defer eventLog.Close()
+	log, err := tcglog.NewLog(eventLog, tcglog.LogOptions{})
+	if err != nil {
+		return xerrors.Errorf("cannot parse TCG event log header: %w", err)
+	}
+
+	if !log.Algorithms.Contains(tcglog.AlgorithmId(params.PCRAlgorithm)) {
+		return errors.New("cannot compute boot manager config policy digests: the TCG event log does not have the requested algorithm")
+	}
+
+	// Collect the events measured to PCR 5, merging consecutive boot variable events in to a single entry as these are
+	// substituted as a group.
+	var events []*bootManagerConfigEvent
+	haveBootVariables := false
+	haveGPT := false
+	for {
+		event, err := log.NextEvent()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return xerrors.Errorf("cannot parse TCG event log: %w", err)
+		}
+
+		if event.PCRIndex != bootManagerConfigPCR || event.EventType == tcglog.EventTypeNoAction {
+			continue
+		}
+
+		digest := tpm2.Digest(event.Digests[tcglog.AlgorithmId(params.PCRAlgorithm)])
+
+		switch event.EventType {
+		case tcglog.EventTypeEFIVariableBoot:
+			haveBootVariables = true
+			if len(events) > 0 && events[len(events)-1].eventType == tcglog.EventTypeEFIVariableBoot {
+				events[len(events)-1].digests = append(events[len(events)-1].digests, digest)
+				continue
+			}
+		case tcglog.EventTypeEFIGPTEvent:
+			haveGPT = true
+		}
+
+		events = append(events, &bootManagerConfigEvent{eventType: event.EventType, digests: tpm2.DigestList{digest}})
+	}
+
+	configs := params.Configs
+	if len(configs) == 0 {
+		configs = []*EFIBootManagerConfig{{}}
+	}
+
+	var branches []*PCRProtectionProfile
+	for i, config := range configs {
+		var bootVariableDigests tpm2.DigestList
+		if config.BootOrder != nil {
+			if !haveBootVariables {
+				return fmt.Errorf("cannot compute PCR digests for config %d: the TCG event log does not contain measurements of "+
+					"boot variables to PCR %d", i, bootManagerConfigPCR)
+			}
+			d, err := computeBootVariableDigests(params.PCRAlgorithm, config)
+			if err != nil {
+				return xerrors.Errorf("cannot compute boot variable digests for config %d: %w", i, err)
+			}
+			bootVariableDigests = d
+		}
+
+		var gptDigest tpm2.Digest
+		if config.BootDisk != "" {
+			if !haveGPT {
+				return fmt.Errorf("cannot compute PCR digests for config %d: the TCG event log does not contain a measurement of "+
+					"the GUID partition table", i)
+			}
+			data, err := computeGPTEventData(config.BootDisk)
+			if err != nil {
+				return xerrors.Errorf("cannot compute GUID partition table measurement for config %d: %w", i, err)
+			}
+			h := params.PCRAlgorithm.NewHash()
+			h.Write(data)
+			gptDigest = h.Sum(nil)
+		}
+
+		branch := NewPCRProtectionProfile()
+		branch.AddPCRValue(params.PCRAlgorithm, bootManagerConfigPCR, make(tpm2.Digest, params.PCRAlgorithm.Size()))
+		for _, e := range events {
+			digests := e.digests
+			switch {
+			case e.eventType == tcglog.EventTypeEFIVariableBoot && bootVariableDigests != nil:
+				digests = bootVariableDigests
+			case e.eventType == tcglog.EventTypeEFIGPTEvent && gptDigest != nil:
+				digests = tpm2.DigestList{gptDigest}
+			}
+			for _, d := range digests {
+				branch.ExtendPCR(params.PCRAlgorithm, bootManagerConfigPCR, d)
+			}
+		}
+		branches = append(branches, branch)
+	}
+
+	profile.AddProfileOR(branches...)
+	return nil
+}
@@ -0,0 +1,153 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type efiBootManagerConfigPolicySuite struct{}
+
+var _ = Suite(&efiBootManagerConfigPolicySuite{})
+
+type testAddEFIBootManagerConfigProfileData struct {
+	eventLogPath string
+	configs      []*EFIBootManagerConfig
+	values       []tpm2.PCRValues
+}
+
+func (s *efiBootManagerConfigPolicySuite) testAddEFIBootManagerConfigProfile(c *C, data *testAddEFIBootManagerConfigProfileData) {
+	expectedPcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{5}}}
+	var expectedDigests tpm2.DigestList
+	for _, v := range data.values {
+		d, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, expectedPcrs, v)
+		expectedDigests = append(expectedDigests, d)
+	}
+
+	profile := NewPCRProtectionProfile()
+	c.Assert(AddEFIBootManagerConfigProfile(profile, &EFIBootManagerConfigProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		Environment:  &FileHostEnvironment{EventLogPath: data.eventLogPath},
+		Configs:      data.configs}), IsNil)
+	pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	c.Check(pcrs.Equal(expectedPcrs), Equals, true)
+	c.Check(digests, DeepEquals, expectedDigests)
+	if c.Failed() {
+		c.Logf("Profile:\n%s", profile)
+		c.Logf("Values:\n%s", profile.DumpValues(nil))
+	}
+}
+
+func (s *efiBootManagerConfigPolicySuite) TestAddEFIBootManagerConfigProfileFromLog(c *C) {
+	s.testAddEFIBootManagerConfigProfile(c, &testAddEFIBootManagerConfigProfileData{
+		eventLogPath: "testdata/eventlog1.bin",
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					5: testutil.DecodeHexString(c, "4b0d6adaf13599aa00d932ab48387a9247d33e88d2fa78ec5ed7dcc1c7dcf05b"),
+				},
+			},
+		},
+	})
+}
+
+func (s *efiBootManagerConfigPolicySuite) TestAddEFIBootManagerConfigProfileSameGPT(c *C) {
+	// gpt1.img contains the same partition table that is measured in the event log.
+	s.testAddEFIBootManagerConfigProfile(c, &testAddEFIBootManagerConfigProfileData{
+		eventLogPath: "testdata/eventlog1.bin",
+		configs:      []*EFIBootManagerConfig{{BootDisk: "testdata/gpt1.img"}},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					5: testutil.DecodeHexString(c, "4b0d6adaf13599aa00d932ab48387a9247d33e88d2fa78ec5ed7dcc1c7dcf05b"),
+				},
+			},
+		},
+	})
+}
+
+func (s *efiBootManagerConfigPolicySuite) TestAddEFIBootManagerConfigProfileNewGPT(c *C) {
+	s.testAddEFIBootManagerConfigProfile(c, &testAddEFIBootManagerConfigProfileData{
+		eventLogPath: "testdata/eventlog1.bin",
+		configs:      []*EFIBootManagerConfig{{}, {BootDisk: "testdata/gpt2.img"}},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					5: testutil.DecodeHexString(c, "4b0d6adaf13599aa00d932ab48387a9247d33e88d2fa78ec5ed7dcc1c7dcf05b"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					5: testutil.DecodeHexString(c, "b1d6b631b96af5d1ea0e9db27141c9439599c65365ef8b97a1141286207bab3a"),
+				},
+			},
+		},
+	})
+}
+
+func (s *efiBootManagerConfigPolicySuite) TestAddEFIBootManagerConfigProfileNewBootOrder(c *C) {
+	s.testAddEFIBootManagerConfigProfile(c, &testAddEFIBootManagerConfigProfileData{
+		eventLogPath: "testdata/eventlog4.bin",
+		configs: []*EFIBootManagerConfig{
+			{},
+			{
+				BootOrder: []uint16{3, 1},
+				BootOptions: map[uint16][]byte{
+					1: []byte("mock boot option 1"),
+					3: []byte("mock boot option 3"),
+				},
+			},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					5: testutil.DecodeHexString(c, "c9ffa1cda04d3675f0f418d42db9eea62f285f64fac21b9dcaa2e5e823433a41"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					5: testutil.DecodeHexString(c, "9e8fb5148feeff5903eacc30b75dd515c1bcb254fa851d6957fec5013d0b3635"),
+				},
+			},
+		},
+	})
+}
+
+func (s *efiBootManagerConfigPolicySuite) TestAddEFIBootManagerConfigProfileNoBootVariables(c *C) {
+	err := AddEFIBootManagerConfigProfile(NewPCRProtectionProfile(), &EFIBootManagerConfigProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		Environment:  &FileHostEnvironment{EventLogPath: "testdata/eventlog1.bin"},
+		Configs:      []*EFIBootManagerConfig{{BootOrder: []uint16{1}, BootOptions: map[uint16][]byte{1: []byte("foo")}}}})
+	c.Check(err, ErrorMatches, "cannot compute PCR digests for config 0: the TCG event log does not contain measurements of boot "+
+		"variables to PCR 5")
+}
+
+func (s *efiBootManagerConfigPolicySuite) TestAddEFIBootManagerConfigProfileMissingBootOption(c *C) {
+	err := AddEFIBootManagerConfigProfile(NewPCRProtectionProfile(), &EFIBootManagerConfigProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		Environment:  &FileHostEnvironment{EventLogPath: "testdata/eventlog4.bin"},
+		Configs:      []*EFIBootManagerConfig{{BootOrder: []uint16{3, 10}, BootOptions: map[uint16][]byte{3: []byte("foo")}}}})
+	c.Check(err, ErrorMatches, "cannot compute boot variable digests for config 0: no contents supplied for Boot000A")
+}
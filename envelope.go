@@ -0,0 +1,84 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	envelopeKeySize = 32 // Size of the AES-256 wrapping key that is sealed to the TPM for envelope mode sealed key objects
+
+	// maxEnvelopePayloadSize is the maximum size of the payload that can be protected by a envelope mode sealed key object. This is
+	// far in excess of what is required, but stops a corrupted key data file from causing a large allocation.
+	maxEnvelopePayloadSize = 16 * 1024 * 1024
+)
+
+// newEnvelopeAEAD returns an AES-256-GCM instance for the supplied wrapping key.
+func newEnvelopeAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != envelopeKeySize {
+		return nil, fmt.Errorf("invalid wrapping key length (%d)", len(key))
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create cipher: %w", err)
+	}
+	return cipher.NewGCM(b)
+}
+
+// encryptEnvelopePayload encrypts and authenticates the supplied payload with the supplied wrapping key using AES-256-GCM. The
+// returned data consists of a randomly generated nonce followed by the ciphertext and authentication tag.
+func encryptEnvelopePayload(key, payload []byte) ([]byte, error) {
+	aead, err := newEnvelopeAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, xerrors.Errorf("cannot obtain nonce: %w", err)
+	}
+
+	return aead.Seal(nonce, nonce, payload, nil), nil
+}
+
+// decryptEnvelopePayload authenticates and decrypts data created by encryptEnvelopePayload with the supplied wrapping key.
+func decryptEnvelopePayload(key, data []byte) ([]byte, error) {
+	aead, err := newEnvelopeAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("encrypted payload is too short")
+	}
+
+	payload, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot authenticate payload: %w", err)
+	}
+	return payload, nil
+}
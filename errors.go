@@ -22,6 +22,7 @@ package secboot
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/canonical/go-tpm2"
 
@@ -125,6 +126,18 @@ func isInvalidKeyFileError(err error) bool {
 	return xerrors.As(err, &e)
 }
 
+// PCRProtectionProfileLimitError is returned from SealKeyToTPM and UpdateKeyPCRProtectionPolicyWithLimits if the PCR policy
+// generated from the supplied PCRProtectionProfile exceeds one of the supplied PCRProtectionProfileLimits.
+type PCRProtectionProfileLimitError struct {
+	Limit string // The name of the field in PCRProtectionProfileLimits corresponding to the limit that was exceeded
+	Value uint64 // The value computed from the profile
+	Max   uint64 // The value of the limit
+}
+
+func (e PCRProtectionProfileLimitError) Error() string {
+	return fmt.Sprintf("the PCR protection profile exceeds the %s limit (%d > %d)", e.Limit, e.Value, e.Max)
+}
+
 // LockAccessToSealedKeysError is returned from ActivateVolumeWithTPMSealedKey if an error occurred whilst trying to lock access
 // to sealed keys created by this package.
 type LockAccessToSealedKeysError string
@@ -133,19 +146,57 @@ func (e LockAccessToSealedKeysError) Error() string {
 	return "cannot lock access to sealed keys: " + string(e)
 }
 
-// ActivateWithTPMSealedKeyError is returned from ActivateVolumeWithTPMSealedKey if activation with the TPM protected key failed.
+// SealedKeyObjectError details an error that occurred whilst trying to activate a volume with a specific TPM sealed key object.
+type SealedKeyObjectError struct {
+	Source string // The path of the key data file, or a description of the LUKS2 token that the sealed key object was read from
+	Err    error
+}
+
+func (e *SealedKeyObjectError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Source, e.Err)
+}
+
+func (e *SealedKeyObjectError) Unwrap() error {
+	return e.Err
+}
+
+// ActivateWithTPMSealedKeyError is returned from ActivateVolumeWithTPMSealedKey and ActivateVolumeWithMultipleTPMSealedKeys if
+// activation with the TPM protected key failed, or if activation succeeded with a TPM protected key other than the first one
+// that was tried.
 type ActivateWithTPMSealedKeyError struct {
-	// TPMErr details the error that occurred during activation with the TPM sealed key.
+	// TPMErr details the error that occurred during activation with the TPM sealed key. If more than one sealed key object was
+	// tried, this is the error for the first one. This is nil if the volume was activated with a sealed key object other than the
+	// first one.
 	TPMErr error
 
 	// RecoveryKeyUsageErr details the error that occurred during activation with the fallback recovery key, if activation with the recovery key
 	// was also unsuccessful.
 	RecoveryKeyUsageErr error
+
+	// SealedKeyErrs details the errors that occurred with each of the sealed key objects that failed, in the order that they were
+	// tried.
+	SealedKeyErrs []*SealedKeyObjectError
+
+	// ActivatedWith is the source of the sealed key object that the volume was activated with, if activation succeeded with a
+	// sealed key object other than the first one. It is empty otherwise.
+	ActivatedWith string
 }
 
 func (e *ActivateWithTPMSealedKeyError) Error() string {
-	if e.RecoveryKeyUsageErr != nil {
-		return fmt.Sprintf("cannot activate with TPM sealed key (%v) and activation with recovery key failed (%v)", e.TPMErr, e.RecoveryKeyUsageErr)
+	tpmErr := fmt.Sprintf("%v", e.TPMErr)
+	if len(e.SealedKeyErrs) > 1 || e.ActivatedWith != "" {
+		var errs []string
+		for _, err := range e.SealedKeyErrs {
+			errs = append(errs, err.Error())
+		}
+		tpmErr = strings.Join(errs, "; ")
+	}
+
+	switch {
+	case e.ActivatedWith != "":
+		return fmt.Sprintf("activated with TPM sealed key from %s after other sealed keys failed (%s)", e.ActivatedWith, tpmErr)
+	case e.RecoveryKeyUsageErr != nil:
+		return fmt.Sprintf("cannot activate with TPM sealed key (%s) and activation with recovery key failed (%v)", tpmErr, e.RecoveryKeyUsageErr)
 	}
-	return fmt.Sprintf("cannot activate with TPM sealed key (%v) but activation with recovery key was successful", e.TPMErr)
+	return fmt.Sprintf("cannot activate with TPM sealed key (%s) but activation with recovery key was successful", tpmErr)
 }
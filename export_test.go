@@ -22,6 +22,7 @@ package secboot
 import (
 	"bytes"
 	"crypto/rsa"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"os"
@@ -41,6 +42,7 @@ const (
 
 // Export variables and unexported functions for testing
 var (
+	AuthenticodeDigestAlgorithmId            = authenticodeDigestAlgorithmId
 	ComputeDbUpdate                          = computeDbUpdate
 	ComputeDynamicPolicy                     = computeDynamicPolicy
 	ComputePeImageDigest                     = computePeImageDigest
@@ -51,11 +53,16 @@ var (
 	CreatePublicAreaForRSASigningKey         = createPublicAreaForRSASigningKey
 	DecodeSecureBootDb                       = decodeSecureBootDb
 	DecodeWinCertificate                     = decodeWinCertificate
+	EFICertSha256Guid                        = efiCertSha256Guid
+	EFICertSha384Guid                        = efiCertSha384Guid
+	EFICertSha512Guid                        = efiCertSha512Guid
 	EFICertTypePkcs7Guid                     = efiCertTypePkcs7Guid
 	EFICertX509Guid                          = efiCertX509Guid
+	EFIImageSecurityDatabaseGuid             = efiImageSecurityDatabaseGuid
 	EnsureLockNVIndex                        = ensureLockNVIndex
 	ExecutePolicySession                     = executePolicySession
 	IdentifyInitialOSLaunchVerificationEvent = identifyInitialOSLaunchVerificationEvent
+	ImageDigestSignatureType                 = imageDigestSignatureType
 	IncrementDynamicPolicyCounter            = incrementDynamicPolicyCounter
 	IsDynamicPolicyDataError                 = isDynamicPolicyDataError
 	IsStaticPolicyDataError                  = isStaticPolicyDataError
@@ -64,6 +71,7 @@ var (
 	ReadAndValidateLockNVIndexPublic         = readAndValidateLockNVIndexPublic
 	ReadDynamicPolicyCounter                 = readDynamicPolicyCounter
 	ReadShimVendorCert                       = readShimVendorCert
+	ShimGuid                                 = shimGuid
 	WinCertTypePKCSSignedData                = winCertTypePKCSSignedData
 	WinCertTypeEfiGuid                       = winCertTypeEfiGuid
 )
@@ -88,6 +96,10 @@ func (s *EFISignatureData) Data() []byte {
 
 type SecureBootVerificationEvent = secureBootVerificationEvent
 
+func (u *EFISignatureDbUpdate) NumSignerInfos() int {
+	return len(u.signature.Signers)
+}
+
 func (e *SecureBootVerificationEvent) MeasuredInPreOS() bool {
 	return e.measuredInPreOS
 }
@@ -126,6 +138,11 @@ func GetWinCertificateType(cert winCertificate) uint16 {
 	return cert.wCertificateType()
 }
 
+func AuthenticodeSignerChainsTo(signer *x509.Certificate, intermediates []*x509.Certificate, ca *x509.Certificate) bool {
+	s := &authenticodeSignerAndIntermediates{signer: signer, intermediates: intermediates}
+	return s.chainsTo(ca)
+}
+
 type MockPolicyPCRParam struct {
 	PCR     int
 	Alg     tpm2.HashAlgorithmId
@@ -201,6 +218,14 @@ func (p *PCRProtectionProfile) ComputePCRDigests(tpm *tpm2.TPMContext, alg tpm2.
 	return p.computePCRDigests(tpm, alg)
 }
 
+func (p *PCRProtectionProfile) ComputePCRValues(tpm *tpm2.TPMContext) ([]tpm2.PCRValues, error) {
+	values, err := p.computePCRValues(tpm)
+	if err != nil {
+		return nil, err
+	}
+	return []tpm2.PCRValues(values), nil
+}
+
 func (p *PCRProtectionProfile) DumpValues(tpm *tpm2.TPMContext) string {
 	values, err := p.computePCRValues(tpm)
 	if err != nil {
@@ -239,3 +264,19 @@ func ValidateKeyDataFile(tpm *tpm2.TPMContext, keyFile, privateFile string, sess
 	_, _, _, err = decodeAndValidateKeyData(tpm, kf, pf, session)
 	return err
 }
+
+// WriteKeyDataFileWithVersion rewrites the key data file at src to dst, using the specified version of the on-disk format.
+func WriteKeyDataFileWithVersion(src, dst string, version uint32) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := decodeKeyData(f)
+	if err != nil {
+		return err
+	}
+	data.version = version
+	return data.writeToFileAtomic(dst)
+}
@@ -0,0 +1,140 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	grubStringPCR = 8 // PCR that GRUB measures commands and command lines to
+	grubBinaryPCR = 9 // PCR that GRUB measures loaded files to
+)
+
+// GRUBEventType corresponds to the type of a GRUBEvent.
+type GRUBEventType int
+
+const (
+	// GRUBCommand corresponds to a command executed by GRUB, such as a command from grub.cfg. The Str field of GRUBEvent contains
+	// the command and its arguments separated by single spaces, after variable expansion (eg, "set root=(hd0,gpt1)"). This is
+	// measured to PCR 8.
+	GRUBCommand GRUBEventType = iota
+
+	// GRUBKernelCmdline corresponds to the kernel command line constructed by the linux command. The Str field of GRUBEvent contains
+	// the command line exactly as it is passed to the kernel, including the "BOOT_IMAGE=" argument that GRUB prepends to it. This is
+	// measured to PCR 8.
+	GRUBKernelCmdline
+
+	// GRUBModuleCmdline corresponds to the command line of a module loaded by the multiboot or xen loaders. The Str field of
+	// GRUBEvent contains the command line. This is measured to PCR 8.
+	GRUBModuleCmdline
+
+	// GRUBFile corresponds to a file that is opened and read by GRUB, such as a configuration file, kernel, initrd, font or GRUB
+	// module. The File field of GRUBEvent provides access to the contents of the file. This is measured to PCR 9.
+	GRUBFile
+)
+
+// GRUBEvent corresponds to a single measurement performed by GRUB.
+type GRUBEvent struct {
+	Type GRUBEventType // The type of event
+	Str  string        // The measured string, for GRUBCommand, GRUBKernelCmdline and GRUBModuleCmdline events
+	File EFIImage      // The measured file, for GRUBFile events
+}
+
+// GRUBProfileParams provide the arguments to AddGRUBProfile.
+type GRUBProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// EventSequences is a list of sequences of GRUB measurements for which to compute PCR digests for. Each sequence corresponds
+	// to a single path through GRUB, such as the boot of a specific menu entry, and must contain the events in the order that
+	// GRUB performs them.
+	EventSequences [][]*GRUBEvent
+}
+
+// computeGRUBEventDigest computes the digest of the data that GRUB measures for the supplied event, and returns it along with the
+// PCR that the event is measured to.
+func computeGRUBEventDigest(alg tpm2.HashAlgorithmId, event *GRUBEvent) (int, tpm2.Digest, error) {
+	switch event.Type {
+	case GRUBCommand, GRUBKernelCmdline, GRUBModuleCmdline:
+		// GRUB measures the string without the NULL terminator. The event description contains a prefix indicating the type of
+		// string, but this isn't part of the measured data.
+		h := alg.NewHash()
+		h.Write([]byte(event.Str))
+		return grubStringPCR, h.Sum(nil), nil
+	case GRUBFile:
+		if event.File == nil {
+			return 0, nil, errors.New("no file supplied")
+		}
+		digest, err := computeEFIImageFileDigest(alg, event.File)
+		if err != nil {
+			return 0, nil, xerrors.Errorf("cannot compute digest of %s: %w", event.File, err)
+		}
+		return grubBinaryPCR, digest, nil
+	default:
+		return 0, nil, fmt.Errorf("invalid event type %d", event.Type)
+	}
+}
+
+// AddGRUBProfile adds the GRUB measured boot profile to the provided PCR protection profile, in order to generate a PCR policy that
+// restricts access to a sealed key to a specific set of GRUB commands, kernel command lines and files loaded by GRUB. When GRUB's
+// tpm module is enabled, GRUB measures every command that it executes and every kernel or module command line that it constructs
+// to PCR 8, and the contents of every file that it opens to PCR 9.
+//
+// The sequences of measurements for which to generate a PCR profile for are supplied via the EventSequences field of params. Each
+// sequence must include every measurement that GRUB performs, including the commands it executes from grub.cfg and the files
+// that it reads, such as grub.cfg itself, any GRUB modules or fonts, the kernel and the initrd. Note that GRUB measures the
+// contents of files exactly as they are read from disk.
+//
+// This function initializes PCRs 8 and 9 to zero before extending them with the measurements in each sequence. Components that
+// perform measurements to these PCRs after GRUB (such as a kernel that measures its initrd to PCR 9) can be included by adding
+// their profiles after calling this function.
+func AddGRUBProfile(profile *PCRProtectionProfile, params *GRUBProfileParams) error {
+	if len(params.EventSequences) == 0 {
+		return errors.New("no event sequences specified")
+	}
+
+	var branches []*PCRProtectionProfile
+	for i, sequence := range params.EventSequences {
+		branch := NewPCRProtectionProfile()
+		branch.AddPCRValue(params.PCRAlgorithm, grubStringPCR, make(tpm2.Digest, params.PCRAlgorithm.Size()))
+		branch.AddPCRValue(params.PCRAlgorithm, grubBinaryPCR, make(tpm2.Digest, params.PCRAlgorithm.Size()))
+
+		for j, event := range sequence {
+			pcr, digest, err := computeGRUBEventDigest(params.PCRAlgorithm, event)
+			if err != nil {
+				return xerrors.Errorf("cannot compute digest for event %d in sequence %d: %w", j, i, err)
+			}
+			branch.ExtendPCR(params.PCRAlgorithm, pcr, digest)
+		}
+
+		branches = append(branches, branch)
+	}
+
+	profile.AddProfileOR(branches...)
+	return nil
+}
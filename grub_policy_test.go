@@ -0,0 +1,121 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type grubPolicySuite struct{}
+
+var _ = Suite(&grubPolicySuite{})
+
+type testAddGRUBProfileData struct {
+	sequences [][]*GRUBEvent
+	values    []tpm2.PCRValues
+}
+
+func (s *grubPolicySuite) testAddGRUBProfile(c *C, data *testAddGRUBProfileData) {
+	expectedPcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{8, 9}}}
+	var expectedDigests tpm2.DigestList
+	for _, v := range data.values {
+		d, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, expectedPcrs, v)
+		expectedDigests = append(expectedDigests, d)
+	}
+
+	profile := NewPCRProtectionProfile()
+	c.Assert(AddGRUBProfile(profile, &GRUBProfileParams{
+		PCRAlgorithm:   tpm2.HashAlgorithmSHA256,
+		EventSequences: data.sequences}), IsNil)
+	pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	c.Check(pcrs.Equal(expectedPcrs), Equals, true)
+	c.Check(digests, DeepEquals, expectedDigests)
+	if c.Failed() {
+		c.Logf("Profile:\n%s", profile)
+		c.Logf("Values:\n%s", profile.DumpValues(nil))
+	}
+}
+
+func (s *grubPolicySuite) TestAddGRUBProfile1(c *C) {
+	s.testAddGRUBProfile(c, &testAddGRUBProfileData{
+		sequences: [][]*GRUBEvent{
+			{
+				{Type: GRUBCommand, Str: "set root=(hd0,gpt2)"},
+				{Type: GRUBCommand, Str: "linux /vmlinuz root=/dev/sda2 ro quiet"},
+				{Type: GRUBFile, File: FileEFIImage("testdata/mockkernel1.efi")},
+				{Type: GRUBKernelCmdline, Str: "BOOT_IMAGE=/vmlinuz root=/dev/sda2 ro quiet"},
+			},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					8: testutil.DecodeHexString(c, "c919f952f28038585cf0dd110059587fffa6719035abe8d825b727d864d29cc6"),
+					9: testutil.DecodeHexString(c, "39307cbc875776ac14ae1bfb878b69137f6aa2aa4f65a17da4acfd7e5f93fa72"),
+				},
+			},
+		},
+	})
+}
+
+func (s *grubPolicySuite) TestAddGRUBProfile2(c *C) {
+	s.testAddGRUBProfile(c, &testAddGRUBProfileData{
+		sequences: [][]*GRUBEvent{
+			{
+				{Type: GRUBCommand, Str: "set root=(hd0,gpt2)"},
+				{Type: GRUBCommand, Str: "linux /vmlinuz root=/dev/sda2 ro quiet"},
+				{Type: GRUBFile, File: FileEFIImage("testdata/mockkernel1.efi")},
+				{Type: GRUBKernelCmdline, Str: "BOOT_IMAGE=/vmlinuz root=/dev/sda2 ro quiet"},
+			},
+			{
+				{Type: GRUBCommand, Str: "set root=(hd0,gpt2)"},
+				{Type: GRUBCommand, Str: "linux /vmlinuz root=/dev/sda2 ro recovery"},
+				{Type: GRUBFile, File: FileEFIImage("testdata/mockkernel1.efi")},
+				{Type: GRUBKernelCmdline, Str: "BOOT_IMAGE=/vmlinuz root=/dev/sda2 ro recovery"},
+				{Type: GRUBFile, File: FileEFIImage("testdata/mockgrub1.efi.signed.shim")},
+			},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					8: testutil.DecodeHexString(c, "c919f952f28038585cf0dd110059587fffa6719035abe8d825b727d864d29cc6"),
+					9: testutil.DecodeHexString(c, "39307cbc875776ac14ae1bfb878b69137f6aa2aa4f65a17da4acfd7e5f93fa72"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					8: testutil.DecodeHexString(c, "b6eebee04e67259df20c9bd133d6697c2f98730007d63fc08e770f216f6e61f8"),
+					9: testutil.DecodeHexString(c, "1ef80c0016c09d732a398c61fd5146282f5e8f625771c36ffe7e6476aee442c5"),
+				},
+			},
+		},
+	})
+}
+
+func (s *grubPolicySuite) TestAddGRUBProfileNoFile(c *C) {
+	err := AddGRUBProfile(NewPCRProtectionProfile(), &GRUBProfileParams{
+		PCRAlgorithm:   tpm2.HashAlgorithmSHA256,
+		EventSequences: [][]*GRUBEvent{{{Type: GRUBCommand, Str: "foo"}, {Type: GRUBFile}}}})
+	c.Check(err, ErrorMatches, "cannot compute digest for event 1 in sequence 0: no file supplied")
+}
@@ -0,0 +1,71 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const kernelInitrdPCR = 9 // PCR that the Linux EFI stub measures the initrd to
+
+// KernelInitrdProfileParams provide the arguments to AddKernelInitrdProfile.
+type KernelInitrdProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// Initrds is a list of initrd images for which to compute PCR digests for. These can be files on disk (see FileEFIImage) or
+	// files contained within a snap (see SnapFileEFIImage).
+	Initrds []EFIImage
+}
+
+// AddKernelInitrdProfile adds the kernel initrd profile to the provided PCR protection profile, in order to generate a PCR policy
+// that restricts access to a sealed key to a specific set of initrd images. When the Linux EFI stub loads an initrd via the
+// LINUX_EFI_INITRD_MEDIA_GUID LoadFile2 protocol, it measures the entire contents of the initrd to PCR 9 using a EV_EVENT_TAG
+// event with the description "Linux initrd".
+//
+// The initrd images for which to generate a PCR profile for are supplied via the Initrds field of params. If more than one image
+// is supplied, the generated PCR profile will permit access to the sealed key when booting with any of them.
+//
+// This function extends PCR 9 rather than initializing it, so that it can be combined with profiles for components that perform
+// measurements to PCR 9 before the kernel (such as GRUB - see AddGRUBProfile), which must be added to the profile first. If no
+// value has been set for PCR 9 previously, it is initialized to zero.
+func AddKernelInitrdProfile(profile *PCRProtectionProfile, params *KernelInitrdProfileParams) error {
+	if len(params.Initrds) == 0 {
+		return errors.New("no initrd images specified")
+	}
+
+	var branches []*PCRProtectionProfile
+	for _, initrd := range params.Initrds {
+		digest, err := computeEFIImageFileDigest(params.PCRAlgorithm, initrd)
+		if err != nil {
+			return xerrors.Errorf("cannot compute digest of initrd %s: %w", initrd, err)
+		}
+		branches = append(branches, NewPCRProtectionProfile().ExtendPCR(params.PCRAlgorithm, kernelInitrdPCR, digest))
+	}
+
+	profile.AddProfileOR(branches...)
+	return nil
+}
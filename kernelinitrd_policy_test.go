@@ -0,0 +1,119 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type kernelInitrdPolicySuite struct{}
+
+var _ = Suite(&kernelInitrdPolicySuite{})
+
+type testAddKernelInitrdProfileData struct {
+	initial *PCRProtectionProfile
+	initrds []EFIImage
+	pcrs    []int
+	values  []tpm2.PCRValues
+}
+
+func (s *kernelInitrdPolicySuite) testAddKernelInitrdProfile(c *C, data *testAddKernelInitrdProfileData) {
+	expectedPcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: data.pcrs}}
+	var expectedDigests tpm2.DigestList
+	for _, v := range data.values {
+		d, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, expectedPcrs, v)
+		expectedDigests = append(expectedDigests, d)
+	}
+
+	profile := data.initial
+	if profile == nil {
+		profile = NewPCRProtectionProfile()
+	}
+	c.Assert(AddKernelInitrdProfile(profile, &KernelInitrdProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		Initrds:      data.initrds}), IsNil)
+	pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	c.Check(pcrs.Equal(expectedPcrs), Equals, true)
+	c.Check(digests, DeepEquals, expectedDigests)
+	if c.Failed() {
+		c.Logf("Profile:\n%s", profile)
+		c.Logf("Values:\n%s", profile.DumpValues(nil))
+	}
+}
+
+func (s *kernelInitrdPolicySuite) TestAddKernelInitrdProfile(c *C) {
+	s.testAddKernelInitrdProfile(c, &testAddKernelInitrdProfileData{
+		initrds: []EFIImage{FileEFIImage("testdata/mockkernel1.efi"), FileEFIImage("testdata/mockgrub1.efi.signed.shim")},
+		pcrs:    []int{9},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					9: testutil.DecodeHexString(c, "39307cbc875776ac14ae1bfb878b69137f6aa2aa4f65a17da4acfd7e5f93fa72"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					9: testutil.DecodeHexString(c, "74c34547f695999c33a17036e564b4d05a01c2e9797a022a4be75b0d838c16b8"),
+				},
+			},
+		},
+	})
+}
+
+func (s *kernelInitrdPolicySuite) TestAddKernelInitrdProfileAfterGRUB(c *C) {
+	initial := NewPCRProtectionProfile()
+	c.Assert(AddGRUBProfile(initial, &GRUBProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		EventSequences: [][]*GRUBEvent{
+			{
+				{Type: GRUBCommand, Str: "set root=(hd0,gpt2)"},
+				{Type: GRUBCommand, Str: "linux /vmlinuz root=/dev/sda2 ro quiet"},
+				{Type: GRUBFile, File: FileEFIImage("testdata/mockkernel1.efi")},
+				{Type: GRUBKernelCmdline, Str: "BOOT_IMAGE=/vmlinuz root=/dev/sda2 ro quiet"},
+			},
+		}}), IsNil)
+
+	s.testAddKernelInitrdProfile(c, &testAddKernelInitrdProfileData{
+		initial: initial,
+		initrds: []EFIImage{FileEFIImage("testdata/mockgrub1.efi.signed.shim")},
+		pcrs:    []int{8, 9},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					8: testutil.DecodeHexString(c, "c919f952f28038585cf0dd110059587fffa6719035abe8d825b727d864d29cc6"),
+					9: testutil.DecodeHexString(c, "1ef80c0016c09d732a398c61fd5146282f5e8f625771c36ffe7e6476aee442c5"),
+				},
+			},
+		},
+	})
+}
+
+func (s *kernelInitrdPolicySuite) TestAddKernelInitrdProfileMissingFile(c *C) {
+	err := AddKernelInitrdProfile(NewPCRProtectionProfile(), &KernelInitrdProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		Initrds:      []EFIImage{FileEFIImage("testdata/nonexistent")}})
+	c.Check(err, ErrorMatches, "cannot compute digest of initrd testdata/nonexistent: cannot open image: open testdata/nonexistent: "+
+		"no such file or directory")
+}
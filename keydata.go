@@ -22,8 +22,10 @@ package secboot
 import (
 	"bytes"
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -39,7 +41,7 @@ import (
 )
 
 const (
-	currentMetadataVersion    uint32 = 0
+	currentMetadataVersion    uint32 = 2
 	keyDataHeader             uint32 = 0x55534b24
 	keyPolicyUpdateDataHeader uint32 = 0x55534b50
 )
@@ -52,7 +54,8 @@ const (
 	AuthModePIN
 )
 
-// keyPolicyUpdateDataRaw_v0 is version 0 of the on-disk format of keyPolicyUpdateData.
+// keyPolicyUpdateDataRaw_v0 is version 0 of the on-disk format of keyPolicyUpdateData. Version 0 encodes AuthKey as a PKCS#1 RSA
+// private key, and later versions encode it as a PKCS#8 private key.
 type keyPolicyUpdateDataRaw_v0 struct {
 	AuthKey        []byte
 	CreationData   *tpm2.CreationData
@@ -63,15 +66,59 @@ type keyPolicyUpdateDataRaw_v0 struct {
 // authorization policies.
 type keyPolicyUpdateData struct {
 	version        uint32
-	authKey        *rsa.PrivateKey
+	authKey        crypto.PrivateKey
 	creationInfo   tpm2.Data
 	creationData   *tpm2.CreationData
 	creationTicket *tpm2.TkCreation
 }
 
+// marshalPolicyUpdateAuthKey serializes the private key used for signing dynamic authorization policies using the encoding
+// associated with the specified metadata version. Version 0 only supports RSA keys.
+func marshalPolicyUpdateAuthKey(version uint32, key crypto.PrivateKey) ([]byte, error) {
+	switch version {
+	case 0:
+		k, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %T for version %d", key, version)
+		}
+		return x509.MarshalPKCS1PrivateKey(k), nil
+	case 1, 2:
+		return x509.MarshalPKCS8PrivateKey(key)
+	default:
+		return nil, fmt.Errorf("unexpected version number (%d)", version)
+	}
+}
+
+// parsePolicyUpdateAuthKey deserializes the private key used for signing dynamic authorization policies using the encoding
+// associated with the specified metadata version.
+func parsePolicyUpdateAuthKey(version uint32, data []byte) (crypto.PrivateKey, error) {
+	if version < 1 {
+		key, err := x509.ParsePKCS1PrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
 func (d *keyPolicyUpdateData) Marshal(w io.Writer) (nbytes int, err error) {
+	authKey, err := marshalPolicyUpdateAuthKey(d.version, d.authKey)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot marshal dynamic authorization policy signing key: %w", err)
+	}
 	raw := &keyPolicyUpdateDataRaw_v0{
-		AuthKey:        x509.MarshalPKCS1PrivateKey(d.authKey),
+		AuthKey:        authKey,
 		CreationData:   d.creationData,
 		CreationTicket: d.creationTicket}
 	return tpm2.MarshalToWriter(w, d.version, raw)
@@ -86,7 +133,8 @@ func (d *keyPolicyUpdateData) Unmarshal(r io.Reader) (nbytes int, err error) {
 	}
 
 	switch version {
-	case 0:
+	case 0, 1, 2:
+		// Later versions didn't change the layout of this structure, although version 1 changed the encoding of the signing key.
 		var raw keyPolicyUpdateDataRaw_v0
 		n, err := tpm2.UnmarshalFromReader(r, &raw)
 		nbytes += n
@@ -94,7 +142,7 @@ func (d *keyPolicyUpdateData) Unmarshal(r io.Reader) (nbytes int, err error) {
 			return nbytes, xerrors.Errorf("cannot unmarshal data: %w", err)
 		}
 
-		authKey, err := x509.ParsePKCS1PrivateKey(raw.AuthKey)
+		authKey, err := parsePolicyUpdateAuthKey(version, raw.AuthKey)
 		if err != nil {
 			return nbytes, xerrors.Errorf("cannot parse dynamic authorization policy signing key: %w", err)
 		}
@@ -105,7 +153,7 @@ func (d *keyPolicyUpdateData) Unmarshal(r io.Reader) (nbytes int, err error) {
 		}
 
 		*d = keyPolicyUpdateData{
-			version:        0,
+			version:        version,
 			authKey:        authKey,
 			creationInfo:   h.Sum(nil),
 			creationData:   raw.CreationData,
@@ -156,6 +204,22 @@ type keyDataRaw_v0 struct {
 	DynamicPolicyData *dynamicPolicyDataRaw_v0
 }
 
+// keyDataRaw_v1 is version 1 of the on-disk format of keyDataRaw. It records the digest algorithm used for the HMAC sessions that
+// protect the unsealed key. The name algorithm of the sealed key object and the type of the dynamic authorization policy signing
+// key are already recorded in KeyPublic and StaticPolicyData respectively.
+//
+// Version 2 of the on-disk format is keyDataRaw_v1 followed by the encrypted payload for envelope mode sealed key objects, which is
+// serialized with a 32-bit length prefix as it may be larger than can be represented by a TPM sized buffer. The encrypted payload
+// is empty for sealed key objects that seal a key directly.
+type keyDataRaw_v1 struct {
+	KeyPrivate        tpm2.Private
+	KeyPublic         *tpm2.Public
+	AuthModeHint      AuthMode
+	SessionAlg        tpm2.HashAlgorithmId
+	StaticPolicyData  *staticPolicyDataRaw_v0
+	DynamicPolicyData *dynamicPolicyDataRaw_v0
+}
+
 // keyData corresponds to the part of a sealed key object that contains the TPM sealed object and associated metadata required
 // for executing authorization policy assertions.
 type keyData struct {
@@ -163,8 +227,19 @@ type keyData struct {
 	keyPrivate        tpm2.Private
 	keyPublic         *tpm2.Public
 	authModeHint      AuthMode
+	sessionAlg        tpm2.HashAlgorithmId // Digest algorithm of the HMAC session used for unsealing (always the default before version 1)
 	staticPolicyData  *staticPolicyData
 	dynamicPolicyData *dynamicPolicyData
+
+	// encryptedPayload is the payload encrypted with the key sealed by the TPM, for envelope mode sealed key objects (version 2
+	// and later).
+	encryptedPayload []byte
+}
+
+// isEnvelope indicates whether the TPM sealed object contains a wrapping key for an encrypted payload rather than a key that is
+// used directly.
+func (d *keyData) isEnvelope() bool {
+	return len(d.encryptedPayload) > 0
 }
 
 func (d *keyData) Marshal(w io.Writer) (nbytes int, err error) {
@@ -187,6 +262,27 @@ func (d *keyData) Marshal(w io.Writer) (nbytes int, err error) {
 		if err != nil {
 			return nbytes, xerrors.Errorf("cannot marshal raw data: %w", err)
 		}
+	case 1, 2:
+		raw := keyDataRaw_v1{
+			KeyPrivate:        d.keyPrivate,
+			KeyPublic:         d.keyPublic,
+			AuthModeHint:      d.authModeHint,
+			SessionAlg:        d.sessionAlg,
+			StaticPolicyData:  makeStaticPolicyDataRaw_v0(d.staticPolicyData),
+			DynamicPolicyData: makeDynamicPolicyDataRaw_v0(d.dynamicPolicyData)}
+		n, err := tpm2.MarshalToWriter(w, raw)
+		nbytes += n
+		if err != nil {
+			return nbytes, xerrors.Errorf("cannot marshal raw data: %w", err)
+		}
+		if d.version < 2 {
+			break
+		}
+		n, err = marshalEncryptedPayload(w, d.encryptedPayload)
+		nbytes += n
+		if err != nil {
+			return nbytes, xerrors.Errorf("cannot marshal encrypted payload: %w", err)
+		}
 	default:
 		return nbytes, fmt.Errorf("unexpected version number (%d)", d.version)
 	}
@@ -214,14 +310,65 @@ func (d *keyData) Unmarshal(r io.Reader) (nbytes int, err error) {
 			keyPrivate:        raw.KeyPrivate,
 			keyPublic:         raw.KeyPublic,
 			authModeHint:      raw.AuthModeHint,
+			sessionAlg:        defaultSessionHashAlgorithm,
 			staticPolicyData:  raw.StaticPolicyData.data(),
 			dynamicPolicyData: raw.DynamicPolicyData.data()}
+	case 1, 2:
+		var raw keyDataRaw_v1
+		n, err := tpm2.UnmarshalFromReader(r, &raw)
+		nbytes += n
+		if err != nil {
+			return nbytes, xerrors.Errorf("cannot unmarshal data: %w", err)
+		}
+		var encryptedPayload []byte
+		if version >= 2 {
+			encryptedPayload, n, err = unmarshalEncryptedPayload(r)
+			nbytes += n
+			if err != nil {
+				return nbytes, xerrors.Errorf("cannot unmarshal encrypted payload: %w", err)
+			}
+		}
+		*d = keyData{
+			version:           version,
+			keyPrivate:        raw.KeyPrivate,
+			keyPublic:         raw.KeyPublic,
+			authModeHint:      raw.AuthModeHint,
+			sessionAlg:        raw.SessionAlg,
+			staticPolicyData:  raw.StaticPolicyData.data(),
+			dynamicPolicyData: raw.DynamicPolicyData.data(),
+			encryptedPayload:  encryptedPayload}
 	default:
 		return nbytes, fmt.Errorf("unexpected version number (%d)", version)
 	}
 	return
 }
 
+// marshalEncryptedPayload serializes the supplied encrypted payload to w with a 32-bit length prefix.
+func marshalEncryptedPayload(w io.Writer, payload []byte) (int, error) {
+	if len(payload) > maxEnvelopePayloadSize {
+		return 0, errors.New("payload is too large")
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(payload))); err != nil {
+		return 0, err
+	}
+	n, err := w.Write(payload)
+	return n + binary.Size(uint32(0)), err
+}
+
+// unmarshalEncryptedPayload deserializes an encrypted payload written by marshalEncryptedPayload from r.
+func unmarshalEncryptedPayload(r io.Reader) ([]byte, int, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, 0, err
+	}
+	if size > maxEnvelopePayloadSize {
+		return nil, binary.Size(size), fmt.Errorf("payload is too large (%d bytes)", size)
+	}
+	payload := make([]byte, size)
+	n, err := io.ReadFull(r, payload)
+	return payload, n + binary.Size(size), err
+}
+
 // load loads the TPM sealed object associated with this keyData in to the storage hierarchy of the TPM, and returns the newly
 // created tpm2.ResourceContext.
 func (d *keyData) load(tpm *tpm2.TPMContext, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
@@ -256,9 +403,8 @@ func (d *keyData) validate(tpm *tpm2.TPMContext, policyUpdateData *keyPolicyUpda
 		return nil, xerrors.Errorf("cannot create context for SRK: %w", err)
 	}
 
-	sealedKeyTemplate := makeSealedKeyTemplate()
-
 	keyPublic := d.keyPublic
+	sealedKeyTemplate := makeSealedKeyTemplate(keyPublic.NameAlg)
 
 	// Perform some initial checks on the sealed data object's public area
 	if keyPublic.Type != sealedKeyTemplate.Type {
@@ -322,9 +468,15 @@ func (d *keyData) validate(tpm *tpm2.TPMContext, policyUpdateData *keyPolicyUpda
 	if err != nil {
 		return nil, keyFileError{xerrors.Errorf("cannot compute name of dynamic authorization policy key: %w", err)}
 	}
-	if authPublicKey.Type != tpm2.ObjectTypeRSA {
+	switch {
+	case authPublicKey.Type == tpm2.ObjectTypeRSA:
+	case authPublicKey.Type == tpm2.ObjectTypeECC && d.version >= 1:
+	default:
 		return nil, keyFileError{errors.New("public area of dynamic authorization policy signing key has the wrong type")}
 	}
+	if d.sessionAlg != tpm2.HashAlgorithmNull && !d.sessionAlg.Supported() {
+		return nil, keyFileError{errors.New("unsupported session digest algorithm")}
+	}
 
 	// Make sure that the static authorization policy data is consistent with the sealed key object's policy.
 	trial, err := tpm2.ComputeAuthPolicy(keyPublic.NameAlg)
@@ -390,17 +542,40 @@ func (d *keyData) validate(tpm *tpm2.TPMContext, policyUpdateData *keyPolicyUpda
 		return nil, keyFileError{errors.New("key data file and dynamic authorization policy update data file mismatch: digest doesn't match creation data")}
 	}
 
-	authKey := policyUpdateData.authKey
-	goAuthPublicKey := rsa.PublicKey{
-		N: new(big.Int).SetBytes(authPublicKey.Unique.RSA()),
-		E: int(authPublicKey.Params.RSADetail().Exponent)}
-	if authKey.E != goAuthPublicKey.E || authKey.N.Cmp(goAuthPublicKey.N) != 0 {
+	if !policySigningKeyMatchesPublic(policyUpdateData.authKey, authPublicKey) {
 		return nil, keyFileError{errors.New("dynamic authorization policy signing private key doesn't match public key")}
 	}
 
 	return pinIndexPublic, nil
 }
 
+// policySigningKeyMatchesPublic indicates whether the supplied private key used for signing dynamic authorization policies
+// corresponds to the supplied public area.
+func policySigningKeyMatchesPublic(key crypto.PrivateKey, public *tpm2.Public) bool {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if public.Type != tpm2.ObjectTypeRSA {
+			return false
+		}
+		n := new(big.Int).SetBytes(public.Unique.RSA())
+		e := int(public.Params.RSADetail().Exponent)
+		return k.E == e && k.N.Cmp(n) == 0
+	case *ecdsa.PrivateKey:
+		if public.Type != tpm2.ObjectTypeECC {
+			return false
+		}
+		curve, ok := eccCurves[public.Params.ECCDetail().CurveID]
+		if !ok || curve != k.Curve {
+			return false
+		}
+		x := new(big.Int).SetBytes(public.Unique.ECC().X)
+		y := new(big.Int).SetBytes(public.Unique.ECC().Y)
+		return k.X.Cmp(x) == 0 && k.Y.Cmp(y) == 0
+	default:
+		return false
+	}
+}
+
 // write serializes keyData in to the provided io.Writer.
 func (d *keyData) write(w io.Writer) error {
 	if _, err := tpm2.MarshalToWriter(w, keyDataHeader, d); err != nil {
@@ -505,6 +680,59 @@ func (k *SealedKeyObject) PINIndexHandle() tpm2.Handle {
 	return k.data.staticPolicyData.PinIndexHandle
 }
 
+// Version indicates the version of the key data format for this sealed key object.
+func (k *SealedKeyObject) Version() uint32 {
+	return k.data.version
+}
+
+// NameAlgorithm indicates the name algorithm of the TPM sealed object, which is also the digest algorithm of its authorization
+// policy.
+func (k *SealedKeyObject) NameAlgorithm() tpm2.HashAlgorithmId {
+	return k.data.keyPublic.NameAlg
+}
+
+// SessionAlgorithm indicates the digest algorithm of the HMAC session used for unsealing this sealed key object.
+func (k *SealedKeyObject) SessionAlgorithm() tpm2.HashAlgorithmId {
+	return k.data.sessionAlg
+}
+
+// IsEnvelope indicates whether this sealed key object was created by SealPayloadToTPM or SealPayloadToTPMWithWriters, in which
+// case the TPM sealed object protects a key used to encrypt a payload stored alongside it.
+func (k *SealedKeyObject) IsEnvelope() bool {
+	return k.data.isEnvelope()
+}
+
+// AuthPublicKey returns the public area of the key used to sign the dynamic authorization policy of this sealed key object. The
+// corresponding private key is stored in the private data file created alongside it.
+func (k *SealedKeyObject) AuthPublicKey() *tpm2.Public {
+	return k.data.staticPolicyData.AuthPublicKey
+}
+
+// LockIndexHandle indicates the handle of the global NV index used for locking access to sealed key objects, which is part of the
+// static authorization policy of this sealed key object. This is always the fixed handle 0x01801100. The name of this index isn't
+// recorded in the key data, so it can only be checked against the NV index on a TPM - this happens when the sealed key object is
+// validated or unsealed.
+func (k *SealedKeyObject) LockIndexHandle() tpm2.Handle {
+	return lockNVHandle
+}
+
+// PCRSelection indicates the PCRs that the dynamic authorization policy of this sealed key object is bound to.
+func (k *SealedKeyObject) PCRSelection() tpm2.PCRSelectionList {
+	return k.data.dynamicPolicyData.PCRSelection
+}
+
+// PCRPolicyBranches indicates the number of combinations of PCR values that satisfy the dynamic authorization policy of this sealed
+// key object, which corresponds to the number of branches in its tree of TPM2_PolicyOR assertions.
+func (k *SealedKeyObject) PCRPolicyBranches() int {
+	return k.data.dynamicPolicyData.PCROrData.numBranches()
+}
+
+// PCRPolicyCount indicates the revocation count of the dynamic authorization policy of this sealed key object. The policy is revoked
+// when the dynamic policy counter in the TPM is incremented beyond this value - see UpdateKeyPCRProtectionPolicyWithLimits.
+func (k *SealedKeyObject) PCRPolicyCount() uint64 {
+	return k.data.dynamicPolicyData.PolicyCount
+}
+
 // ReadSealedKeyObject loads a sealed key data file created by SealKeyToTPM from the specified path. If the file cannot be opened,
 // a wrapped *os.PathError error is returned. If the key data file cannot be deserialized successfully, a InvalidKeyFileError error
 // will be returned.
@@ -516,7 +744,13 @@ func ReadSealedKeyObject(path string) (*SealedKeyObject, error) {
 	}
 	defer f.Close()
 
-	data, err := decodeKeyData(f)
+	return ReadSealedKeyObjectFromReader(f)
+}
+
+// ReadSealedKeyObjectFromReader loads sealed key data created by SealKeyToTPM or SealKeyToTPMWithWriters from the supplied
+// io.Reader. If the key data cannot be deserialized successfully, a InvalidKeyFileError error will be returned.
+func ReadSealedKeyObjectFromReader(r io.Reader) (*SealedKeyObject, error) {
+	data, err := decodeKeyData(r)
 	if err != nil {
 		return nil, InvalidKeyFileError{err.Error()}
 	}
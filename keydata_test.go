@@ -20,6 +20,7 @@
 package secboot_test
 
 import (
+	"fmt"
 	"math/rand"
 
 	"github.com/canonical/go-tpm2"
@@ -57,3 +58,74 @@ func (s *keyDataSuite) TestValidateAfterLock(c *C) {
 	defer s.ResetTPMSimulator(c)
 	c.Check(ValidateKeyDataFile(s.TPM.TPMContext, keyFile, "", s.TPM.HmacSession()), IsNil)
 }
+
+func (s *keyDataSuite) TestInspectSealedKeyObject(c *C) {
+	c.Assert(ProvisionTPM(s.TPM, ProvisionModeFull, nil), IsNil)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	dir := c.MkDir()
+	keyFile := dir + "/keydata"
+
+	pinHandle := tpm2.Handle(0x0181fff0)
+
+	profile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 16, make(tpm2.Digest, 32))
+	var branches []*PCRProtectionProfile
+	for _, data := range []string{"foo", "bar", "baz"} {
+		branches = append(branches, NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 23,
+			testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, data)))
+	}
+	profile.AddProfileOR(branches...)
+
+	params := KeyCreationParams{
+		PCRProfile:           profile,
+		PINHandle:            pinHandle,
+		NameAlgorithm:        tpm2.HashAlgorithmSHA384,
+		PolicySigningKeyType: PolicySigningKeyECCP256}
+	c.Assert(SealKeyToTPM(s.TPM, key, keyFile, "", &params), IsNil)
+	pinIndex, err := s.TPM.CreateResourceContextFromTPM(pinHandle)
+	c.Assert(err, IsNil)
+	s.AddCleanupNVSpace(c, s.TPM.OwnerHandleContext(), pinIndex)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	c.Assert(err, IsNil)
+	c.Check(k.Version(), Equals, uint32(CurrentMetadataVersion))
+	c.Check(k.NameAlgorithm(), Equals, tpm2.HashAlgorithmSHA384)
+	c.Check(k.SessionAlgorithm(), Equals, tpm2.HashAlgorithmSHA256)
+	c.Check(k.IsEnvelope(), Equals, false)
+	c.Check(k.PINIndexHandle(), Equals, pinHandle)
+	c.Check(k.LockIndexHandle(), Equals, LockNVHandle)
+	c.Check(k.AuthPublicKey().Type, Equals, tpm2.ObjectTypeECC)
+	c.Check(k.PCRSelection(), DeepEquals, tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{16, 23}}})
+	c.Check(k.PCRPolicyBranches(), Equals, 3)
+}
+
+func (s *keyDataSuite) TestInspectSealedKeyObjectManyBranches(c *C) {
+	// Verify that the number of branches is computed correctly when the TPM2_PolicyOR tree has more than one level.
+	c.Assert(ProvisionTPM(s.TPM, ProvisionModeFull, nil), IsNil)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	dir := c.MkDir()
+	keyFile := dir + "/keydata"
+
+	pinHandle := tpm2.Handle(0x0181fff0)
+
+	var branches []*PCRProtectionProfile
+	for i := 0; i < 20; i++ {
+		branches = append(branches, NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 23,
+			testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, fmt.Sprintf("%d", i))))
+	}
+
+	c.Assert(SealKeyToTPM(s.TPM, key, keyFile, "", &KeyCreationParams{PCRProfile: NewPCRProtectionProfile().AddProfileOR(branches...),
+		PINHandle: pinHandle}), IsNil)
+	pinIndex, err := s.TPM.CreateResourceContextFromTPM(pinHandle)
+	c.Assert(err, IsNil)
+	s.AddCleanupNVSpace(c, s.TPM.OwnerHandleContext(), pinIndex)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	c.Assert(err, IsNil)
+	c.Check(k.PCRPolicyBranches(), Equals, 20)
+}
@@ -0,0 +1,271 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+
+	"github.com/snapcore/snapd/osutil"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// LUKS2KeyDataTokenType is the type of the LUKS2 tokens that contain sealed key data.
+	LUKS2KeyDataTokenType = "secboot-tpm2"
+
+	luks2BinaryHeaderSize = 4096 // Size of the LUKS2 binary header, which is followed by the JSON metadata area
+	luks2MaxHeaderSize    = 4 * 1024 * 1024
+	luks2ChecksumOffset   = 448 // Offset of the csum field in the LUKS2 binary header
+	luks2ChecksumSize     = 64
+)
+
+var (
+	luks2Magic1 = []byte("LUKS\xba\xbe")
+	luks2Magic2 = []byte("SKUL\xba\xbe")
+
+	// luks2SecondaryHeaderOffsets are the possible offsets of the secondary LUKS2 header, as defined by the LUKS2 specification.
+	// These are searched if the primary header is damaged.
+	luks2SecondaryHeaderOffsets = []int64{0x4000, 0x8000, 0x10000, 0x20000, 0x40000, 0x80000, 0x100000, 0x200000, 0x400000}
+)
+
+// luks2BinaryHeader corresponds to the fixed size fields at the start of a LUKS2 binary header that are required for decoding the
+// JSON metadata.
+type luks2BinaryHeader struct {
+	Magic       [6]byte
+	Version     uint16
+	HdrSize     uint64
+	SeqId       uint64
+	Label       [48]byte
+	ChecksumAlg [32]byte
+}
+
+// luks2Token corresponds to a LUKS2 token of type LUKS2KeyDataTokenType. Tokens of this type store a serialized sealed key object
+// created by SealKeyToTPMWithWriters in the KeyData field, which is encoded as base64 in the JSON metadata.
+type luks2Token struct {
+	Type     string   `json:"type"`
+	Keyslots []string `json:"keyslots"`
+	KeyData  []byte   `json:"secboot_tpm2_key_data"`
+}
+
+// LUKS2KeyDataToken corresponds to a LUKS2 token that contains a sealed key object.
+type LUKS2KeyDataToken struct {
+	ID      int    // The ID of the token in the LUKS2 header
+	Keyslot int    // The keyslot that the token is bound to
+	KeyData []byte // The serialized sealed key object
+}
+
+// readLUKS2HeaderAt reads and verifies the LUKS2 binary header and JSON metadata at the specified offset, and returns the header
+// and the JSON metadata.
+func readLUKS2HeaderAt(r io.ReaderAt, offset int64, magic []byte) (*luks2BinaryHeader, []byte, error) {
+	var hdr luks2BinaryHeader
+	if err := binary.Read(io.NewSectionReader(r, offset, luks2BinaryHeaderSize), binary.BigEndian, &hdr); err != nil {
+		return nil, nil, xerrors.Errorf("cannot read binary header: %w", err)
+	}
+	if !bytes.Equal(hdr.Magic[:], magic) {
+		return nil, nil, errors.New("invalid magic")
+	}
+	if hdr.Version != 2 {
+		return nil, nil, fmt.Errorf("unexpected version (%d)", hdr.Version)
+	}
+	if hdr.HdrSize <= luks2BinaryHeaderSize || hdr.HdrSize > luks2MaxHeaderSize {
+		return nil, nil, fmt.Errorf("invalid header size (%d)", hdr.HdrSize)
+	}
+	if alg := string(bytes.TrimRight(hdr.ChecksumAlg[:], "\x00")); alg != "sha256" {
+		return nil, nil, fmt.Errorf("unsupported checksum algorithm %q", alg)
+	}
+
+	data := make([]byte, hdr.HdrSize)
+	if _, err := r.ReadAt(data, offset); err != nil {
+		return nil, nil, xerrors.Errorf("cannot read header: %w", err)
+	}
+
+	// The checksum is computed over the binary header and JSON area, with the csum field zeroed.
+	var csum [luks2ChecksumSize]byte
+	copy(csum[:], data[luks2ChecksumOffset:])
+	copy(data[luks2ChecksumOffset:luks2ChecksumOffset+luks2ChecksumSize], make([]byte, luks2ChecksumSize))
+	h := sha256.Sum256(data)
+	if !bytes.Equal(h[:], csum[:len(h)]) {
+		return nil, nil, errors.New("checksum mismatch")
+	}
+
+	// The JSON area is padded with zeroes.
+	return &hdr, bytes.TrimRight(data[luks2BinaryHeaderSize:], "\x00"), nil
+}
+
+// readLUKS2Metadata reads the JSON metadata from the LUKS2 container at the specified path. If both the primary and secondary
+// headers are valid, the metadata from the one with the highest sequence ID is returned.
+func readLUKS2Metadata(devicePath string) ([]byte, error) {
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open device: %w", err)
+	}
+	defer f.Close()
+
+	primaryHdr, primaryMetadata, primaryErr := readLUKS2HeaderAt(f, 0, luks2Magic1)
+
+	offsets := luks2SecondaryHeaderOffsets
+	if primaryErr == nil {
+		offsets = []int64{int64(primaryHdr.HdrSize)}
+	}
+
+	for _, offset := range offsets {
+		hdr, metadata, err := readLUKS2HeaderAt(f, offset, luks2Magic2)
+		if err != nil {
+			continue
+		}
+		if primaryErr != nil || hdr.SeqId > primaryHdr.SeqId {
+			return metadata, nil
+		}
+		break
+	}
+
+	if primaryErr != nil {
+		return nil, xerrors.Errorf("cannot read primary header and no valid secondary header found: %w", primaryErr)
+	}
+	return primaryMetadata, nil
+}
+
+// ReadLUKS2KeyDataTokens returns the sealed key objects stored in the tokens of type LUKS2KeyDataTokenType from the LUKS2 container
+// at the specified devicePath, ordered by token ID. This reads the LUKS2 header directly and doesn't require the container to be
+// activated. Tokens of other types are ignored.
+func ReadLUKS2KeyDataTokens(devicePath string) ([]*LUKS2KeyDataToken, error) {
+	data, err := readLUKS2Metadata(devicePath)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read LUKS2 header: %w", err)
+	}
+
+	var metadata struct {
+		Tokens map[string]json.RawMessage `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, xerrors.Errorf("cannot decode LUKS2 metadata: %w", err)
+	}
+
+	var tokens []*LUKS2KeyDataToken
+	for idStr, rawToken := range metadata.Tokens {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token ID %q", idStr)
+		}
+
+		var token luks2Token
+		if err := json.Unmarshal(rawToken, &token); err != nil {
+			return nil, xerrors.Errorf("cannot decode token %d: %w", id, err)
+		}
+		if token.Type != LUKS2KeyDataTokenType {
+			continue
+		}
+		if len(token.Keyslots) != 1 {
+			return nil, fmt.Errorf("token %d is bound to %d keyslots", id, len(token.Keyslots))
+		}
+		keyslot, err := strconv.Atoi(token.Keyslots[0])
+		if err != nil {
+			return nil, fmt.Errorf("token %d has an invalid keyslot %q", id, token.Keyslots[0])
+		}
+
+		tokens = append(tokens, &LUKS2KeyDataToken{ID: id, Keyslot: keyslot, KeyData: token.KeyData})
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	return tokens, nil
+}
+
+// ReadSealedKeyObjectFromLUKS2Token loads the sealed key object stored in the first token of type LUKS2KeyDataTokenType from the
+// LUKS2 container at the specified devicePath. If the container has no token of this type or the key data cannot be deserialized
+// successfully, a InvalidKeyFileError error will be returned.
+func ReadSealedKeyObjectFromLUKS2Token(devicePath string) (*SealedKeyObject, error) {
+	tokens, err := ReadLUKS2KeyDataTokens(devicePath)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read LUKS2 tokens: %w", err)
+	}
+	if len(tokens) == 0 {
+		return nil, InvalidKeyFileError{"no sealed key data token found in LUKS2 header"}
+	}
+
+	return ReadSealedKeyObjectFromReader(bytes.NewReader(tokens[0].KeyData))
+}
+
+// WriteLUKS2KeyDataToken stores the supplied serialized sealed key object in a new token of type LUKS2KeyDataTokenType in the LUKS2
+// container at the specified devicePath, bound to the specified keyslot. The key data can be created by passing a bytes.Buffer to
+// SealKeyToTPMWithWriters. Storing the key data in the LUKS2 header means that it can't become separated from the volume that it
+// unlocks, and it can be used by passing an empty keyPath to ActivateVolumeWithTPMSealedKey.
+//
+// Any existing tokens of this type that are bound to the same keyslot are removed after the new token is successfully imported, so
+// this can also be used to store key data that has been updated with UpdateKeyPCRProtectionPolicyFromReader or
+// ChangePINFromReader.
+//
+// Note that the size of the LUKS2 JSON metadata area is fixed when the container is created, which limits the size of key data
+// that can be stored this way. Envelope mode sealed key objects created by SealPayloadToTPMWithWriters should only be stored in a
+// token if the payload is small.
+//
+// On failure, this will return an error containing the output of the cryptsetup command.
+func WriteLUKS2KeyDataToken(devicePath string, keyslot int, keyData []byte) error {
+	if keyslot < 0 {
+		return errors.New("invalid keyslot")
+	}
+
+	existing, err := ReadLUKS2KeyDataTokens(devicePath)
+	if err != nil {
+		return xerrors.Errorf("cannot read existing tokens: %w", err)
+	}
+
+	token, err := json.Marshal(&luks2Token{
+		Type:     LUKS2KeyDataTokenType,
+		Keyslots: []string{strconv.Itoa(keyslot)},
+		KeyData:  keyData})
+	if err != nil {
+		return xerrors.Errorf("cannot encode token: %w", err)
+	}
+
+	cmd := exec.Command("cryptsetup",
+		// import a token
+		"token", "import",
+		// read the token JSON from stdin
+		"--json-file", "-",
+		// container to import the token to
+		devicePath)
+	cmd.Stdin = bytes.NewReader(token)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return osutil.OutputErr(output, err)
+	}
+
+	for _, t := range existing {
+		if t.Keyslot != keyslot {
+			continue
+		}
+		cmd := exec.Command("cryptsetup", "token", "remove", "--token-id", strconv.Itoa(t.ID), devicePath)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return osutil.OutputErr(output, err)
+		}
+	}
+
+	return nil
+}
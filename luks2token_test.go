@@ -0,0 +1,197 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+
+	. "github.com/snapcore/secboot"
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+const mockLUKS2HeaderSize = 16384
+
+// makeMockLUKS2Header creates a LUKS2 binary header and JSON metadata area with the specified magic and sequence ID, containing
+// the supplied tokens.
+func makeMockLUKS2Header(c *C, magic string, seqId uint64, offset int, tokens map[int]interface{}) []byte {
+	metadata := map[string]interface{}{"keyslots": map[string]interface{}{}, "tokens": map[string]interface{}{}}
+	for id, token := range tokens {
+		metadata["tokens"].(map[string]interface{})[strconv.Itoa(id)] = token
+	}
+	j, err := json.Marshal(metadata)
+	c.Assert(err, IsNil)
+
+	hdr := make([]byte, mockLUKS2HeaderSize)
+	copy(hdr, magic)
+	binary.BigEndian.PutUint16(hdr[6:], 2)
+	binary.BigEndian.PutUint64(hdr[8:], mockLUKS2HeaderSize)
+	binary.BigEndian.PutUint64(hdr[16:], seqId)
+	copy(hdr[72:], "sha256")
+	binary.BigEndian.PutUint64(hdr[256:], uint64(offset))
+	copy(hdr[4096:], j)
+
+	h := sha256.Sum256(hdr)
+	copy(hdr[448:], h[:])
+	return hdr
+}
+
+// makeMockLUKS2KeyDataToken creates a LUKS2 token containing the supplied key data and bound to the specified keyslot.
+func makeMockLUKS2KeyDataToken(keyslot int, keyData []byte) map[string]interface{} {
+	return map[string]interface{}{
+		"type":                  LUKS2KeyDataTokenType,
+		"keyslots":              []string{strconv.Itoa(keyslot)},
+		"secboot_tpm2_key_data": base64.StdEncoding.EncodeToString(keyData)}
+}
+
+// writeMockLUKS2Container writes a file at the specified path containing valid primary and secondary LUKS2 headers with the
+// supplied tokens.
+func writeMockLUKS2Container(c *C, path string, tokens map[int]interface{}) {
+	data := makeMockLUKS2Header(c, "LUKS\xba\xbe", 1, 0, tokens)
+	data = append(data, makeMockLUKS2Header(c, "SKUL\xba\xbe", 1, mockLUKS2HeaderSize, tokens)...)
+	c.Assert(ioutil.WriteFile(path, data, 0644), IsNil)
+}
+
+type luks2TokenSuite struct {
+	snapd_testutil.BaseTest
+	dir string
+}
+
+var _ = Suite(&luks2TokenSuite{})
+
+func (s *luks2TokenSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+	s.dir = c.MkDir()
+}
+
+func (s *luks2TokenSuite) TestReadLUKS2KeyDataTokens(c *C) {
+	path := filepath.Join(s.dir, "luks2")
+	writeMockLUKS2Container(c, path, map[int]interface{}{
+		3: makeMockLUKS2KeyDataToken(1, []byte("bar")),
+		0: map[string]interface{}{"type": "luks2-keyring", "keyslots": []string{"0"}, "key_description": "foo"},
+		1: makeMockLUKS2KeyDataToken(0, []byte("foo"))})
+
+	tokens, err := ReadLUKS2KeyDataTokens(path)
+	c.Assert(err, IsNil)
+	c.Check(tokens, DeepEquals, []*LUKS2KeyDataToken{
+		{ID: 1, Keyslot: 0, KeyData: []byte("foo")},
+		{ID: 3, Keyslot: 1, KeyData: []byte("bar")}})
+}
+
+func (s *luks2TokenSuite) TestReadLUKS2KeyDataTokensNone(c *C) {
+	path := filepath.Join(s.dir, "luks2")
+	writeMockLUKS2Container(c, path, nil)
+
+	tokens, err := ReadLUKS2KeyDataTokens(path)
+	c.Check(err, IsNil)
+	c.Check(tokens, HasLen, 0)
+
+	_, err = ReadSealedKeyObjectFromLUKS2Token(path)
+	c.Check(err, ErrorMatches, "invalid key data file: no sealed key data token found in LUKS2 header")
+	c.Check(err, FitsTypeOf, InvalidKeyFileError{})
+}
+
+func (s *luks2TokenSuite) TestReadLUKS2KeyDataTokensDamagedPrimaryHeader(c *C) {
+	// Verify that the secondary header is used if the checksum of the primary header is invalid.
+	tokens := map[int]interface{}{0: makeMockLUKS2KeyDataToken(0, []byte("foo"))}
+	data := makeMockLUKS2Header(c, "LUKS\xba\xbe", 1, 0, nil)
+	data[4096] = 'x'
+	data = append(data, makeMockLUKS2Header(c, "SKUL\xba\xbe", 1, mockLUKS2HeaderSize, tokens)...)
+
+	path := filepath.Join(s.dir, "luks2")
+	c.Assert(ioutil.WriteFile(path, data, 0644), IsNil)
+
+	read, err := ReadLUKS2KeyDataTokens(path)
+	c.Assert(err, IsNil)
+	c.Check(read, DeepEquals, []*LUKS2KeyDataToken{{ID: 0, Keyslot: 0, KeyData: []byte("foo")}})
+}
+
+func (s *luks2TokenSuite) TestReadLUKS2KeyDataTokensNewerSecondaryHeader(c *C) {
+	// Verify that the header with the highest sequence ID is used.
+	data := makeMockLUKS2Header(c, "LUKS\xba\xbe", 1, 0, map[int]interface{}{0: makeMockLUKS2KeyDataToken(0, []byte("foo"))})
+	data = append(data, makeMockLUKS2Header(c, "SKUL\xba\xbe", 2, mockLUKS2HeaderSize,
+		map[int]interface{}{1: makeMockLUKS2KeyDataToken(0, []byte("bar"))})...)
+
+	path := filepath.Join(s.dir, "luks2")
+	c.Assert(ioutil.WriteFile(path, data, 0644), IsNil)
+
+	read, err := ReadLUKS2KeyDataTokens(path)
+	c.Assert(err, IsNil)
+	c.Check(read, DeepEquals, []*LUKS2KeyDataToken{{ID: 1, Keyslot: 0, KeyData: []byte("bar")}})
+}
+
+func (s *luks2TokenSuite) TestReadLUKS2KeyDataTokensNotLUKS2(c *C) {
+	path := filepath.Join(s.dir, "luks2")
+	c.Assert(ioutil.WriteFile(path, make([]byte, 2*mockLUKS2HeaderSize), 0644), IsNil)
+
+	_, err := ReadLUKS2KeyDataTokens(path)
+	c.Check(err, ErrorMatches, "cannot read LUKS2 header: cannot read primary header and no valid secondary header found: invalid magic")
+}
+
+func (s *luks2TokenSuite) TestWriteLUKS2KeyDataToken(c *C) {
+	path := filepath.Join(s.dir, "luks2")
+	writeMockLUKS2Container(c, path, map[int]interface{}{
+		0: makeMockLUKS2KeyDataToken(0, []byte("foo")),
+		1: makeMockLUKS2KeyDataToken(1, []byte("bar")),
+		2: makeMockLUKS2KeyDataToken(0, []byte("baz"))})
+
+	tokenFile := filepath.Join(s.dir, "token")
+	cryptsetup := snapd_testutil.MockCommand(c, "cryptsetup", fmt.Sprintf(`
+if [ "$2" = "import" ]; then
+    cat /dev/stdin > %s
+fi
+`, tokenFile))
+	s.AddCleanup(cryptsetup.Restore)
+
+	c.Check(WriteLUKS2KeyDataToken(path, 0, []byte("1234")), IsNil)
+	c.Check(cryptsetup.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "token", "import", "--json-file", "-", path},
+		{"cryptsetup", "token", "remove", "--token-id", "0", path},
+		{"cryptsetup", "token", "remove", "--token-id", "2", path}})
+
+	data, err := ioutil.ReadFile(tokenFile)
+	c.Assert(err, IsNil)
+	var token map[string]interface{}
+	c.Assert(json.Unmarshal(data, &token), IsNil)
+	c.Check(token, DeepEquals, map[string]interface{}{
+		"type":                  LUKS2KeyDataTokenType,
+		"keyslots":              []interface{}{"0"},
+		"secboot_tpm2_key_data": base64.StdEncoding.EncodeToString([]byte("1234"))})
+}
+
+func (s *luks2TokenSuite) TestWriteLUKS2KeyDataTokenImportFails(c *C) {
+	path := filepath.Join(s.dir, "luks2")
+	writeMockLUKS2Container(c, path, map[int]interface{}{0: makeMockLUKS2KeyDataToken(0, []byte("foo"))})
+
+	cryptsetup := snapd_testutil.MockCommand(c, "cryptsetup", `echo "not enough space"; exit 1`)
+	s.AddCleanup(cryptsetup.Restore)
+
+	c.Check(WriteLUKS2KeyDataToken(path, 0, []byte("1234")), ErrorMatches, "not enough space")
+	// The existing token must not be removed if the import fails.
+	c.Check(cryptsetup.Calls(), DeepEquals, [][]string{{"cryptsetup", "token", "import", "--json-file", "-", path}})
+}
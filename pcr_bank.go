@@ -0,0 +1,178 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/chrisccoulson/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrNoActivePCRBank is returned from SelectPCRAlgorithm if there are no PCR banks that are allocated on the TPM and that have
+// been extended with the measurements recorded in the TCG event log.
+var ErrNoActivePCRBank = errors.New("no PCR bank is allocated on the TPM that is consistent with the TCG event log")
+
+// pcrAlgorithmCandidates is the list of PCR banks considered by SelectPCRAlgorithm, in order of preference. SHA-256 is preferred as
+// it is required by the "TCG PC Client Platform TPM Profile (PTP) Specification", and SHA-1 is only used as a last resort.
+var pcrAlgorithmCandidates = []tpm2.HashAlgorithmId{
+	tpm2.HashAlgorithmSHA256,
+	tpm2.HashAlgorithmSHA384,
+	tpm2.HashAlgorithmSHA512,
+	tpm2.HashAlgorithmSHA1,
+}
+
+const maxPreOSPCR = 7 // The highest PCR that is measured to by the platform firmware before the OS is loaded
+
+// replayPreOSPCRs computes the values of the pre-OS PCRs (0-7) in the specified banks by replaying the events recorded in the
+// supplied TCG event log. Only PCRs that have events recorded in the log are included in the returned values.
+func replayPreOSPCRs(log *tcglog.Log, algs []tpm2.HashAlgorithmId) (tpm2.PCRValues, error) {
+	values := make(tpm2.PCRValues)
+	startupLocality := uint8(0)
+
+	for {
+		event, err := log.NextEvent()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("cannot parse TCG event log: %w", err)
+		}
+
+		pcr := int(event.PCRIndex)
+		if pcr > maxPreOSPCR {
+			continue
+		}
+
+		if event.EventType == tcglog.EventTypeNoAction {
+			if locality, ok := decodeStartupLocalityEvent(event); ok {
+				startupLocality = locality
+			}
+			continue
+		}
+
+		for _, alg := range algs {
+			if _, ok := values[alg][pcr]; !ok {
+				values.SetValue(alg, pcr, initialPCRValue(alg, pcr, startupLocality))
+			}
+			h := alg.NewHash()
+			h.Write(values[alg][pcr])
+			h.Write(event.Digests[tcglog.AlgorithmId(alg)])
+			values[alg][pcr] = h.Sum(nil)
+		}
+	}
+
+	return values, nil
+}
+
+// SelectPCRAlgorithm determines which PCR bank should be used to compute a PCR profile for the current boot, by finding a bank that
+// is allocated on the TPM, is present in the TCG event log and for which the values of the pre-OS PCRs (0-7) in the TPM are
+// consistent with the measurements recorded in the TCG event log. This is useful for devices where the firmware only extends a
+// subset of the allocated PCR banks (eg, devices that only populate the SHA-1 bank). The returned algorithm can be passed via the
+// PCRAlgorithm field of the parameters to the various profile helpers (such as AddEFISecureBootPolicyProfile).
+//
+// Banks are considered in the order SHA-256, SHA-384, SHA-512 and then SHA-1, and the first one that satisfies the above criteria
+// is returned. If no bank satisfies the criteria, a ErrNoActivePCRBank error is returned.
+//
+// By default, the TCG event log is read from the current host. A different event log can be used by supplying a HostEnvironment
+// via the env argument, although the PCR values are always read from the supplied TPM.
+func SelectPCRAlgorithm(tpm *TPMConnection, env HostEnvironment) (tpm2.HashAlgorithmId, error) {
+	if env == nil {
+		env = defaultHostEnvironment()
+	}
+
+	session := tpm.HmacSession()
+
+	allocated, err := tpm.GetCapabilityPCRs(session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return tpm2.HashAlgorithmNull, xerrors.Errorf("cannot determine allocated PCR banks: %w", err)
+	}
+
+	eventLog, err := env.OpenEventLog()
+	if err != nil {
+		return tpm2.HashAlgorithmNull, xerrors.Errorf("cannot open TCG event log: %w", err)
+	}
+	defer eventLog.Close()
+	log, err := tcglog.NewLog(eventLog, tcglog.LogOptions{})
+	if err != nil {
+		return tpm2.HashAlgorithmNull, xerrors.Errorf("cannot parse TCG event log header: %w", err)
+	}
+
+	var candidates []tpm2.HashAlgorithmId
+	for _, alg := range pcrAlgorithmCandidates {
+		if log.Algorithms.Contains(tcglog.AlgorithmId(alg)) {
+			candidates = append(candidates, alg)
+		}
+	}
+
+	expected, err := replayPreOSPCRs(log, candidates)
+	if err != nil {
+		return tpm2.HashAlgorithmNull, err
+	}
+
+Candidates:
+	for _, alg := range candidates {
+		var pcrs []int
+		for pcr := range expected[alg] {
+			pcrs = append(pcrs, pcr)
+		}
+		if len(pcrs) == 0 {
+			continue
+		}
+
+		// Make sure that all of the PCRs in the log are allocated in this bank.
+		for _, pcr := range pcrs {
+			found := false
+			for _, s := range allocated {
+				if s.Hash != alg {
+					continue
+				}
+				for _, p := range s.Select {
+					if p == pcr {
+						found = true
+						break
+					}
+				}
+			}
+			if !found {
+				continue Candidates
+			}
+		}
+
+		_, values, err := tpm.PCRRead(tpm2.PCRSelectionList{{Hash: alg, Select: pcrs}}, session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			return tpm2.HashAlgorithmNull, xerrors.Errorf("cannot read PCR values from bank %v: %w", alg, err)
+		}
+
+		for _, pcr := range pcrs {
+			if !bytes.Equal(values[alg][pcr], expected[alg][pcr]) {
+				continue Candidates
+			}
+		}
+
+		return alg, nil
+	}
+
+	return tpm2.HashAlgorithmNull, ErrNoActivePCRBank
+}
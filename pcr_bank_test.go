@@ -0,0 +1,120 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/chrisccoulson/tcglog-parser"
+	. "github.com/snapcore/secboot"
+)
+
+// replayEventLogToTPM extends the pre-OS measurements from the specified TCG event log to the specified banks of the TPM.
+func replayEventLogToTPM(t *testing.T, tpm *TPMConnection, path string, algs []tpm2.HashAlgorithmId) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+
+	log, err := tcglog.NewLog(f, tcglog.LogOptions{})
+	if err != nil {
+		t.Fatalf("NewLog failed: %v", err)
+	}
+
+	for {
+		event, err := log.NextEvent()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextEvent failed: %v", err)
+		}
+		if event.PCRIndex > 7 || event.EventType == tcglog.EventTypeNoAction {
+			continue
+		}
+
+		var digests tpm2.TaggedHashList
+		for _, alg := range algs {
+			digests = append(digests, tpm2.TaggedHash{HashAlg: alg, Digest: tpm2.Digest(event.Digests[tcglog.AlgorithmId(alg)])})
+		}
+		if err := tpm.PCRExtend(tpm.PCRHandleContext(int(event.PCRIndex)), digests, nil); err != nil {
+			t.Fatalf("PCRExtend failed: %v", err)
+		}
+	}
+}
+
+func TestSelectPCRAlgorithm(t *testing.T) {
+	tpm, tcti := openTPMSimulatorForTesting(t)
+	defer func() {
+		tpm, _ = resetTPMSimulator(t, tpm, tcti)
+		closeTPM(t, tpm)
+	}()
+
+	env := &FileHostEnvironment{EventLogPath: "testdata/eventlog1.bin"}
+
+	for _, data := range []struct {
+		desc     string
+		extended []tpm2.HashAlgorithmId
+		expected tpm2.HashAlgorithmId
+	}{
+		{
+			desc:     "SHA256",
+			extended: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256},
+			expected: tpm2.HashAlgorithmSHA256,
+		},
+		{
+			// Verify that the SHA-1 bank is selected if the firmware doesn't extend the SHA-256 bank
+			desc:     "SHA1Only",
+			extended: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1},
+			expected: tpm2.HashAlgorithmSHA1,
+		},
+		{
+			desc:     "SHA256Only",
+			extended: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256},
+			expected: tpm2.HashAlgorithmSHA256,
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			tpm, tcti = resetTPMSimulator(t, tpm, tcti)
+			replayEventLogToTPM(t, tpm, env.EventLogPath, data.extended)
+
+			alg, err := SelectPCRAlgorithm(tpm, env)
+			if err != nil {
+				t.Fatalf("SelectPCRAlgorithm failed: %v", err)
+			}
+			if alg != data.expected {
+				t.Errorf("Unexpected algorithm: %v", alg)
+			}
+		})
+	}
+
+	t.Run("NoActiveBank", func(t *testing.T) {
+		tpm, tcti = resetTPMSimulator(t, tpm, tcti)
+
+		_, err := SelectPCRAlgorithm(tpm, env)
+		if err != ErrNoActivePCRBank {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
@@ -21,8 +21,13 @@ package secboot
 
 import (
 	"bytes"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"sort"
 
 	"github.com/canonical/go-tpm2"
 
@@ -55,6 +60,54 @@ func (l pcrValuesList) extendValue(alg tpm2.HashAlgorithmId, pcr int, value tpm2
 	}
 }
 
+// pcrValuesKey returns a string that uniquely identifies the supplied set of PCR values, for the purpose of de-duplication.
+func pcrValuesKey(v tpm2.PCRValues) string {
+	var algs []int
+	for alg := range v {
+		algs = append(algs, int(alg))
+	}
+	sort.Ints(algs)
+
+	var b bytes.Buffer
+	for _, alg := range algs {
+		var pcrs []int
+		for pcr := range v[tpm2.HashAlgorithmId(alg)] {
+			pcrs = append(pcrs, pcr)
+		}
+		sort.Ints(pcrs)
+		for _, pcr := range pcrs {
+			fmt.Fprintf(&b, "%d:%d:%x;", alg, pcr, v[tpm2.HashAlgorithmId(alg)][pcr])
+		}
+	}
+	return b.String()
+}
+
+// dedup returns a copy of this list with duplicate PCR value combinations removed. The order of the first occurrence of each
+// combination is preserved.
+func (l pcrValuesList) dedup() (out pcrValuesList) {
+	seen := make(map[string]bool)
+	for _, v := range l {
+		k := pcrValuesKey(v)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		out = append(out, v)
+	}
+	return
+}
+
+// selection returns the PCR selection for this list, making sure that all branches contain values for the same sets of PCRs.
+func (l pcrValuesList) selection() (tpm2.PCRSelectionList, error) {
+	pcrs := l[0].SelectionList()
+	for _, v := range l[1:] {
+		if !v.SelectionList().Equal(pcrs) {
+			return nil, errors.New("not all branches contain values for the same sets of PCRs")
+		}
+	}
+	return pcrs, nil
+}
+
 func (l pcrValuesList) copy() (out pcrValuesList) {
 	for _, v := range l {
 		ov := make(tpm2.PCRValues)
@@ -98,6 +151,10 @@ type pcrProtectionProfileInstr interface{}
 
 // PCRProtectionProfile defines the PCR profile used to protect a key sealed with SealKeyToTPM. It contains a sequence of instructions
 // for computing combinations of PCR values that a key will be protected against. The profile is built using the methods of this type.
+//
+// The PCR bank is specified for each instruction, and a profile may contain values for PCRs from more than one bank. The bank for
+// a key is selected by the PCR algorithm used to build its profile - SelectPCRAlgorithm can be used to find a bank that is active
+// on the current device.
 type PCRProtectionProfile struct {
 	instrs []pcrProtectionProfileInstr
 }
@@ -279,7 +336,9 @@ func (c *pcrProtectionProfileComputeContext) handleBranches(n int) (out []*pcrPr
 // *pcrProtectionProfileComputeContext associated with the parent branch. Calling this will panic on a
 // *pcrProtectionProfileComputeContext associated with the root branch.
 func (c *pcrProtectionProfileComputeContext) finishBranch() {
-	c.parent.values = append(c.parent.values, c.values...)
+	// De-duplicate here so that identical combinations produced by different branches aren't carried forward in to subsequent
+	// instructions, which would otherwise multiply the number of combinations that need to be computed.
+	c.parent.values = append(c.parent.values, c.values...).dedup()
 }
 
 // isRoot returns true if this *pcrProtectionProfileComputeContext is associated with a root branch.
@@ -348,6 +407,30 @@ func (p *PCRProtectionProfile) computePCRValues(tpm *tpm2.TPMContext) (pcrValues
 	}
 }
 
+// computeDigests computes a PCR digest for each branch of this list. The returned list of PCR digests is de-duplicated, and is in
+// the order in which each digest first occurs. This list must contain values for the same sets of PCRs in every branch.
+func (l pcrValuesList) computeDigests(alg tpm2.HashAlgorithmId) (tpm2.PCRSelectionList, tpm2.DigestList) {
+	var pcrs tpm2.PCRSelectionList
+	var pcrDigests tpm2.DigestList
+	for _, v := range l {
+		p, digest, _ := tpm2.ComputePCRDigestSimple(alg, v)
+		pcrs = p
+
+		found := false
+		for _, d := range pcrDigests {
+			if bytes.Equal(d, digest) {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		pcrDigests = append(pcrDigests, digest)
+	}
+	return pcrs, pcrDigests
+}
+
 // computePCRDigests computes a PCR selection and list of PCR digests from this PCRProtectionProfile. The returned list of PCR digests
 // is de-duplicated.
 func (p *PCRProtectionProfile) computePCRDigests(tpm *tpm2.TPMContext, alg tpm2.HashAlgorithmId) (tpm2.PCRSelectionList, tpm2.DigestList, error) {
@@ -357,33 +440,550 @@ func (p *PCRProtectionProfile) computePCRDigests(tpm *tpm2.TPMContext, alg tpm2.
 		return nil, nil, err
 	}
 
-	// Compute the PCR selection for this profile from the first branch.
-	pcrs := values[0].SelectionList()
+	// Make sure that all branches contain values for the same sets of PCRs.
+	if _, err := values.selection(); err != nil {
+		return nil, nil, err
+	}
 
-	// Compute the PCR digests for all branches, making sure that they all contain values for the same sets of PCRs.
-	var pcrDigests tpm2.DigestList
-	for _, v := range values {
-		p, digest, _ := tpm2.ComputePCRDigestSimple(alg, v)
-		if !p.Equal(pcrs) {
-			return nil, nil, errors.New("not all branches contain values for the same sets of PCRs")
+	pcrs, pcrDigests := values.computeDigests(alg)
+	return pcrs, pcrDigests, nil
+}
+
+// countCombinations returns the number of PCR value combinations that computePCRValues would produce for this profile, before
+// de-duplication. This is cheap to compute, and saturates at math.MaxUint64 rather than overflowing.
+func (p *PCRProtectionProfile) countCombinations() uint64 {
+	n := uint64(1)
+	for _, instr := range p.instrs {
+		i, isOR := instr.(*pcrProtectionProfileAddProfileORInstr)
+		if !isOR || len(i.profiles) == 0 {
+			// An empty branch point doesn't affect the number of combinations
+			continue
 		}
-		pcrDigests = append(pcrDigests, digest)
+		var sum uint64
+		for _, sub := range i.profiles {
+			c := sub.countCombinations()
+			if c > math.MaxUint64-sum {
+				sum = math.MaxUint64
+				break
+			}
+			sum += c
+		}
+		if sum != 0 && n > math.MaxUint64/sum {
+			return math.MaxUint64
+		}
+		n *= sum
 	}
+	return n
+}
 
-	var uniquePcrDigests tpm2.DigestList
-	for _, d := range pcrDigests {
-		found := false
-		for _, f := range uniquePcrDigests {
-			if bytes.Equal(d, f) {
-				found = true
-				break
+// makePlaceholderPolicySignature returns a zero-filled signature with the same size as one that would be created for a dynamic
+// authorization policy by a key of the specified type.
+func makePlaceholderPolicySignature(keyType PolicySigningKeyType) (*tpm2.Signature, error) {
+	var size int
+	switch keyType {
+	case PolicySigningKeyRSA2048:
+		return &tpm2.Signature{
+			SigAlg: tpm2.SigSchemeAlgRSAPSS,
+			Signature: tpm2.SignatureU{
+				Data: &tpm2.SignatureRSAPSS{
+					Hash: tpm2.HashAlgorithmSHA256,
+					Sig:  make(tpm2.PublicKeyRSA, 2048/8)}}}, nil
+	case PolicySigningKeyECCP256:
+		size = 32
+	case PolicySigningKeyECCP384:
+		size = 48
+	default:
+		return nil, fmt.Errorf("invalid key type (%d)", keyType)
+	}
+
+	return &tpm2.Signature{
+		SigAlg: tpm2.SigSchemeAlgECDSA,
+		Signature: tpm2.SignatureU{
+			Data: &tpm2.SignatureECDSA{
+				Hash:       tpm2.HashAlgorithmSHA256,
+				SignatureR: make([]byte, size),
+				SignatureS: make([]byte, size)}}}, nil
+}
+
+// PCRProtectionProfileAnalysis describes the PCR policy that would be generated from a PCRProtectionProfile.
+type PCRProtectionProfileAnalysis struct {
+	// PCRs is the selection of PCRs that are bound to the policy.
+	PCRs tpm2.PCRSelectionList
+
+	// NumCombinations is the number of PCR value combinations produced by the profile, including duplicates.
+	NumCombinations uint64
+
+	// NumDigests is the number of distinct PCR digests produced by the profile. Each of these becomes a branch of the policy.
+	NumDigests int
+
+	// ORTreeDepth is the number of levels in the tree of TPM2_PolicyOR assertions required to support NumDigests branches, and
+	// corresponds to the number of TPM2_PolicyOR commands executed when unsealing a key.
+	ORTreeDepth int
+
+	// DynamicPolicyDataSize is the number of bytes that the dynamic authorization policy metadata computed from the profile
+	// occupies in the key data file. This is the part of the key data file that grows with the complexity of the profile.
+	DynamicPolicyDataSize int
+}
+
+// Analyze computes the PCR policy that would be generated from this profile for a key sealed with SealKeyToTPM, and returns
+// information about it that can be used to determine whether the profile is too complex. The alg argument is the digest algorithm
+// used to compute PCR digests and the authorization policy, which corresponds to the NameAlgorithm field of KeyCreationParams (or
+// SealedKeyObject.NameAlgorithm for an existing key). The keyType argument is the type of key used to sign the dynamic
+// authorization policy, which corresponds to the PolicySigningKeyType field of KeyCreationParams and determines the size of the
+// signature recorded in the key data.
+//
+// A TPM connection is only required if the profile contains instructions added by AddPCRValueFromTPM, and may be nil otherwise.
+func (p *PCRProtectionProfile) Analyze(tpm *TPMConnection, alg tpm2.HashAlgorithmId, keyType PolicySigningKeyType) (*PCRProtectionProfileAnalysis, error) {
+	if !alg.Supported() {
+		return nil, errors.New("unsupported digest algorithm")
+	}
+	signature, err := makePlaceholderPolicySignature(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	var tpmCtx *tpm2.TPMContext
+	if tpm != nil {
+		tpmCtx = tpm.TPMContext
+	}
+
+	pcrs, pcrDigests, err := p.computePCRDigests(tpmCtx, alg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR digests: %w", err)
+	}
+
+	// The contents of the policy digests don't affect the shape or size of the tree, so there's no need to compute them here.
+	orDigests := make(tpm2.DigestList, 0, len(pcrDigests))
+	for range pcrDigests {
+		orDigests = append(orDigests, make(tpm2.Digest, alg.Size()))
+	}
+	trial, _ := tpm2.ComputeAuthPolicy(alg)
+	orData := computePolicyORData(alg, trial, orDigests)
+
+	policyData := &dynamicPolicyData{
+		PCRSelection:              pcrs,
+		PCROrData:                 orData,
+		AuthorizedPolicy:          make(tpm2.Digest, alg.Size()),
+		AuthorizedPolicySignature: signature}
+
+	return &PCRProtectionProfileAnalysis{
+		PCRs:                  pcrs,
+		NumCombinations:       p.countCombinations(),
+		NumDigests:            len(pcrDigests),
+		ORTreeDepth:           orData.depth(),
+		DynamicPolicyDataSize: policyData.marshalledSize()}, nil
+}
+
+// PCRProtectionProfileLimits defines limits on the complexity of the PCR policy generated from a PCRProtectionProfile. A field
+// with a value of zero indicates that there is no limit.
+type PCRProtectionProfileLimits struct {
+	// MaxCombinations is the maximum number of PCR value combinations that the profile may produce, including duplicates. This is
+	// checked before any PCR values are computed, so it can be used to reject profiles that would take too long to compute.
+	MaxCombinations uint64
+
+	// MaxDigests is the maximum number of distinct PCR digests that the profile may produce.
+	MaxDigests int
+
+	// MaxORTreeDepth is the maximum number of levels in the tree of TPM2_PolicyOR assertions.
+	MaxORTreeDepth int
+
+	// MaxDynamicPolicyDataSize is the maximum size in bytes of the dynamic authorization policy metadata in the key data file.
+	MaxDynamicPolicyDataSize int
+}
+
+func (l *PCRProtectionProfileLimits) checkLimit(name string, value, max uint64) error {
+	if max == 0 || value <= max {
+		return nil
+	}
+	return PCRProtectionProfileLimitError{Limit: name, Value: value, Max: max}
+}
+
+// checkCombinations checks that the number of PCR value combinations produced by the supplied profile does not exceed the limit.
+func (l *PCRProtectionProfileLimits) checkCombinations(profile *PCRProtectionProfile) error {
+	if l == nil {
+		return nil
+	}
+	return l.checkLimit("MaxCombinations", profile.countCombinations(), l.MaxCombinations)
+}
+
+// checkDigests checks that the number of distinct PCR digests does not exceed the limit.
+func (l *PCRProtectionProfileLimits) checkDigests(n int) error {
+	if l == nil {
+		return nil
+	}
+	return l.checkLimit("MaxDigests", uint64(n), uint64(l.MaxDigests))
+}
+
+// checkDynamicPolicyData checks that the supplied dynamic authorization policy metadata does not exceed the OR tree depth and size
+// limits.
+func (l *PCRProtectionProfileLimits) checkDynamicPolicyData(data *dynamicPolicyData) error {
+	if l == nil {
+		return nil
+	}
+	if err := l.checkLimit("MaxORTreeDepth", uint64(data.PCROrData.depth()), uint64(l.MaxORTreeDepth)); err != nil {
+		return err
+	}
+	return l.checkLimit("MaxDynamicPolicyDataSize", uint64(data.marshalledSize()), uint64(l.MaxDynamicPolicyDataSize))
+}
+
+const (
+	pcrProtectionProfileHeader         uint32 = 0x55535050
+	currentPCRProtectionProfileVersion uint32 = 0
+)
+
+// Opcodes for the instructions in the binary format of PCRProtectionProfile.
+const (
+	pcrProtectionProfileOpAddPCRValue        uint8 = 1
+	pcrProtectionProfileOpAddPCRValueFromTPM uint8 = 2
+	pcrProtectionProfileOpExtendPCR          uint8 = 3
+	pcrProtectionProfileOpAddProfileOR       uint8 = 4
+)
+
+const (
+	maxPCRProtectionProfilePCR     = 23 // The highest PCR index defined for a PC Client platform TPM
+	maxPCRProtectionProfileORDepth = 64 // The maximum nesting depth of AddProfileOR instructions in a serialized profile
+)
+
+// checkPCRProtectionProfileInstr verifies that the supplied algorithm is supported and that the supplied PCR index is valid.
+func checkPCRProtectionProfileInstr(alg tpm2.HashAlgorithmId, pcr int) error {
+	if !alg.Supported() {
+		return fmt.Errorf("unsupported digest algorithm %v", alg)
+	}
+	if pcr < 0 || pcr > maxPCRProtectionProfilePCR {
+		return fmt.Errorf("invalid PCR index %d", pcr)
+	}
+	return nil
+}
+
+// checkPCRProtectionProfileDigest verifies that the supplied algorithm is supported, that the supplied PCR index is valid and that
+// value has the correct size for the algorithm.
+func checkPCRProtectionProfileDigest(alg tpm2.HashAlgorithmId, pcr int, value tpm2.Digest) error {
+	if err := checkPCRProtectionProfileInstr(alg, pcr); err != nil {
+		return err
+	}
+	if len(value) != alg.Size() {
+		return fmt.Errorf("invalid digest length for algorithm %v", alg)
+	}
+	return nil
+}
+
+func (p *PCRProtectionProfile) marshalInstrs(w io.Writer) (nbytes int, err error) {
+	n, err := tpm2.MarshalToWriter(w, uint32(len(p.instrs)))
+	nbytes += n
+	if err != nil {
+		return nbytes, err
+	}
+
+	for _, instr := range p.instrs {
+		switch i := instr.(type) {
+		case *pcrProtectionProfileAddPCRValueInstr:
+			n, err = tpm2.MarshalToWriter(w, pcrProtectionProfileOpAddPCRValue, i.alg, uint32(i.pcr), i.value)
+		case *pcrProtectionProfileAddPCRValueFromTPMInstr:
+			n, err = tpm2.MarshalToWriter(w, pcrProtectionProfileOpAddPCRValueFromTPM, i.alg, uint32(i.pcr))
+		case *pcrProtectionProfileExtendPCRInstr:
+			n, err = tpm2.MarshalToWriter(w, pcrProtectionProfileOpExtendPCR, i.alg, uint32(i.pcr), i.value)
+		case *pcrProtectionProfileAddProfileORInstr:
+			n, err = tpm2.MarshalToWriter(w, pcrProtectionProfileOpAddProfileOR, uint32(len(i.profiles)))
+			nbytes += n
+			if err != nil {
+				return nbytes, err
 			}
+			for _, sub := range i.profiles {
+				n, err = sub.marshalInstrs(w)
+				nbytes += n
+				if err != nil {
+					return nbytes, err
+				}
+			}
+			continue
+		default:
+			panic("unhandled instruction type")
 		}
-		if found {
+		nbytes += n
+		if err != nil {
+			return nbytes, err
+		}
+	}
+
+	return nbytes, nil
+}
+
+func (p *PCRProtectionProfile) unmarshalInstrs(r io.Reader, depth int) (nbytes int, err error) {
+	if depth > maxPCRProtectionProfileORDepth {
+		return 0, errors.New("too many nested AddProfileOR instructions")
+	}
+
+	var count uint32
+	n, err := tpm2.UnmarshalFromReader(r, &count)
+	nbytes += n
+	if err != nil {
+		return nbytes, xerrors.Errorf("cannot unmarshal number of instructions: %w", err)
+	}
+
+	for i := uint32(0); i < count; i++ {
+		var op uint8
+		n, err := tpm2.UnmarshalFromReader(r, &op)
+		nbytes += n
+		if err != nil {
+			return nbytes, xerrors.Errorf("cannot unmarshal opcode for instruction %d: %w", i, err)
+		}
+
+		switch op {
+		case pcrProtectionProfileOpAddPCRValue, pcrProtectionProfileOpExtendPCR:
+			var alg tpm2.HashAlgorithmId
+			var pcr uint32
+			var value tpm2.Digest
+			n, err := tpm2.UnmarshalFromReader(r, &alg, &pcr, &value)
+			nbytes += n
+			if err != nil {
+				return nbytes, xerrors.Errorf("cannot unmarshal instruction %d: %w", i, err)
+			}
+			if err := checkPCRProtectionProfileDigest(alg, int(pcr), value); err != nil {
+				return nbytes, xerrors.Errorf("invalid instruction %d: %w", i, err)
+			}
+			if op == pcrProtectionProfileOpAddPCRValue {
+				p.AddPCRValue(alg, int(pcr), value)
+			} else {
+				p.ExtendPCR(alg, int(pcr), value)
+			}
+		case pcrProtectionProfileOpAddPCRValueFromTPM:
+			var alg tpm2.HashAlgorithmId
+			var pcr uint32
+			n, err := tpm2.UnmarshalFromReader(r, &alg, &pcr)
+			nbytes += n
+			if err != nil {
+				return nbytes, xerrors.Errorf("cannot unmarshal instruction %d: %w", i, err)
+			}
+			if err := checkPCRProtectionProfileInstr(alg, int(pcr)); err != nil {
+				return nbytes, xerrors.Errorf("invalid instruction %d: %w", i, err)
+			}
+			p.AddPCRValueFromTPM(alg, int(pcr))
+		case pcrProtectionProfileOpAddProfileOR:
+			var numProfiles uint32
+			n, err := tpm2.UnmarshalFromReader(r, &numProfiles)
+			nbytes += n
+			if err != nil {
+				return nbytes, xerrors.Errorf("cannot unmarshal number of branches for instruction %d: %w", i, err)
+			}
+			var profiles []*PCRProtectionProfile
+			for j := uint32(0); j < numProfiles; j++ {
+				sub := NewPCRProtectionProfile()
+				n, err := sub.unmarshalInstrs(r, depth+1)
+				nbytes += n
+				if err != nil {
+					return nbytes, xerrors.Errorf("cannot unmarshal branch %d for instruction %d: %w", j, i, err)
+				}
+				profiles = append(profiles, sub)
+			}
+			p.AddProfileOR(profiles...)
+		default:
+			return nbytes, fmt.Errorf("invalid opcode for instruction %d (%d)", i, op)
+		}
+	}
+
+	return nbytes, nil
+}
+
+// Marshal serializes this profile to the supplied io.Writer in a versioned binary format. The serialized profile includes all
+// sub-profiles added with AddProfileOR, and placeholders for PCR values added with AddPCRValueFromTPM. The current values of these
+// PCRs are not recorded, and are read back from the TPM when the PCR values of the deserialized profile are computed. This makes
+// it possible to compute a profile on one host and use it to seal a key on another.
+func (p *PCRProtectionProfile) Marshal(w io.Writer) (nbytes int, err error) {
+	n, err := tpm2.MarshalToWriter(w, pcrProtectionProfileHeader, currentPCRProtectionProfileVersion)
+	nbytes += n
+	if err != nil {
+		return nbytes, xerrors.Errorf("cannot marshal header: %w", err)
+	}
+
+	n, err = p.marshalInstrs(w)
+	nbytes += n
+	if err != nil {
+		return nbytes, xerrors.Errorf("cannot marshal instructions: %w", err)
+	}
+	return nbytes, nil
+}
+
+// Unmarshal deserializes a profile in the binary format produced by Marshal from the supplied io.Reader, replacing the contents
+// of this profile.
+func (p *PCRProtectionProfile) Unmarshal(r io.Reader) (nbytes int, err error) {
+	var header, version uint32
+	n, err := tpm2.UnmarshalFromReader(r, &header, &version)
+	nbytes += n
+	if err != nil {
+		return nbytes, xerrors.Errorf("cannot unmarshal header: %w", err)
+	}
+	if header != pcrProtectionProfileHeader {
+		return nbytes, fmt.Errorf("unexpected header (%d)", header)
+	}
+	if version != currentPCRProtectionProfileVersion {
+		return nbytes, fmt.Errorf("unexpected version number (%d)", version)
+	}
+
+	profile := NewPCRProtectionProfile()
+	n, err = profile.unmarshalInstrs(r, 0)
+	nbytes += n
+	if err != nil {
+		return nbytes, err
+	}
+
+	*p = *profile
+	return nbytes, nil
+}
+
+var pcrProtectionProfileJSONAlgorithms = map[tpm2.HashAlgorithmId]string{
+	tpm2.HashAlgorithmSHA1:   "sha1",
+	tpm2.HashAlgorithmSHA256: "sha256",
+	tpm2.HashAlgorithmSHA384: "sha384",
+	tpm2.HashAlgorithmSHA512: "sha512",
+}
+
+// pcrProtectionProfileInstrJSON is the JSON representation of a pcrProtectionProfileInstr.
+type pcrProtectionProfileInstrJSON struct {
+	Op       string                             `json:"op"`
+	Alg      string                             `json:"alg,omitempty"`
+	PCR      *int                               `json:"pcr,omitempty"`
+	Value    string                             `json:"value,omitempty"`
+	Profiles [][]*pcrProtectionProfileInstrJSON `json:"profiles,omitempty"`
+}
+
+// pcrProtectionProfileJSON is the JSON representation of PCRProtectionProfile.
+type pcrProtectionProfileJSON struct {
+	Version uint32                           `json:"version"`
+	Instrs  []*pcrProtectionProfileInstrJSON `json:"instrs"`
+}
+
+func (p *PCRProtectionProfile) makeInstrsJSON() ([]*pcrProtectionProfileInstrJSON, error) {
+	out := make([]*pcrProtectionProfileInstrJSON, 0, len(p.instrs))
+	for n, instr := range p.instrs {
+		var alg tpm2.HashAlgorithmId
+		var jsonInstr *pcrProtectionProfileInstrJSON
+
+		switch i := instr.(type) {
+		case *pcrProtectionProfileAddPCRValueInstr:
+			pcr := i.pcr
+			alg = i.alg
+			jsonInstr = &pcrProtectionProfileInstrJSON{Op: "AddPCRValue", PCR: &pcr, Value: hex.EncodeToString(i.value)}
+		case *pcrProtectionProfileAddPCRValueFromTPMInstr:
+			pcr := i.pcr
+			alg = i.alg
+			jsonInstr = &pcrProtectionProfileInstrJSON{Op: "AddPCRValueFromTPM", PCR: &pcr}
+		case *pcrProtectionProfileExtendPCRInstr:
+			pcr := i.pcr
+			alg = i.alg
+			jsonInstr = &pcrProtectionProfileInstrJSON{Op: "ExtendPCR", PCR: &pcr, Value: hex.EncodeToString(i.value)}
+		case *pcrProtectionProfileAddProfileORInstr:
+			profiles := make([][]*pcrProtectionProfileInstrJSON, 0, len(i.profiles))
+			for j, sub := range i.profiles {
+				instrs, err := sub.makeInstrsJSON()
+				if err != nil {
+					return nil, xerrors.Errorf("cannot marshal branch %d for instruction %d: %w", j, n, err)
+				}
+				profiles = append(profiles, instrs)
+			}
+			out = append(out, &pcrProtectionProfileInstrJSON{Op: "AddProfileOR", Profiles: profiles})
 			continue
+		default:
+			panic("unhandled instruction type")
 		}
-		uniquePcrDigests = append(uniquePcrDigests, d)
+
+		name, ok := pcrProtectionProfileJSONAlgorithms[alg]
+		if !ok {
+			return nil, fmt.Errorf("cannot represent algorithm %v for instruction %d", alg, n)
+		}
+		jsonInstr.Alg = name
+		out = append(out, jsonInstr)
+	}
+	return out, nil
+}
+
+func (p *PCRProtectionProfile) addInstrsFromJSON(instrs []*pcrProtectionProfileInstrJSON, depth int) error {
+	if depth > maxPCRProtectionProfileORDepth {
+		return errors.New("too many nested AddProfileOR instructions")
+	}
+
+	for n, i := range instrs {
+		if i.Op == "AddProfileOR" {
+			var profiles []*PCRProtectionProfile
+			for j, instrs := range i.Profiles {
+				sub := NewPCRProtectionProfile()
+				if err := sub.addInstrsFromJSON(instrs, depth+1); err != nil {
+					return xerrors.Errorf("invalid branch %d for instruction %d: %w", j, n, err)
+				}
+				profiles = append(profiles, sub)
+			}
+			p.AddProfileOR(profiles...)
+			continue
+		}
+
+		alg := tpm2.HashAlgorithmNull
+		for a, name := range pcrProtectionProfileJSONAlgorithms {
+			if name == i.Alg {
+				alg = a
+				break
+			}
+		}
+		if alg == tpm2.HashAlgorithmNull {
+			return fmt.Errorf("invalid algorithm for instruction %d (%q)", n, i.Alg)
+		}
+		if i.PCR == nil {
+			return fmt.Errorf("no PCR for instruction %d", n)
+		}
+
+		switch i.Op {
+		case "AddPCRValue", "ExtendPCR":
+			value, err := hex.DecodeString(i.Value)
+			if err != nil {
+				return xerrors.Errorf("cannot decode value for instruction %d: %w", n, err)
+			}
+			if err := checkPCRProtectionProfileDigest(alg, *i.PCR, value); err != nil {
+				return xerrors.Errorf("invalid instruction %d: %w", n, err)
+			}
+			if i.Op == "AddPCRValue" {
+				p.AddPCRValue(alg, *i.PCR, value)
+			} else {
+				p.ExtendPCR(alg, *i.PCR, value)
+			}
+		case "AddPCRValueFromTPM":
+			if err := checkPCRProtectionProfileInstr(alg, *i.PCR); err != nil {
+				return xerrors.Errorf("invalid instruction %d: %w", n, err)
+			}
+			p.AddPCRValueFromTPM(alg, *i.PCR)
+		default:
+			return fmt.Errorf("invalid op for instruction %d (%q)", n, i.Op)
+		}
+	}
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, and serializes this profile in a versioned JSON format that is suitable for storing and
+// diffing. As with Marshal, the serialized profile includes all sub-profiles added with AddProfileOR and placeholders for PCR
+// values added with AddPCRValueFromTPM. Only the tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256, tpm2.HashAlgorithmSHA384 and
+// tpm2.HashAlgorithmSHA512 algorithms can be represented in this format.
+func (p *PCRProtectionProfile) MarshalJSON() ([]byte, error) {
+	instrs, err := p.makeInstrsJSON()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&pcrProtectionProfileJSON{Version: currentPCRProtectionProfileVersion, Instrs: instrs})
+}
+
+// UnmarshalJSON implements json.Unmarshaler, and deserializes a profile in the JSON format produced by MarshalJSON, replacing
+// the contents of this profile.
+func (p *PCRProtectionProfile) UnmarshalJSON(data []byte) error {
+	var raw pcrProtectionProfileJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw.Version != currentPCRProtectionProfileVersion {
+		return fmt.Errorf("unexpected version number (%d)", raw.Version)
+	}
+
+	profile := NewPCRProtectionProfile()
+	if err := profile.addInstrsFromJSON(raw.Instrs, 0); err != nil {
+		return err
 	}
 
-	return pcrs, uniquePcrDigests, nil
+	*p = *profile
+	return nil
 }
@@ -21,8 +21,11 @@ package secboot_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/canonical/go-tpm2"
@@ -413,3 +416,357 @@ func TestPCRProtectionProfileAddValueFromTPM(t *testing.T) {
 		t.Errorf("ComputePCRDigests returned unexpected values")
 	}
 }
+
+func makeTestPCRProtectionProfileForMarshalling() *PCRProtectionProfile {
+	return NewPCRProtectionProfile().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+		AddPCRValueFromTPM(tpm2.HashAlgorithmSHA1, 8).
+		AddProfileOR(
+			NewPCRProtectionProfile().
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 12, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "bar")),
+			NewPCRProtectionProfile().
+				AddProfileOR(
+					NewPCRProtectionProfile().ExtendPCR(tpm2.HashAlgorithmSHA1, 12, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA1, "baz")),
+					NewPCRProtectionProfile())).
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "xyz"))
+}
+
+func TestPCRProtectionProfileDedupValues(t *testing.T) {
+	// Verify that (A || A) && (B1 || B2) only produces 2 combinations of PCR values
+	p := NewPCRProtectionProfile().
+		AddProfileOR(
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")),
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo"))).
+		AddProfileOR(
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 8, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "bar1")),
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 8, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "bar2")))
+
+	values, err := p.ComputePCRValues(nil)
+	if err != nil {
+		t.Fatalf("ComputePCRValues failed: %v", err)
+	}
+	expected := []tpm2.PCRValues{
+		{
+			tpm2.HashAlgorithmSHA256: {
+				7: testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo"),
+				8: testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "bar1"),
+			},
+		},
+		{
+			tpm2.HashAlgorithmSHA256: {
+				7: testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo"),
+				8: testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "bar2"),
+			},
+		},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("ComputePCRValues returned unexpected values")
+		t.Logf("Values:\n%s", p.DumpValues(nil))
+	}
+}
+
+func TestPCRProtectionProfileAnalyze(t *testing.T) {
+	makeBranches := func(pcr int, n int) (out []*PCRProtectionProfile) {
+		for i := 0; i < n; i++ {
+			out = append(out, NewPCRProtectionProfile().
+				AddPCRValue(tpm2.HashAlgorithmSHA256, pcr, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, fmt.Sprintf("%d", i))))
+		}
+		return
+	}
+
+	for _, data := range []struct {
+		desc            string
+		profile         *PCRProtectionProfile
+		numCombinations uint64
+		numDigests      int
+		orTreeDepth     int
+	}{
+		{
+			desc: "Single",
+			profile: NewPCRProtectionProfile().
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")),
+			numCombinations: 1,
+			numDigests:      1,
+			orTreeDepth:     1,
+		},
+		{
+			// Verify that identical branches are only counted once in the number of digests
+			desc: "Duplicates",
+			profile: NewPCRProtectionProfile().
+				AddProfileOR(
+					NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")),
+					NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo"))),
+			numCombinations: 2,
+			numDigests:      1,
+			orTreeDepth:     1,
+		},
+		{
+			desc: "EmptyProfileOR",
+			profile: NewPCRProtectionProfile().
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+				AddProfileOR(),
+			numCombinations: 1,
+			numDigests:      1,
+			orTreeDepth:     1,
+		},
+		{
+			desc: "9",
+			profile: NewPCRProtectionProfile().
+				AddProfileOR(makeBranches(7, 3)...).
+				AddProfileOR(makeBranches(8, 3)...),
+			numCombinations: 9,
+			numDigests:      9,
+			orTreeDepth:     2,
+		},
+		{
+			desc: "65",
+			profile: NewPCRProtectionProfile().
+				AddProfileOR(makeBranches(7, 13)...).
+				AddProfileOR(makeBranches(8, 5)...),
+			numCombinations: 65,
+			numDigests:      65,
+			orTreeDepth:     3,
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			analysis, err := data.profile.Analyze(nil, tpm2.HashAlgorithmSHA256, PolicySigningKeyRSA2048)
+			if err != nil {
+				t.Fatalf("Analyze failed: %v", err)
+			}
+			if analysis.NumCombinations != data.numCombinations {
+				t.Errorf("Unexpected number of combinations: %d", analysis.NumCombinations)
+			}
+			if analysis.NumDigests != data.numDigests {
+				t.Errorf("Unexpected number of digests: %d", analysis.NumDigests)
+			}
+			if analysis.ORTreeDepth != data.orTreeDepth {
+				t.Errorf("Unexpected OR tree depth: %d", analysis.ORTreeDepth)
+			}
+		})
+	}
+
+	t.Run("DynamicPolicyDataSize", func(t *testing.T) {
+		// The PCR selection is the same for both profiles, so the difference in size is the size of the additional OR tree nodes
+		// and digests: 2 additional nodes (4 bytes for the parent index and 4 bytes for the number of digests each) and 10
+		// additional digests (2 bytes for the size and 32 bytes for the digest each).
+		a1, err := NewPCRProtectionProfile().
+			AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+			AddPCRValue(tpm2.HashAlgorithmSHA256, 8, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "bar")).
+			Analyze(nil, tpm2.HashAlgorithmSHA256, PolicySigningKeyRSA2048)
+		if err != nil {
+			t.Fatalf("Analyze failed: %v", err)
+		}
+		a2, err := NewPCRProtectionProfile().
+			AddProfileOR(makeBranches(7, 3)...).
+			AddProfileOR(makeBranches(8, 3)...).
+			Analyze(nil, tpm2.HashAlgorithmSHA256, PolicySigningKeyRSA2048)
+		if err != nil {
+			t.Fatalf("Analyze failed: %v", err)
+		}
+		if a2.DynamicPolicyDataSize-a1.DynamicPolicyDataSize != (2*8)+(10*34) {
+			t.Errorf("Unexpected difference in dynamic policy data size (%d vs %d)", a1.DynamicPolicyDataSize, a2.DynamicPolicyDataSize)
+		}
+	})
+
+	t.Run("DynamicPolicyDataSizeSigningKeyType", func(t *testing.T) {
+		// The size of the policy signature depends on the type of signing key. A RSA-2048 RSASSA-PSS signature is 256 bytes with a
+		// 2 byte size, and a ECDSA signature has 2 parameters with a 2 byte size each, which are 32 bytes each for P-256 and 48
+		// bytes each for P-384.
+		profile := NewPCRProtectionProfile().
+			AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo"))
+		sizes := make(map[PolicySigningKeyType]int)
+		for _, keyType := range []PolicySigningKeyType{PolicySigningKeyRSA2048, PolicySigningKeyECCP256, PolicySigningKeyECCP384} {
+			a, err := profile.Analyze(nil, tpm2.HashAlgorithmSHA256, keyType)
+			if err != nil {
+				t.Fatalf("Analyze failed: %v", err)
+			}
+			sizes[keyType] = a.DynamicPolicyDataSize
+		}
+		if sizes[PolicySigningKeyRSA2048]-sizes[PolicySigningKeyECCP256] != (2+256)-(2*(2+32)) {
+			t.Errorf("Unexpected difference in dynamic policy data size (%d vs %d)", sizes[PolicySigningKeyRSA2048], sizes[PolicySigningKeyECCP256])
+		}
+		if sizes[PolicySigningKeyECCP384]-sizes[PolicySigningKeyECCP256] != 2*16 {
+			t.Errorf("Unexpected difference in dynamic policy data size (%d vs %d)", sizes[PolicySigningKeyECCP384], sizes[PolicySigningKeyECCP256])
+		}
+
+		if _, err := profile.Analyze(nil, tpm2.HashAlgorithmSHA256, PolicySigningKeyType(10)); err == nil || err.Error() != "invalid key type (10)" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestPCRProtectionProfileMarshalAndUnmarshal(t *testing.T) {
+	p := makeTestPCRProtectionProfileForMarshalling()
+
+	var b bytes.Buffer
+	n, err := p.Marshal(&b)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if n != b.Len() {
+		t.Errorf("Marshal returned the wrong number of bytes")
+	}
+
+	var p2 PCRProtectionProfile
+	_, err = p2.Unmarshal(&b)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if b.Len() != 0 {
+		t.Errorf("Unmarshal didn't consume all of the data")
+	}
+	if p2.String() != p.String() {
+		t.Errorf("Unexpected profile after unmarshalling:%s", &p2)
+	}
+}
+
+func TestPCRProtectionProfileUnmarshalInvalid(t *testing.T) {
+	for _, data := range []struct {
+		desc string
+		data []byte
+		err  string
+	}{
+		{
+			desc: "InvalidHeader",
+			data: decodeHexStringT(t, "555350510000000000000000"),
+			err:  "unexpected header \\(1431523409\\)",
+		},
+		{
+			desc: "InvalidVersion",
+			data: decodeHexStringT(t, "555350500000000100000000"),
+			err:  "unexpected version number \\(1\\)",
+		},
+		{
+			desc: "InvalidOpcode",
+			data: decodeHexStringT(t, "55535050000000000000000105"),
+			err:  "invalid opcode for instruction 0 \\(5\\)",
+		},
+		{
+			desc: "InvalidDigestLength",
+			data: decodeHexStringT(t, "55535050000000000000000101000b00000007000401020304"),
+			err:  "invalid instruction 0: invalid digest length for algorithm .*",
+		},
+		{
+			desc: "EmptyDigest",
+			data: decodeHexStringT(t, "55535050000000000000000101000b000000070000"),
+			err:  "invalid instruction 0: invalid digest length for algorithm .*",
+		},
+		{
+			desc: "InvalidExtendDigestLength",
+			data: decodeHexStringT(t, "55535050000000000000000103000b00000007000401020304"),
+			err:  "invalid instruction 0: invalid digest length for algorithm .*",
+		},
+		{
+			desc: "InvalidPCR",
+			data: decodeHexStringT(t, "55535050000000000000000102000b00000018"),
+			err:  "invalid instruction 0: invalid PCR index 24",
+		},
+		{
+			desc: "InvalidPCRInExtend",
+			data: decodeHexStringT(t, "55535050000000000000000103000b80000007"+
+				"00200000000000000000000000000000000000000000000000000000000000000000"),
+			err: "invalid instruction 0: invalid PCR index 2147483655",
+		},
+		{
+			desc: "TooManyNestedORs",
+			data: decodeHexStringT(t, "5553505000000000"+strings.Repeat("000000010400000001", 66)+"00000000"),
+			err:  "(cannot unmarshal branch 0 for instruction 0: )+too many nested AddProfileOR instructions",
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			var p PCRProtectionProfile
+			_, err := p.Unmarshal(bytes.NewReader(data.data))
+			if err == nil {
+				t.Fatalf("Unmarshal should have failed")
+			}
+			if !regexp.MustCompile("^" + data.err + "$").MatchString(err.Error()) {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestPCRProtectionProfileMarshalAndUnmarshalJSON(t *testing.T) {
+	p := makeTestPCRProtectionProfileForMarshalling()
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %v", err)
+	}
+
+	var p2 PCRProtectionProfile
+	if err := json.Unmarshal(data, &p2); err != nil {
+		t.Fatalf("UnmarshalJSON failed: %v", err)
+	}
+	if p2.String() != p.String() {
+		t.Errorf("Unexpected profile after unmarshalling:%s", &p2)
+	}
+}
+
+func TestPCRProtectionProfileMarshalJSONFormat(t *testing.T) {
+	p := NewPCRProtectionProfile().
+		AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 0).
+		AddProfileOR(
+			NewPCRProtectionProfile().ExtendPCR(tpm2.HashAlgorithmSHA1, 7, make(tpm2.Digest, 20)))
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %v", err)
+	}
+
+	expected := `{"version":0,"instrs":[{"op":"AddPCRValueFromTPM","alg":"sha256","pcr":0},` +
+		`{"op":"AddProfileOR","profiles":[[{"op":"ExtendPCR","alg":"sha1","pcr":7,"value":"0000000000000000000000000000000000000000"}]]}]}`
+	if string(data) != expected {
+		t.Errorf("Unexpected JSON: %s", data)
+	}
+}
+
+func TestPCRProtectionProfileUnmarshalJSONInvalid(t *testing.T) {
+	for _, data := range []struct {
+		desc string
+		data string
+		err  string
+	}{
+		{
+			desc: "InvalidVersion",
+			data: `{"version":1,"instrs":[]}`,
+			err:  "unexpected version number \\(1\\)",
+		},
+		{
+			desc: "InvalidOp",
+			data: `{"version":0,"instrs":[{"op":"Foo","alg":"sha256","pcr":7}]}`,
+			err:  "invalid op for instruction 0 \\(\"Foo\"\\)",
+		},
+		{
+			desc: "InvalidAlg",
+			data: `{"version":0,"instrs":[{"op":"AddPCRValueFromTPM","alg":"md5","pcr":7}]}`,
+			err:  "invalid algorithm for instruction 0 \\(\"md5\"\\)",
+		},
+		{
+			desc: "NoPCR",
+			data: `{"version":0,"instrs":[{"op":"AddPCRValueFromTPM","alg":"sha256"}]}`,
+			err:  "no PCR for instruction 0",
+		},
+		{
+			desc: "InvalidDigestLengthInBranch",
+			data: `{"version":0,"instrs":[{"op":"AddProfileOR","profiles":[[{"op":"ExtendPCR","alg":"sha256","pcr":7,"value":"00"}]]}]}`,
+			err:  "invalid branch 0 for instruction 0: invalid instruction 0: invalid digest length for algorithm .*",
+		},
+		{
+			desc: "InvalidPCR",
+			data: `{"version":0,"instrs":[{"op":"AddPCRValueFromTPM","alg":"sha256","pcr":24}]}`,
+			err:  "invalid instruction 0: invalid PCR index 24",
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			var p PCRProtectionProfile
+			err := json.Unmarshal([]byte(data.data), &p)
+			if err == nil {
+				t.Fatalf("UnmarshalJSON should have failed")
+			}
+			if !regexp.MustCompile("^" + data.err + "$").MatchString(err.Error()) {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/binary"
+	"io"
 	"os"
 
 	"github.com/canonical/go-tpm2"
@@ -264,14 +265,8 @@ func performPinChange(tpm *tpm2.TPMContext, public *tpm2.NVPublic, authPolicies
 //
 // If oldPIN is incorrect, then a ErrPINFail error will be returned and the TPM's dictionary attack counter will be incremented.
 func ChangePIN(tpm *TPMConnection, path string, oldPIN, newPIN string) error {
-	// Check if the TPM is in lockout mode
-	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
-	if err != nil {
-		return xerrors.Errorf("cannot fetch properties from TPM: %w", err)
-	}
-
-	if tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrInLockout > 0 {
-		return ErrTPMLockout
+	if err := checkTPMLockout(tpm); err != nil {
+		return err
 	}
 
 	// Open the key data file
@@ -281,25 +276,77 @@ func ChangePIN(tpm *TPMConnection, path string, oldPIN, newPIN string) error {
 	}
 	defer keyFile.Close()
 
+	data, changed, err := changePIN(tpm, keyFile, oldPIN, newPIN)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	if err := data.writeToFileAtomic(path); err != nil {
+		return xerrors.Errorf("cannot write key data file: %v", err)
+	}
+
+	return nil
+}
+
+// ChangePINFromReader behaves like ChangePIN, but reads the key data from keyReader and writes the updated key data to keyWriter
+// instead of updating a file. The updated key data is always written to keyWriter on success, even if it is unchanged. Note that
+// the PIN is changed on the TPM before the updated key data is written, so the caller should persist the updated key data if an
+// error occurs whilst writing it.
+func ChangePINFromReader(tpm *TPMConnection, keyReader io.Reader, keyWriter io.Writer, oldPIN, newPIN string) error {
+	if err := checkTPMLockout(tpm); err != nil {
+		return err
+	}
+
+	data, _, err := changePIN(tpm, keyReader, oldPIN, newPIN)
+	if err != nil {
+		return err
+	}
+
+	if err := data.write(keyWriter); err != nil {
+		return xerrors.Errorf("cannot write key data: %v", err)
+	}
+
+	return nil
+}
+
+// checkTPMLockout returns ErrTPMLockout if the TPM is in dictionary attack lockout mode.
+func checkTPMLockout(tpm *TPMConnection) error {
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
+	if err != nil {
+		return xerrors.Errorf("cannot fetch properties from TPM: %w", err)
+	}
+
+	if tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrInLockout > 0 {
+		return ErrTPMLockout
+	}
+	return nil
+}
+
+// changePIN changes the PIN for the key data read from keyReader, and returns the updated key data. It also indicates whether the
+// key data was modified and needs to be written back. The caller must check that the TPM is not in lockout mode first.
+func changePIN(tpm *TPMConnection, keyReader io.Reader, oldPIN, newPIN string) (*keyData, bool, error) {
 	// Read and validate the key data file
-	data, _, pinIndexPublic, err := decodeAndValidateKeyData(tpm.TPMContext, keyFile, nil, tpm.HmacSession())
+	data, _, pinIndexPublic, err := decodeAndValidateKeyData(tpm.TPMContext, keyReader, nil, tpm.HmacSession())
 	if err != nil {
 		var kfErr keyFileError
 		if xerrors.As(err, &kfErr) {
-			return InvalidKeyFileError{err.Error()}
+			return nil, false, InvalidKeyFileError{err.Error()}
 		}
-		return xerrors.Errorf("cannot read and validate key data file: %w", err)
+		return nil, false, xerrors.Errorf("cannot read and validate key data file: %w", err)
 	}
 
 	// Change the PIN
 	if err := performPinChange(tpm.TPMContext, pinIndexPublic, data.staticPolicyData.PinIndexAuthPolicies, oldPIN, newPIN, tpm.HmacSession()); err != nil {
 		if isAuthFailError(err, tpm2.CommandNVChangeAuth, 1) {
-			return ErrPINFail
+			return nil, false, ErrPINFail
 		}
-		return err
+		return nil, false, err
 	}
 
-	// Update the metadata and write a new key data file
+	// Update the metadata
 	origAuthModeHint := data.authModeHint
 	if newPIN == "" {
 		data.authModeHint = AuthModeNone
@@ -307,13 +354,5 @@ func ChangePIN(tpm *TPMConnection, path string, oldPIN, newPIN string) error {
 		data.authModeHint = AuthModePIN
 	}
 
-	if origAuthModeHint == data.authModeHint {
-		return nil
-	}
-
-	if err := data.writeToFileAtomic(path); err != nil {
-		return xerrors.Errorf("cannot write key data file: %v", err)
-	}
-
-	return nil
+	return data, origAuthModeHint != data.authModeHint, nil
 }
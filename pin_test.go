@@ -273,3 +273,13 @@ func (s *pinSuite) TestChangePINErrorHandling4(c *C) {
 		errCheckerArgs: []interface{}{"invalid key data file: cannot validate key data: PIN NV index is unavailable"},
 	})
 }
+
+func (s *pinSuite) TestChangePINErrorHandling5(c *C) {
+	// Lockout mode should be detected before the key data file is opened
+	c.Assert(s.TPM.DictionaryAttackParameters(s.TPM.LockoutHandleContext(), 0, 7200, 86400, nil), IsNil)
+	s.testChangePINErrorHandling(c, &testChangePINErrorHandlingData{
+		keyFile:        "/path/to/nothing",
+		errChecker:     Equals,
+		errCheckerArgs: []interface{}{ErrTPMLockout},
+	})
+}
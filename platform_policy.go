@@ -0,0 +1,285 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/chrisccoulson/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	platformFirmwarePCR   = 0 // SRTM, BIOS, Host Platform Extensions, Embedded Option ROMs and PI Drivers
+	platformConfigPCR     = 1 // Host Platform Configuration
+	driverAndAppCodePCR   = 2 // UEFI driver and application Code
+	driverAndAppConfigPCR = 3 // UEFI driver and application Configuration and Data
+)
+
+// PlatformFirmwareUpdate describes the measurements that the platform firmware is expected to perform after a pending firmware
+// update (such as a UEFI capsule update) has been applied.
+type PlatformFirmwareUpdate struct {
+	// Digests contains the digests of the events that the updated firmware is expected to measure to each PCR, in the order in
+	// which they will be measured, keyed by PCR index. The EV_SEPARATOR event that terminates the pre-OS measurements to each PCR
+	// should be omitted. The digests must be computed with the algorithm specified by the PCRAlgorithm field of the parameters
+	// that this update is supplied with. PCRs that are not present in this map are assumed to be unaffected by the update, and
+	// the measurements recorded in the current TCG event log will be used for these. The same update can be supplied to both
+	// AddPlatformFirmwareProfile and AddPlatformConfigProfile, each of which only uses the digests for the PCRs that it computes.
+	Digests map[int]tpm2.DigestList
+}
+
+// platformPCRLog contains the events measured to a single PCR during the pre-OS environment, as recorded in the TCG event log.
+type platformPCRLog struct {
+	initial   tpm2.Digest     // The initial value of the PCR, which depends on the startup locality for PCR 0
+	digests   tpm2.DigestList // The digests of the events measured to the PCR before the EV_SEPARATOR event
+	separator tpm2.Digest     // The digest of the EV_SEPARATOR event
+}
+
+// decodeStartupLocalityEvent returns the locality from which TPM2_Startup was called if the supplied event is the StartupLocality
+// EV_NO_ACTION event, which determines the initial value of PCR 0. EV_NO_ACTION events aren't otherwise extended to the TPM.
+func decodeStartupLocalityEvent(event *tcglog.Event) (uint8, bool) {
+	if event.EventType != tcglog.EventTypeNoAction || event.PCRIndex != platformFirmwarePCR {
+		return 0, false
+	}
+	d, ok := event.Data.(*tcglog.StartupLocalityEventData)
+	if !ok {
+		return 0, false
+	}
+	return d.Locality, true
+}
+
+// initialPCRValue returns the value of the specified PCR in the bank for the specified algorithm after TPM2_Startup was called from
+// the specified locality. All PCRs are initialized to zero, apart from PCR 0 which contains the startup locality in its last byte.
+func initialPCRValue(alg tpm2.HashAlgorithmId, pcr int, startupLocality uint8) tpm2.Digest {
+	value := make(tpm2.Digest, alg.Size())
+	if pcr == platformFirmwarePCR {
+		value[len(value)-1] = startupLocality
+	}
+	return value
+}
+
+// readPlatformPCRLogs replays the events measured to the specified PCRs from the TCG event log obtained from the supplied
+// environment, up to and including the EV_SEPARATOR event that marks the transition to OS-present for each PCR.
+func readPlatformPCRLogs(env HostEnvironment, alg tpm2.HashAlgorithmId, pcrs []int) (map[int]*platformPCRLog, error) {
+	eventLog, err := env.OpenEventLog()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open TCG event log: %w", err)
+	}
+	defer eventLog.Close()
+	log, err := tcglog.NewLog(eventLog, tcglog.LogOptions{})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot parse TCG event log header: %w", err)
+	}
+
+	if !log.Algorithms.Contains(tcglog.AlgorithmId(alg)) {
+		return nil, errors.New("the TCG event log does not have the requested algorithm")
+	}
+
+	logs := make(map[int]*platformPCRLog)
+	for _, pcr := range pcrs {
+		logs[pcr] = &platformPCRLog{initial: initialPCRValue(alg, pcr, 0)}
+	}
+
+	remaining := len(pcrs)
+	for remaining > 0 {
+		event, err := log.NextEvent()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("cannot parse TCG event log: %w", err)
+		}
+
+		l, ok := logs[int(event.PCRIndex)]
+		if !ok || l.separator != nil {
+			continue
+		}
+
+		switch {
+		case event.EventType == tcglog.EventTypeNoAction:
+			if locality, ok := decodeStartupLocalityEvent(event); ok {
+				l.initial = initialPCRValue(alg, int(event.PCRIndex), locality)
+			}
+		case event.EventType == tcglog.EventTypeSeparator:
+			l.separator = tpm2.Digest(event.Digests[tcglog.AlgorithmId(alg)])
+			remaining--
+		default:
+			l.digests = append(l.digests, tpm2.Digest(event.Digests[tcglog.AlgorithmId(alg)]))
+		}
+	}
+
+	for _, pcr := range pcrs {
+		if logs[pcr].separator == nil {
+			return nil, fmt.Errorf("the TCG event log does not contain a EV_SEPARATOR event for PCR %d", pcr)
+		}
+	}
+
+	return logs, nil
+}
+
+// addPlatformPCRProfile adds the pre-OS measurements made to the specified PCRs by the platform firmware to the provided PCR
+// protection profile. If any firmware updates are supplied, a branch is created for the current firmware and for each update.
+func addPlatformPCRProfile(profile *PCRProtectionProfile, alg tpm2.HashAlgorithmId, env HostEnvironment, pcrs []int, updates []*PlatformFirmwareUpdate) error {
+	if env == nil {
+		env = defaultHostEnvironment()
+	}
+
+	for i, update := range updates {
+		for pcr, digests := range update.Digests {
+			found := false
+			for _, p := range pcrs {
+				if p == pcr {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+			for _, d := range digests {
+				if len(d) != alg.Size() {
+					return fmt.Errorf("invalid digest length for PCR %d in firmware update %d", pcr, i)
+				}
+			}
+		}
+	}
+
+	logs, err := readPlatformPCRLogs(env, alg, pcrs)
+	if err != nil {
+		return err
+	}
+
+	addMeasurements := func(profile *PCRProtectionProfile, update *PlatformFirmwareUpdate) {
+		for _, pcr := range pcrs {
+			l := logs[pcr]
+			digests := l.digests
+			if update != nil {
+				if d, ok := update.Digests[pcr]; ok {
+					digests = d
+				}
+			}
+
+			profile.AddPCRValue(alg, pcr, l.initial)
+			for _, d := range digests {
+				profile.ExtendPCR(alg, pcr, d)
+			}
+			profile.ExtendPCR(alg, pcr, l.separator)
+		}
+	}
+
+	if len(updates) == 0 {
+		addMeasurements(profile, nil)
+		return nil
+	}
+
+	branches := []*PCRProtectionProfile{NewPCRProtectionProfile()}
+	addMeasurements(branches[0], nil)
+	for _, update := range updates {
+		branch := NewPCRProtectionProfile()
+		addMeasurements(branch, update)
+		branches = append(branches, branch)
+	}
+	profile.AddProfileOR(branches...)
+
+	return nil
+}
+
+// PlatformFirmwareProfileParams provide the arguments to AddPlatformFirmwareProfile.
+type PlatformFirmwareProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// Environment is an optional parameter that allows the caller to provide a TCG event log from an environment other than the
+	// current one. If not set, the event log of the current host is used.
+	Environment HostEnvironment
+
+	// FirmwareUpdates is an optional list of pending firmware updates for which to compute PCR digests for, in addition to the
+	// currently installed firmware.
+	FirmwareUpdates []*PlatformFirmwareUpdate
+}
+
+// AddPlatformFirmwareProfile adds the platform firmware code profile to the provided PCR protection profile, in order to generate a
+// PCR policy that restricts access to a sealed key to a specific platform firmware and set of UEFI drivers. The measurements are
+// made to PCR 0 (SRTM, BIOS, host platform extensions, embedded option ROMs and PI drivers) and PCR 2 (UEFI drivers and
+// applications, including option ROMs for add-in devices), and are detailed in sections 2.3.4.1 and 2.3.4.3 of the "TCG PC Client
+// Platform Firmware Profile Specification".
+//
+// The PCR values are computed by replaying the events recorded to these PCRs in the TCG event log up to and including the
+// EV_SEPARATOR event that marks the transition to OS-present. The initial value of PCR 0 takes in to account the locality from which
+// TPM2_Startup was called, if this is recorded in the event log.
+//
+// By default, the TCG event log is read from the current host. A PCR profile can be computed for a different environment by
+// supplying a HostEnvironment via the Environment field of params (see FileHostEnvironment).
+//
+// Updating the platform firmware will change the measurements made to these PCRs. If the FirmwareUpdates field of params is
+// supplied, the generated PCR profile will permit access to the sealed key with the currently installed firmware or with any of
+// the supplied updates applied, so that keys can remain accessible across a firmware update that is applied on the next boot.
+// Each update supplies the digests of the events that the updated firmware measures to each PCR, which must be obtained from the
+// firmware vendor or by booting the updated firmware on a reference device. This function has no way of verifying that these
+// digests are correct.
+func AddPlatformFirmwareProfile(profile *PCRProtectionProfile, params *PlatformFirmwareProfileParams) error {
+	return addPlatformPCRProfile(profile, params.PCRAlgorithm, params.Environment, []int{platformFirmwarePCR, driverAndAppCodePCR},
+		params.FirmwareUpdates)
+}
+
+// PlatformConfigProfileParams provide the arguments to AddPlatformConfigProfile.
+type PlatformConfigProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// Environment is an optional parameter that allows the caller to provide a TCG event log from an environment other than the
+	// current one. If not set, the event log of the current host is used.
+	Environment HostEnvironment
+
+	// FirmwareUpdates is an optional list of pending firmware updates for which to compute PCR digests for, in addition to the
+	// currently installed firmware.
+	FirmwareUpdates []*PlatformFirmwareUpdate
+}
+
+// AddPlatformConfigProfile adds the platform firmware configuration profile to the provided PCR protection profile, in order to
+// generate a PCR policy that restricts access to a sealed key to a specific platform firmware configuration. The measurements are
+// made to PCR 1 (host platform configuration, such as SMBIOS tables and the Boot#### and BootOrder variables) and PCR 3 (UEFI driver
+// and application configuration and data), and are detailed in sections 2.3.4.2 and 2.3.4.4 of the "TCG PC Client Platform
+// Firmware Profile Specification".
+//
+// The PCR values are computed by replaying the events recorded to these PCRs in the TCG event log up to and including the
+// EV_SEPARATOR event that marks the transition to OS-present. Note that it is not possible to pre-compute the effect of changes to
+// the platform configuration using this function, and so a new PCR profile can only be generated after the change has been made and
+// the platform has been rebooted.
+//
+// By default, the TCG event log is read from the current host. A PCR profile can be computed for a different environment by
+// supplying a HostEnvironment via the Environment field of params (see FileHostEnvironment).
+//
+// Platform firmware commonly measures data that includes the firmware version to PCR 1 (eg, SMBIOS tables), so updating the platform
+// firmware may also change the measurements made to these PCRs. If the FirmwareUpdates field of params is supplied, the generated
+// PCR profile will permit access to the sealed key with the currently installed firmware or with any of the supplied updates
+// applied. See the documentation for AddPlatformFirmwareProfile.
+func AddPlatformConfigProfile(profile *PCRProtectionProfile, params *PlatformConfigProfileParams) error {
+	return addPlatformPCRProfile(profile, params.PCRAlgorithm, params.Environment, []int{platformConfigPCR, driverAndAppConfigPCR},
+		params.FirmwareUpdates)
+}
@@ -0,0 +1,175 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto/sha256"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type platformPolicySuite struct{}
+
+var _ = Suite(&platformPolicySuite{})
+
+type testAddPlatformProfileData struct {
+	add    func(profile *PCRProtectionProfile) error
+	pcrs   []int
+	values []tpm2.PCRValues
+}
+
+func (s *platformPolicySuite) testAddPlatformProfile(c *C, data *testAddPlatformProfileData) {
+	expectedPcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: data.pcrs}}
+	var expectedDigests tpm2.DigestList
+	for _, v := range data.values {
+		d, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, expectedPcrs, v)
+		expectedDigests = append(expectedDigests, d)
+	}
+
+	profile := NewPCRProtectionProfile()
+	c.Assert(data.add(profile), IsNil)
+	pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	c.Check(pcrs.Equal(expectedPcrs), Equals, true)
+	c.Check(digests, DeepEquals, expectedDigests)
+	if c.Failed() {
+		c.Logf("Profile:\n%s", profile)
+		c.Logf("Values:\n%s", profile.DumpValues(nil))
+	}
+}
+
+func (s *platformPolicySuite) mockFirmwareUpdate() *PlatformFirmwareUpdate {
+	h := sha256.Sum256([]byte("updated firmware version"))
+	version := h[:]
+	h = sha256.Sum256([]byte("updated firmware blob"))
+	blob := h[:]
+	h = sha256.Sum256([]byte("updated SMBIOS tables"))
+	smbios := h[:]
+	return &PlatformFirmwareUpdate{
+		Digests: map[int]tpm2.DigestList{
+			0: {version, blob},
+			1: {smbios},
+		},
+	}
+}
+
+func (s *platformPolicySuite) TestAddPlatformFirmwareProfile(c *C) {
+	s.testAddPlatformProfile(c, &testAddPlatformProfileData{
+		add: func(profile *PCRProtectionProfile) error {
+			return AddPlatformFirmwareProfile(profile, &PlatformFirmwareProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+				Environment:  &FileHostEnvironment{EventLogPath: "testdata/eventlog1.bin"}})
+		},
+		pcrs: []int{0, 2},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					0: testutil.DecodeHexString(c, "7e77f6ab3fa1cf5c24a9787ec2812f33cc2abf196822fe34ee042a89ee717497"),
+					2: testutil.DecodeHexString(c, "cb6fae05d9e2ee5240157ae17f7229a38bec97f9c53fa3dcec18e6802adbeeec"),
+				},
+			},
+		},
+	})
+}
+
+func (s *platformPolicySuite) TestAddPlatformFirmwareProfileWithUpdate(c *C) {
+	s.testAddPlatformProfile(c, &testAddPlatformProfileData{
+		add: func(profile *PCRProtectionProfile) error {
+			return AddPlatformFirmwareProfile(profile, &PlatformFirmwareProfileParams{
+				PCRAlgorithm:    tpm2.HashAlgorithmSHA256,
+				Environment:     &FileHostEnvironment{EventLogPath: "testdata/eventlog1.bin"},
+				FirmwareUpdates: []*PlatformFirmwareUpdate{s.mockFirmwareUpdate()}})
+		},
+		pcrs: []int{0, 2},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					0: testutil.DecodeHexString(c, "7e77f6ab3fa1cf5c24a9787ec2812f33cc2abf196822fe34ee042a89ee717497"),
+					2: testutil.DecodeHexString(c, "cb6fae05d9e2ee5240157ae17f7229a38bec97f9c53fa3dcec18e6802adbeeec"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					0: testutil.DecodeHexString(c, "c6b7952a5c6bee679e9b8675e82710b99a3274875b726f2c5d7b6dedf30de10d"),
+					2: testutil.DecodeHexString(c, "cb6fae05d9e2ee5240157ae17f7229a38bec97f9c53fa3dcec18e6802adbeeec"),
+				},
+			},
+		},
+	})
+}
+
+func (s *platformPolicySuite) TestAddPlatformConfigProfile(c *C) {
+	s.testAddPlatformProfile(c, &testAddPlatformProfileData{
+		add: func(profile *PCRProtectionProfile) error {
+			return AddPlatformConfigProfile(profile, &PlatformConfigProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+				Environment:  &FileHostEnvironment{EventLogPath: "testdata/eventlog1.bin"}})
+		},
+		pcrs: []int{1, 3},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					1: testutil.DecodeHexString(c, "798fece5afca6ef1d79a2e4eb85f8427ff474fc8a6ad935e4694b203de1d5cda"),
+					3: testutil.DecodeHexString(c, "3d458cfe55cc03ea1f443f1562beec8df51c75e14a9fcf9a7234a13f198e7969"),
+				},
+			},
+		},
+	})
+}
+
+func (s *platformPolicySuite) TestAddPlatformConfigProfileWithUpdate(c *C) {
+	s.testAddPlatformProfile(c, &testAddPlatformProfileData{
+		add: func(profile *PCRProtectionProfile) error {
+			return AddPlatformConfigProfile(profile, &PlatformConfigProfileParams{
+				PCRAlgorithm:    tpm2.HashAlgorithmSHA256,
+				Environment:     &FileHostEnvironment{EventLogPath: "testdata/eventlog1.bin"},
+				FirmwareUpdates: []*PlatformFirmwareUpdate{s.mockFirmwareUpdate()}})
+		},
+		pcrs: []int{1, 3},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					1: testutil.DecodeHexString(c, "798fece5afca6ef1d79a2e4eb85f8427ff474fc8a6ad935e4694b203de1d5cda"),
+					3: testutil.DecodeHexString(c, "3d458cfe55cc03ea1f443f1562beec8df51c75e14a9fcf9a7234a13f198e7969"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					1: testutil.DecodeHexString(c, "51d5ed0f30bc57271f252d22b2e909b274da70ff6f6ab51e58daabe2bbba2cb1"),
+					3: testutil.DecodeHexString(c, "3d458cfe55cc03ea1f443f1562beec8df51c75e14a9fcf9a7234a13f198e7969"),
+				},
+			},
+		},
+	})
+}
+
+func (s *platformPolicySuite) TestAddPlatformFirmwareProfileInvalidUpdateDigest(c *C) {
+	err := AddPlatformFirmwareProfile(NewPCRProtectionProfile(), &PlatformFirmwareProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		Environment:  &FileHostEnvironment{EventLogPath: "testdata/eventlog1.bin"},
+		FirmwareUpdates: []*PlatformFirmwareUpdate{
+			{Digests: map[int]tpm2.DigestList{0: {make(tpm2.Digest, 20)}}},
+		}})
+	c.Check(err, ErrorMatches, "invalid digest length for PCR 0 in firmware update 0")
+}
@@ -21,11 +21,14 @@ package secboot
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io/ioutil"
 
 	"github.com/canonical/go-tpm2"
 
@@ -44,7 +47,7 @@ var (
 
 // dynamicPolicyComputeParams provides the parameters to computeDynamicPolicy.
 type dynamicPolicyComputeParams struct {
-	key *rsa.PrivateKey // Key used to authorize the generated dynamic authorization policy
+	key crypto.PrivateKey // Key used to authorize the generated dynamic authorization policy (*rsa.PrivateKey or *ecdsa.PrivateKey)
 
 	// signAlg is the digest algorithm for the signature used to authorize the generated dynamic authorization policy. It must
 	// match the name algorithm of the public part of key that will be loaded in to the TPM for verification.
@@ -67,6 +70,38 @@ type policyOrDataNode struct {
 
 type policyOrDataTree []policyOrDataNode
 
+// depth returns the number of levels in this tree, which corresponds to the number of TPM2_PolicyOR assertions that are executed
+// when satisfying a policy with it.
+func (t policyOrDataTree) depth() (n int) {
+	if len(t) == 0 {
+		return 0
+	}
+	for i := 0; ; {
+		n++
+		if t[i].Next == 0 {
+			return n
+		}
+		i += int(t[i].Next)
+	}
+}
+
+// numBranches returns the number of digests contained in the leaf nodes of this tree, which corresponds to the number of PCR value
+// combinations that can satisfy a policy with it.
+func (t policyOrDataTree) numBranches() (n int) {
+	parents := make(map[int]bool)
+	for i, node := range t {
+		if node.Next != 0 {
+			parents[i+int(node.Next)] = true
+		}
+	}
+	for i, node := range t {
+		if !parents[i] {
+			n += len(node.Digests)
+		}
+	}
+	return n
+}
+
 // dynamicPolicyData is an output of computeDynamicPolicy and provides metadata for executing a policy session.
 type dynamicPolicyData struct {
 	PCRSelection              tpm2.PCRSelectionList
@@ -89,6 +124,15 @@ func makeDynamicPolicyDataRaw_v0(data *dynamicPolicyData) *dynamicPolicyDataRaw_
 	return (*dynamicPolicyDataRaw_v0)(data)
 }
 
+// marshalledSize returns the number of bytes that this dynamicPolicyData occupies in a key data file.
+func (d *dynamicPolicyData) marshalledSize() int {
+	n, err := tpm2.MarshalToWriter(ioutil.Discard, makeDynamicPolicyDataRaw_v0(d))
+	if err != nil {
+		panic(fmt.Sprintf("cannot marshal dynamic policy data: %v", err))
+	}
+	return n
+}
+
 // staticPolicyComputeParams provides the parameters to computeStaticPolicy.
 type staticPolicyComputeParams struct {
 	key                  *tpm2.Public    // Public part of key used to authorize a dynamic authorization policy
@@ -117,13 +161,47 @@ func makeStaticPolicyDataRaw_v0(data *staticPolicyData) *staticPolicyDataRaw_v0
 	return (*staticPolicyDataRaw_v0)(data)
 }
 
+// signPolicyAuthorization signs the supplied digest, which was computed with the specified algorithm, using the specified key. RSA
+// keys produce a RSASSA-PSS signature and ECC keys produce a ECDSA signature. The returned signature is suitable for use with
+// TPM2_PolicySigned and TPM2_VerifySignature.
+func signPolicyAuthorization(key crypto.PrivateKey, alg tpm2.HashAlgorithmId, digest []byte) (*tpm2.Signature, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err := rsa.SignPSS(rand.Reader, k, alg.GetHash(), digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		if err != nil {
+			return nil, err
+		}
+		return &tpm2.Signature{
+			SigAlg: tpm2.SigSchemeAlgRSAPSS,
+			Signature: tpm2.SignatureU{
+				Data: &tpm2.SignatureRSAPSS{
+					Hash: alg,
+					Sig:  tpm2.PublicKeyRSA(sig)}}}, nil
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			return nil, err
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return &tpm2.Signature{
+			SigAlg: tpm2.SigSchemeAlgECDSA,
+			Signature: tpm2.SignatureU{
+				Data: &tpm2.SignatureECDSA{
+					Hash:       alg,
+					SignatureR: zeroExtendBytes(r.Bytes(), size),
+					SignatureS: zeroExtendBytes(s.Bytes(), size)}}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
 // incrementDynamicPolicyCounter will increment the NV counter index associated with nvPublic. This is designed to operate on a
 // NV index created by createPinNVIndex. The authorization policy digests returned from createPinNVIndex must be supplied via the
 // nvAuthPolicies argument.
 //
 // This requires a signed authorization. The keyPublic argument must correspond to the updateKeyName argument originally passed to
 // createPinNVIndex. The private part of that key must be supplied via the key argument.
-func incrementDynamicPolicyCounter(tpm *tpm2.TPMContext, nvPublic *tpm2.NVPublic, nvAuthPolicies tpm2.DigestList, key *rsa.PrivateKey, keyPublic *tpm2.Public, hmacSession tpm2.SessionContext) error {
+func incrementDynamicPolicyCounter(tpm *tpm2.TPMContext, nvPublic *tpm2.NVPublic, nvAuthPolicies tpm2.DigestList, key crypto.PrivateKey, keyPublic *tpm2.Public, hmacSession tpm2.SessionContext) error {
 	index, err := tpm2.CreateNVIndexResourceContextFromPublic(nvPublic)
 	if err != nil {
 		return xerrors.Errorf("cannot create context for NV index: %w", err)
@@ -137,13 +215,13 @@ func incrementDynamicPolicyCounter(tpm *tpm2.TPMContext, nvPublic *tpm2.NVPublic
 	defer tpm.FlushContext(policySession)
 
 	// Compute a digest for signing with the update key
-	signDigest := tpm2.HashAlgorithmSHA256
+	signDigest := keyPublic.NameAlg
 	h := signDigest.NewHash()
 	h.Write(policySession.NonceTPM())
 	binary.Write(h, binary.BigEndian, int32(0)) // expiration
 
 	// Sign the digest
-	sig, err := rsa.SignPSS(rand.Reader, key, signDigest.GetHash(), h.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	signature, err := signPolicyAuthorization(key, signDigest, h.Sum(nil))
 	if err != nil {
 		return xerrors.Errorf("cannot sign authorization: %w", err)
 	}
@@ -157,13 +235,6 @@ func incrementDynamicPolicyCounter(tpm *tpm2.TPMContext, nvPublic *tpm2.NVPublic
 	}
 	defer tpm.FlushContext(keyLoaded)
 
-	signature := tpm2.Signature{
-		SigAlg: tpm2.SigSchemeAlgRSAPSS,
-		Signature: tpm2.SignatureU{
-			Data: &tpm2.SignatureRSAPSS{
-				Hash: signDigest,
-				Sig:  tpm2.PublicKeyRSA(sig)}}}
-
 	// Execute the policy assertions
 	if err := tpm.PolicyCommandCode(policySession, tpm2.CommandNVIncrement); err != nil {
 		return xerrors.Errorf("cannot execute assertion to increment counter: %w", err)
@@ -171,7 +242,7 @@ func incrementDynamicPolicyCounter(tpm *tpm2.TPMContext, nvPublic *tpm2.NVPublic
 	if err := tpm.PolicyNvWritten(policySession, true); err != nil {
 		return xerrors.Errorf("cannot execute assertion to increment counter: %w", err)
 	}
-	if _, _, err := tpm.PolicySigned(keyLoaded, policySession, true, nil, nil, 0, &signature); err != nil {
+	if _, _, err := tpm.PolicySigned(keyLoaded, policySession, true, nil, nil, 0, signature); err != nil {
 		return xerrors.Errorf("cannot execute assertion to increment counter: %w", err)
 	}
 	if err := tpm.PolicyOR(policySession, nvAuthPolicies); err != nil {
@@ -580,8 +651,8 @@ func computePolicyORData(alg tpm2.HashAlgorithmId, trial *tpm2.TrialAuthPolicy,
 // computeDynamicPolicy computes the part of an authorization policy associated with a sealed key object that can change and be
 // updated.
 func computeDynamicPolicy(version uint32, alg tpm2.HashAlgorithmId, input *dynamicPolicyComputeParams) (*dynamicPolicyData, error) {
-	// We only have a single metadata version at the moment (version 0)
-	if version != 0 {
+	// All metadata versions use the same dynamic authorization policy
+	if version > currentMetadataVersion {
 		return nil, errors.New("invalid version")
 	}
 	if len(input.pcrDigests) == 0 {
@@ -610,24 +681,17 @@ func computeDynamicPolicy(version uint32, alg tpm2.HashAlgorithmId, input *dynam
 	h.Write(authorizedPolicy)
 
 	// Sign the digest
-	sig, err := rsa.SignPSS(rand.Reader, input.key, input.signAlg.GetHash(), h.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	signature, err := signPolicyAuthorization(input.key, input.signAlg, h.Sum(nil))
 	if err != nil {
 		return nil, xerrors.Errorf("cannot provide signature for initializing NV index: %w", err)
 	}
 
-	signature := tpm2.Signature{
-		SigAlg: tpm2.SigSchemeAlgRSAPSS,
-		Signature: tpm2.SignatureU{
-			Data: &tpm2.SignatureRSAPSS{
-				Hash: input.signAlg,
-				Sig:  tpm2.PublicKeyRSA(sig)}}}
-
 	return &dynamicPolicyData{
 		PCRSelection:              input.pcrs,
 		PCROrData:                 pcrOrData,
 		PolicyCount:               input.policyCount,
 		AuthorizedPolicy:          authorizedPolicy,
-		AuthorizedPolicySignature: &signature}, nil
+		AuthorizedPolicySignature: signature}, nil
 }
 
 type staticPolicyDataError struct {
@@ -22,13 +22,28 @@ package secboot
 import (
 	"bytes"
 	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/chrisccoulson/tcglog-parser"
+	"github.com/snapcore/secboot/internal/pe1.14"
 
 	"golang.org/x/xerrors"
 )
 
+const (
+	systemdStubKernelImagePCR  = 11 // PCR that systemd-stub measures the sections of a unified kernel image to
+	systemdStubKernelConfigPCR = 12 // PCR that systemd-stub measures the kernel commandline supplied by the boot loader and credentials to
+	systemdStubSysextPCR       = 13 // PCR that systemd-stub measures system extension images to
+)
+
+// systemdStubUKISections is the list of unified kernel image sections measured by systemd-stub, in the order in which they are
+// measured.
+var systemdStubUKISections = []string{".linux", ".osrel", ".cmdline", ".initrd", ".splash", ".dtb", ".uname", ".sbat", ".pcrpkey"}
+
 // SystemdEFIStubProfileParams provides the parameters to AddSystemdEFIStubProfile.
 type SystemdEFIStubProfileParams struct {
 	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
@@ -41,6 +56,18 @@ type SystemdEFIStubProfileParams struct {
 
 	// KernelCmdlines is the set of kernel commandlines to add to the PCR profile.
 	KernelCmdlines []string
+
+	// Credentials is an optional list of paths to the credential files that the systemd EFI stub loads from the directory
+	// associated with the kernel image (<image>.extra.d/*.cred). These are measured to PCR 12.
+	Credentials []string
+
+	// GlobalCredentials is an optional list of paths to the credential files that the systemd EFI stub loads from the
+	// \loader\credentials directory of the EFI system partition. These are measured to PCR 12.
+	GlobalCredentials []string
+
+	// SystemExtensions is an optional list of paths to the system extension images that the systemd EFI stub loads from the
+	// directory associated with the kernel image (<image>.extra.d/*.raw). These are measured to PCR 13.
+	SystemExtensions []string
 }
 
 // AddSystemdEFIStubProfile adds the systemd EFI linux loader stub profile to the PCR protection profile, in order to generate a
@@ -50,28 +77,228 @@ type SystemdEFIStubProfileParams struct {
 // The PCR index that the EFI stub measures the kernel commandline too can be specified via the PCRIndex field of params.
 //
 // The set of kernel commandlines to add to the PCRProtectionProfile is specified via the KernelCmdlines field of params.
+//
+// Current versions of the systemd EFI stub also measure credential files and system extension images that are loaded from the EFI
+// system partition. These can be specified via the Credentials, GlobalCredentials and SystemExtensions fields of params. The stub
+// measures the contents of each credential file to PCR 12 and the contents of each system extension image to PCR 13. Files loaded
+// from the same directory are measured in order of their filename, with credentials associated with the kernel image measured
+// before global credentials. At least one kernel commandline, credential file or system extension image must be specified.
 func AddSystemdEFIStubProfile(profile *PCRProtectionProfile, params *SystemdEFIStubProfileParams) error {
 	if params.PCRIndex < 0 {
 		return errors.New("invalid PCR index")
 	}
-	if len(params.KernelCmdlines) == 0 {
-		return errors.New("no kernel commandlines specified")
+	if len(params.KernelCmdlines) == 0 && len(params.Credentials) == 0 && len(params.GlobalCredentials) == 0 && len(params.SystemExtensions) == 0 {
+		return errors.New("no kernel commandlines, credentials or system extensions specified")
 	}
 
-	var subProfiles []*PCRProtectionProfile
-	for _, cmdline := range params.KernelCmdlines {
+	if len(params.KernelCmdlines) > 0 {
+		subProfiles, err := computeSystemdEFIStubCmdlineProfiles(params.PCRAlgorithm, params.PCRIndex, params.KernelCmdlines)
+		if err != nil {
+			return err
+		}
+		profile.AddProfileOR(subProfiles...)
+	}
+
+	return addSystemdEFIStubFileMeasurements(profile, params.PCRAlgorithm, params.Credentials, params.GlobalCredentials, params.SystemExtensions)
+}
+
+// computeSystemdEFIStubFileDigests computes the digests of the files with the supplied paths, in the order in which the systemd EFI
+// stub measures them. The stub measures the files loaded from a directory in order of their filename.
+func computeSystemdEFIStubFileDigests(alg tpm2.HashAlgorithmId, paths []string) (tpm2.DigestList, error) {
+	sorted := make([]string, len(paths))
+	copy(sorted, paths)
+	sort.SliceStable(sorted, func(i, j int) bool { return filepath.Base(sorted[i]) < filepath.Base(sorted[j]) })
+
+	var digests tpm2.DigestList
+	for _, path := range sorted {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot open %s: %w", path, err)
+		}
+		h := alg.NewHash()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read %s: %w", path, err)
+		}
+		digests = append(digests, h.Sum(nil))
+	}
+	return digests, nil
+}
+
+// addSystemdEFIStubFileMeasurements extends the measurements of the supplied credential files and system extension images made by
+// the systemd EFI stub to the supplied profile.
+func addSystemdEFIStubFileMeasurements(profile *PCRProtectionProfile, alg tpm2.HashAlgorithmId, credentials, globalCredentials, sysexts []string) error {
+	for _, files := range []struct {
+		pcr   int
+		paths []string
+	}{
+		{pcr: systemdStubKernelConfigPCR, paths: credentials},
+		{pcr: systemdStubKernelConfigPCR, paths: globalCredentials},
+		{pcr: systemdStubSysextPCR, paths: sysexts},
+	} {
+		digests, err := computeSystemdEFIStubFileDigests(alg, files.paths)
+		if err != nil {
+			return xerrors.Errorf("cannot compute file measurements: %w", err)
+		}
+		for _, digest := range digests {
+			profile.ExtendPCR(alg, files.pcr, digest)
+		}
+	}
+	return nil
+}
+
+// computeSystemdEFIStubCmdlineProfiles returns a PCR profile for each of the supplied kernel commandlines, each containing the
+// measurement of the commandline made by the systemd EFI stub to the specified PCR.
+func computeSystemdEFIStubCmdlineProfiles(alg tpm2.HashAlgorithmId, pcr int, cmdlines []string) ([]*PCRProtectionProfile, error) {
+	var out []*PCRProtectionProfile
+	for _, cmdline := range cmdlines {
 		event := tcglog.SystemdEFIStubEventData{Str: cmdline}
 		var buf bytes.Buffer
 		if err := event.EncodeMeasuredBytes(&buf); err != nil {
-			return xerrors.Errorf("cannot encode kernel commandline event: %w", err)
+			return nil, xerrors.Errorf("cannot encode kernel commandline event: %w", err)
 		}
 
-		h := params.PCRAlgorithm.NewHash()
+		h := alg.NewHash()
 		buf.WriteTo(h)
 
-		subProfiles = append(subProfiles, NewPCRProtectionProfile().ExtendPCR(params.PCRAlgorithm, params.PCRIndex, h.Sum(nil)))
+		out = append(out, NewPCRProtectionProfile().ExtendPCR(alg, pcr, h.Sum(nil)))
+	}
+	return out, nil
+}
+
+// SystemdUKIProfileParams provides the parameters to AddSystemdUKIProfile.
+type SystemdUKIProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// Images is the set of unified kernel images to add to the PCR profile.
+	Images []EFIImage
+
+	// KernelCmdlines is an optional set of kernel commandlines supplied by the boot loader. These are only used for images that don't
+	// contain a .cmdline section, as systemd-stub ignores the commandline supplied by the boot loader otherwise.
+	KernelCmdlines []string
+
+	// Credentials is an optional list of paths to the credential files that systemd-stub loads from the directory associated with
+	// the images (<image>.extra.d/*.cred). These are measured to PCR 12.
+	Credentials []string
+
+	// GlobalCredentials is an optional list of paths to the credential files that systemd-stub loads from the \loader\credentials
+	// directory of the EFI system partition. These are measured to PCR 12.
+	GlobalCredentials []string
+
+	// SystemExtensions is an optional list of paths to the system extension images that systemd-stub loads from the directory
+	// associated with the images (<image>.extra.d/*.raw). These are measured to PCR 13.
+	SystemExtensions []string
+}
+
+// computeSystemdUKISectionsMeasurements computes the measurements made by systemd-stub to PCR 11 for the supplied unified kernel
+// image. It also returns whether the image contains a .cmdline section.
+func computeSystemdUKISectionsMeasurements(alg tpm2.HashAlgorithmId, image EFIImage) (digests tpm2.DigestList, hasCmdline bool, err error) {
+	r, err := image.Open()
+	if err != nil {
+		return nil, false, xerrors.Errorf("cannot open image: %w", err)
+	}
+	defer r.Close()
+
+	pefile, err := pe.NewFile(r)
+	if err != nil {
+		return nil, false, xerrors.Errorf("cannot decode PE binary: %w", err)
+	}
+
+	if pefile.Section(".linux") == nil {
+		return nil, false, errors.New("image is not a unified kernel image: no .linux section")
+	}
+
+	for _, name := range systemdStubUKISections {
+		section := pefile.Section(name)
+		if section == nil || section.VirtualSize == 0 {
+			continue
+		}
+		if name == ".cmdline" {
+			hasCmdline = true
+		}
+
+		// systemd-stub measures the section contents as they appear in memory, which is VirtualSize bytes long and zero padded if
+		// this is larger than the size of the raw data.
+		data, err := section.Data()
+		if err != nil {
+			return nil, false, xerrors.Errorf("cannot read %s section: %w", name, err)
+		}
+		if len(data) > int(section.VirtualSize) {
+			data = data[:section.VirtualSize]
+		} else {
+			data = append(data, make([]byte, int(section.VirtualSize)-len(data))...)
+		}
+
+		// The section name is measured first, including the NUL terminator.
+		h := alg.NewHash()
+		h.Write(append([]byte(name), 0))
+		digests = append(digests, h.Sum(nil))
+
+		h = alg.NewHash()
+		h.Write(data)
+		digests = append(digests, h.Sum(nil))
+	}
+
+	return digests, hasCmdline, nil
+}
+
+// AddSystemdUKIProfile adds the systemd EFI stub profile for unified kernel images (UKIs) to the PCR protection profile, in order to
+// generate a PCR policy that restricts access to a key to a defined set of unified kernel images booted with systemd-stub.
+//
+// For each image specified via the Images field of params, the measurements made by systemd-stub to PCR 11 are computed from the
+// .linux, .osrel, .cmdline, .initrd, .splash, .dtb, .uname, .sbat and .pcrpkey sections of the image. The name of each section
+// that is present is measured, followed by its contents.
+//
+// If an image doesn't contain a .cmdline section, the commandlines supplied via the KernelCmdlines field of params are added to the
+// PCR profile for PCR 12, in the same way as AddSystemdEFIStubProfile. If an image contains a .cmdline section, systemd-stub ignores
+// any commandline supplied by the boot loader and so nothing is measured to PCR 12. In this case, PCR 12 is added to the PCR profile
+// with its initial value if any commandlines are supplied via the KernelCmdlines field of params, so that every branch of the profile
+// contains the same set of PCRs. If no commandlines are supplied, PCR 12 is not added to the PCR profile.
+//
+// Credential files and system extension images supplied via the Credentials, GlobalCredentials and SystemExtensions fields of
+// params are measured in the same way as AddSystemdEFIStubProfile, after the kernel commandline.
+//
+// Note that the unified kernel images must also be added to the profiles for PCR 4 and PCR 7 (see AddEFIBootManagerProfile and
+// AddEFISecureBootPolicyProfile) in order to compute a complete PCR policy for them.
+func AddSystemdUKIProfile(profile *PCRProtectionProfile, params *SystemdUKIProfileParams) error {
+	if len(params.Images) == 0 {
+		return errors.New("no images specified")
+	}
+
+	var subProfiles []*PCRProtectionProfile
+	for _, image := range params.Images {
+		digests, hasCmdline, err := computeSystemdUKISectionsMeasurements(params.PCRAlgorithm, image)
+		if err != nil {
+			return xerrors.Errorf("cannot compute measurements for %s: %w", image, err)
+		}
+
+		p := NewPCRProtectionProfile()
+		for _, digest := range digests {
+			p.ExtendPCR(params.PCRAlgorithm, systemdStubKernelImagePCR, digest)
+		}
+
+		switch {
+		case len(params.KernelCmdlines) == 0:
+			// Nothing to do
+		case hasCmdline:
+			// The commandline supplied by the boot loader is ignored, so nothing is measured to PCR 12.
+			p.AddPCRValue(params.PCRAlgorithm, systemdStubKernelConfigPCR, make(tpm2.Digest, params.PCRAlgorithm.Size()))
+		default:
+			cmdlineProfiles, err := computeSystemdEFIStubCmdlineProfiles(params.PCRAlgorithm, systemdStubKernelConfigPCR, params.KernelCmdlines)
+			if err != nil {
+				return xerrors.Errorf("cannot compute kernel commandline measurements for %s: %w", image, err)
+			}
+			p.AddProfileOR(cmdlineProfiles...)
+		}
+
+		subProfiles = append(subProfiles, p)
 	}
 
 	profile.AddProfileOR(subProfiles...)
-	return nil
+
+	return addSystemdEFIStubFileMeasurements(profile, params.PCRAlgorithm, params.Credentials, params.GlobalCredentials, params.SystemExtensions)
 }
@@ -20,6 +20,11 @@
 package secboot_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
@@ -153,3 +158,295 @@ func TestAddSystemdEFIStubProfile(t *testing.T) {
 		})
 	}
 }
+
+type mockUKISection struct {
+	name string
+	data []byte
+}
+
+// writeMockUKI writes a minimal PE image containing the supplied sections to path. The raw data of each section is padded to a
+// 16-byte boundary, but the VirtualSize of each section is set to the length of the supplied data.
+func writeMockUKI(t *testing.T, path string, sections []mockUKISection) {
+	var hdr bytes.Buffer
+	var data bytes.Buffer
+
+	binary.Write(&hdr, binary.LittleEndian, struct {
+		Machine              uint16
+		NumberOfSections     uint16
+		TimeDateStamp        uint32
+		PointerToSymbolTable uint32
+		NumberOfSymbols      uint32
+		SizeOfOptionalHeader uint16
+		Characteristics      uint16
+	}{Machine: 0x8664, NumberOfSections: uint16(len(sections))})
+
+	dataOffset := 512
+	for _, s := range sections {
+		var name [8]uint8
+		copy(name[:], s.name)
+		rawSize := (len(s.data) + 15) &^ 15
+		binary.Write(&hdr, binary.LittleEndian, struct {
+			Name                 [8]uint8
+			VirtualSize          uint32
+			VirtualAddress       uint32
+			SizeOfRawData        uint32
+			PointerToRawData     uint32
+			PointerToRelocations uint32
+			PointerToLineNumbers uint32
+			NumberOfRelocations  uint16
+			NumberOfLineNumbers  uint16
+			Characteristics      uint32
+		}{
+			Name:             name,
+			VirtualSize:      uint32(len(s.data)),
+			VirtualAddress:   uint32(dataOffset + data.Len()),
+			SizeOfRawData:    uint32(rawSize),
+			PointerToRawData: uint32(dataOffset + data.Len())})
+		data.Write(s.data)
+		data.Write(make([]byte, rawSize-len(s.data)))
+	}
+
+	if hdr.Len() > dataOffset {
+		t.Fatalf("too many sections")
+	}
+	hdr.Write(make([]byte, dataOffset-hdr.Len()))
+	hdr.Write(data.Bytes())
+
+	if err := ioutil.WriteFile(path, hdr.Bytes(), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+}
+
+func TestAddSystemdUKIProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secboot-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeMockUKI(t, filepath.Join(dir, "uki1.efi"), []mockUKISection{
+		{name: ".cmdline", data: []byte("console=ttyS0 panic=-1")},
+		{name: ".osrel", data: []byte("ID=ubuntu\nVERSION_ID=\"22.04\"\n")},
+		{name: ".uname", data: []byte("5.15.0-1-generic")},
+		{name: ".linux", data: []byte("mock kernel image")},
+		{name: ".initrd", data: []byte("mock initrd")},
+	})
+	writeMockUKI(t, filepath.Join(dir, "uki2.efi"), []mockUKISection{
+		{name: ".osrel", data: []byte("ID=ubuntu\nVERSION_ID=\"22.04\"\n")},
+		{name: ".linux", data: []byte("mock kernel image")},
+		{name: ".initrd", data: []byte("mock initrd")},
+	})
+
+	for _, data := range []struct {
+		desc   string
+		params SystemdUKIProfileParams
+		pcrs   []int
+		values []tpm2.PCRValues
+	}{
+		{
+			desc: "WithCmdlineSection",
+			params: SystemdUKIProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+				Images:       []EFIImage{FileEFIImage(filepath.Join(dir, "uki1.efi"))},
+			},
+			pcrs: []int{11},
+			values: []tpm2.PCRValues{
+				{
+					tpm2.HashAlgorithmSHA256: {
+						11: decodeHexStringT(t, "28ded237b0da1d423fe4f172651d7a710569eb44fd39aab3c3cf5c66a5f7cf22"),
+					},
+				},
+			},
+		},
+		{
+			desc: "WithoutCmdlineSection",
+			params: SystemdUKIProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+				Images:       []EFIImage{FileEFIImage(filepath.Join(dir, "uki2.efi"))},
+				KernelCmdlines: []string{
+					"console=ttyS0 console=tty1 panic=-1 systemd.gpt_auto=0 snapd_recovery_mode=run",
+					"console=ttyS0 console=tty1 panic=-1 systemd.gpt_auto=0 snapd_recovery_mode=recover",
+				},
+			},
+			pcrs: []int{11, 12},
+			values: []tpm2.PCRValues{
+				{
+					tpm2.HashAlgorithmSHA256: {
+						11: decodeHexStringT(t, "afbdd22a4ecd44384a7594ca7cf8aff7ad50b97ff11beee1cf4f5d76b8ae1c08"),
+						12: decodeHexStringT(t, "fc433eaf039c6261f496a2a5bf2addfd8ff1104b0fc98af3fe951517e3bde824"),
+					},
+				},
+				{
+					tpm2.HashAlgorithmSHA256: {
+						11: decodeHexStringT(t, "afbdd22a4ecd44384a7594ca7cf8aff7ad50b97ff11beee1cf4f5d76b8ae1c08"),
+						12: decodeHexStringT(t, "b3a29076eeeae197ae721c254da40480b76673038045305cfa78ec87421c4eea"),
+					},
+				},
+			},
+		},
+		{
+			desc: "Mixed",
+			params: SystemdUKIProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+				Images: []EFIImage{
+					FileEFIImage(filepath.Join(dir, "uki1.efi")),
+					FileEFIImage(filepath.Join(dir, "uki2.efi")),
+				},
+				KernelCmdlines: []string{
+					"console=ttyS0 console=tty1 panic=-1 systemd.gpt_auto=0 snapd_recovery_mode=run",
+				},
+			},
+			pcrs: []int{11, 12},
+			values: []tpm2.PCRValues{
+				{
+					tpm2.HashAlgorithmSHA256: {
+						11: decodeHexStringT(t, "28ded237b0da1d423fe4f172651d7a710569eb44fd39aab3c3cf5c66a5f7cf22"),
+						12: make(tpm2.Digest, 32),
+					},
+				},
+				{
+					tpm2.HashAlgorithmSHA256: {
+						11: decodeHexStringT(t, "afbdd22a4ecd44384a7594ca7cf8aff7ad50b97ff11beee1cf4f5d76b8ae1c08"),
+						12: decodeHexStringT(t, "fc433eaf039c6261f496a2a5bf2addfd8ff1104b0fc98af3fe951517e3bde824"),
+					},
+				},
+			},
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			expectedPcrs := tpm2.PCRSelectionList{{Hash: data.params.PCRAlgorithm, Select: data.pcrs}}
+			var expectedDigests tpm2.DigestList
+			for _, v := range data.values {
+				d, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, expectedPcrs, v)
+				expectedDigests = append(expectedDigests, d)
+			}
+
+			profile := NewPCRProtectionProfile()
+			if err := AddSystemdUKIProfile(profile, &data.params); err != nil {
+				t.Fatalf("AddSystemdUKIProfile failed: %v", err)
+			}
+			pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+			if err != nil {
+				t.Fatalf("ComputePCRDigests failed: %v", err)
+			}
+			if !pcrs.Equal(expectedPcrs) {
+				t.Errorf("ComputePCRDigests returned the wrong PCR selection")
+			}
+			if !reflect.DeepEqual(digests, expectedDigests) {
+				t.Errorf("ComputePCRDigests returned unexpected values")
+				t.Logf("Profile:\n%s", profile)
+				t.Logf("Values:\n%s", profile.DumpValues(nil))
+			}
+		})
+	}
+}
+
+func TestAddSystemdUKIProfileNotUKI(t *testing.T) {
+	err := AddSystemdUKIProfile(NewPCRProtectionProfile(), &SystemdUKIProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		Images:       []EFIImage{FileEFIImage("testdata/mockkernel1.efi")}})
+	if err == nil {
+		t.Fatalf("Expected AddSystemdUKIProfile to fail")
+	}
+	if err.Error() != "cannot compute measurements for testdata/mockkernel1.efi: image is not a unified kernel image: no .linux section" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestAddSystemdEFIStubProfileWithCredentialsAndSysexts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secboot-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"b.cred":      "cred-b",
+		"a.cred":      "cred-a",
+		"global.cred": "cred-global",
+		"ext.raw":     "mock sysext",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	writeMockUKI(t, filepath.Join(dir, "uki.efi"), []mockUKISection{
+		{name: ".cmdline", data: []byte("console=ttyS0 panic=-1")},
+		{name: ".osrel", data: []byte("ID=ubuntu\nVERSION_ID=\"22.04\"\n")},
+		{name: ".uname", data: []byte("5.15.0-1-generic")},
+		{name: ".linux", data: []byte("mock kernel image")},
+		{name: ".initrd", data: []byte("mock initrd")},
+	})
+
+	credentials := []string{filepath.Join(dir, "b.cred"), filepath.Join(dir, "a.cred")}
+	globalCredentials := []string{filepath.Join(dir, "global.cred")}
+	sysexts := []string{filepath.Join(dir, "ext.raw")}
+
+	for _, data := range []struct {
+		desc   string
+		add    func(profile *PCRProtectionProfile) error
+		pcrs   []int
+		values tpm2.PCRValues
+	}{
+		{
+			desc: "Stub",
+			add: func(profile *PCRProtectionProfile) error {
+				return AddSystemdEFIStubProfile(profile, &SystemdEFIStubProfileParams{
+					PCRAlgorithm:      tpm2.HashAlgorithmSHA256,
+					PCRIndex:          12,
+					KernelCmdlines:    []string{"console=ttyS0 console=tty1 panic=-1 systemd.gpt_auto=0 snapd_recovery_mode=run"},
+					Credentials:       credentials,
+					GlobalCredentials: globalCredentials,
+					SystemExtensions:  sysexts})
+			},
+			pcrs: []int{12, 13},
+			values: tpm2.PCRValues{
+				tpm2.HashAlgorithmSHA256: {
+					12: decodeHexStringT(t, "1e6fb3b7c76ff2ddb7c796201e9a6f9d8ca90d8620c4c3c1e6c3c79dfd6b1eb1"),
+					13: decodeHexStringT(t, "b9b84310b3b0f25b60fb8a79a9ed9d5325e394e979c6732562dcc4ba573685c0"),
+				},
+			},
+		},
+		{
+			desc: "UKI",
+			add: func(profile *PCRProtectionProfile) error {
+				return AddSystemdUKIProfile(profile, &SystemdUKIProfileParams{
+					PCRAlgorithm:      tpm2.HashAlgorithmSHA256,
+					Images:            []EFIImage{FileEFIImage(filepath.Join(dir, "uki.efi"))},
+					Credentials:       credentials,
+					GlobalCredentials: globalCredentials,
+					SystemExtensions:  sysexts})
+			},
+			pcrs: []int{11, 12, 13},
+			values: tpm2.PCRValues{
+				tpm2.HashAlgorithmSHA256: {
+					11: decodeHexStringT(t, "28ded237b0da1d423fe4f172651d7a710569eb44fd39aab3c3cf5c66a5f7cf22"),
+					12: decodeHexStringT(t, "76824b6fab509b964a720eafed8da49e389a728a37939802e81dbbfdbb76bd07"),
+					13: decodeHexStringT(t, "b9b84310b3b0f25b60fb8a79a9ed9d5325e394e979c6732562dcc4ba573685c0"),
+				},
+			},
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			expectedPcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: data.pcrs}}
+			expectedDigest, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, expectedPcrs, data.values)
+
+			profile := NewPCRProtectionProfile()
+			if err := data.add(profile); err != nil {
+				t.Fatalf("Adding profile failed: %v", err)
+			}
+			pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+			if err != nil {
+				t.Fatalf("ComputePCRDigests failed: %v", err)
+			}
+			if !pcrs.Equal(expectedPcrs) {
+				t.Errorf("ComputePCRDigests returned the wrong PCR selection")
+			}
+			if !reflect.DeepEqual(digests, tpm2.DigestList{expectedDigest}) {
+				t.Errorf("ComputePCRDigests returned unexpected values")
+				t.Logf("Profile:\n%s", profile)
+				t.Logf("Values:\n%s", profile.DumpValues(nil))
+			}
+		})
+	}
+}
@@ -21,11 +21,13 @@ package secboot
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/canonical/go-tpm2"
@@ -34,17 +36,63 @@ import (
 	"golang.org/x/xerrors"
 )
 
-func makeSealedKeyTemplate() *tpm2.Public {
+// PolicySigningKeyType corresponds to the type of key that SealKeyToTPM creates for signing dynamic authorization policies.
+type PolicySigningKeyType int
+
+const (
+	// PolicySigningKeyRSA2048 corresponds to a RSA-2048 key, with RSASSA-PSS signatures computed using SHA-256.
+	PolicySigningKeyRSA2048 PolicySigningKeyType = iota
+
+	// PolicySigningKeyECCP256 corresponds to a ECC key on the NIST P-256 curve, with ECDSA signatures computed using SHA-256.
+	PolicySigningKeyECCP256
+
+	// PolicySigningKeyECCP384 corresponds to a ECC key on the NIST P-384 curve, with ECDSA signatures computed using SHA-384.
+	PolicySigningKeyECCP384
+)
+
+// createPolicySigningKey creates a new asymmetric key of the specified type for signing dynamic authorization policies, and returns
+// the private key along with a public area that is suitable for loading in to the TPM.
+func createPolicySigningKey(keyType PolicySigningKeyType) (crypto.PrivateKey, *tpm2.Public, error) {
+	switch keyType {
+	case PolicySigningKeyRSA2048:
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, createPublicAreaForRSASigningKey(&key.PublicKey), nil
+	case PolicySigningKeyECCP256:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, createPublicAreaForECDSASigningKey(&key.PublicKey, tpm2.ECCCurveNIST_P256, tpm2.HashAlgorithmSHA256), nil
+	case PolicySigningKeyECCP384:
+		key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, createPublicAreaForECDSASigningKey(&key.PublicKey, tpm2.ECCCurveNIST_P384, tpm2.HashAlgorithmSHA384), nil
+	default:
+		return nil, nil, fmt.Errorf("invalid key type (%d)", keyType)
+	}
+}
+
+func makeSealedKeyTemplate(nameAlg tpm2.HashAlgorithmId) *tpm2.Public {
 	return &tpm2.Public{
 		Type:    tpm2.ObjectTypeKeyedHash,
-		NameAlg: tpm2.HashAlgorithmSHA256,
+		NameAlg: nameAlg,
 		Attrs:   tpm2.AttrFixedTPM | tpm2.AttrFixedParent,
 		Params:  tpm2.PublicParamsU{Data: &tpm2.KeyedHashParams{Scheme: tpm2.KeyedHashScheme{Scheme: tpm2.KeyedHashSchemeNull}}}}
 }
 
-func computeSealedKeyDynamicAuthPolicy(tpm *tpm2.TPMContext, version uint32, alg, signAlg tpm2.HashAlgorithmId, authKey *rsa.PrivateKey,
+func computeSealedKeyDynamicAuthPolicy(tpm *tpm2.TPMContext, version uint32, alg, signAlg tpm2.HashAlgorithmId, authKey crypto.PrivateKey,
 	countIndexPub *tpm2.NVPublic, countIndexAuthPolicies tpm2.DigestList, pcrProfile *PCRProtectionProfile,
-	session tpm2.SessionContext) (*dynamicPolicyData, error) {
+	limits *PCRProtectionProfileLimits, session tpm2.SessionContext) (*dynamicPolicyData, error) {
+	// Reject profiles that produce too many combinations before computing any PCR values
+	if err := limits.checkCombinations(pcrProfile); err != nil {
+		return nil, err
+	}
+
 	// Obtain the count for the new dynamic authorization policy
 	nextPolicyCount, err := readDynamicPolicyCounter(tpm, countIndexPub, countIndexAuthPolicies, session)
 	if err != nil {
@@ -91,6 +139,10 @@ func computeSealedKeyDynamicAuthPolicy(tpm *tpm2.TPMContext, version uint32, alg
 		}
 	}
 
+	if err := limits.checkDigests(len(pcrDigests)); err != nil {
+		return nil, err
+	}
+
 	// Use the PCR digests and NV index names to generate a single signed dynamic authorization policy digest
 	policyParams := dynamicPolicyComputeParams{
 		key:                  authKey,
@@ -105,6 +157,10 @@ func computeSealedKeyDynamicAuthPolicy(tpm *tpm2.TPMContext, version uint32, alg
 		return nil, xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
 	}
 
+	if err := limits.checkDynamicPolicyData(policyData); err != nil {
+		return nil, err
+	}
+
 	return policyData, nil
 }
 
@@ -117,6 +173,21 @@ type KeyCreationParams struct {
 	// and the choice of handle should take in to consideration the reserved indices from the "Registry of reserved TPM 2.0 handles and
 	// localities" specification. It is recommended that the handle is in the block reserved for owner objects (0x01800000 - 0x01bfffff).
 	PINHandle tpm2.Handle
+
+	// PCRProfileLimits defines optional limits on the complexity of the PCR policy generated from PCRProfile. If this is nil,
+	// no limits are enforced. See PCRProtectionProfile.Analyze for a way to determine the complexity of a profile in advance.
+	PCRProfileLimits *PCRProtectionProfileLimits
+
+	// NameAlgorithm is the digest algorithm used to compute the name and authorization policy of the sealed key object, and the
+	// PCR digests in its PCR protection policy. If this is tpm2.HashAlgorithmNull, SHA-256 is used.
+	NameAlgorithm tpm2.HashAlgorithmId
+
+	// SessionAlgorithm is the digest algorithm for the HMAC sessions used for parameter encryption when the key is sealed and
+	// unsealed. If this is tpm2.HashAlgorithmNull, the session returned from TPMConnection.HmacSession is used, which uses SHA-256.
+	SessionAlgorithm tpm2.HashAlgorithmId
+
+	// PolicySigningKeyType is the type of key created for signing dynamic authorization policies. The default is a RSA-2048 key.
+	PolicySigningKeyType PolicySigningKeyType
 }
 
 // SealKeyToTPM seals the supplied disk encryption key to the storage hierarchy of the TPM. The sealed key object and associated
@@ -145,13 +216,141 @@ type KeyCreationParams struct {
 // that the handle is in the block reserved for owner objects (0x01800000 - 0x01bfffff).
 //
 // The key will be protected with a PCR policy computed from the PCRProtectionProfile supplied via the PCRProfile field of the params
-// argument.
+// argument. If the PCRProfileLimits field of the params argument is set and the computed PCR policy exceeds any of the limits, a
+// PCRProtectionProfileLimitError error will be returned.
+//
+// The name algorithm of the sealed key object, the digest algorithm of the HMAC sessions used to protect the key and the type of
+// key used for signing dynamic authorization policies can be customized via the NameAlgorithm, SessionAlgorithm and
+// PolicySigningKeyType fields of the params argument. These choices are recorded in the key data file.
 func SealKeyToTPM(tpm *TPMConnection, key []byte, keyPath, policyUpdatePath string, params *KeyCreationParams) error {
+	return sealToTPM(tpm, key, nil, sealDestinationFiles(keyPath, policyUpdatePath), params)
+}
+
+// SealKeyToTPMWithWriters behaves like SealKeyToTPM, but writes the key data to keyWriter and the policy update data to
+// policyUpdateWriter instead of to files, which makes it possible to store them somewhere other than the filesystem. If
+// policyUpdateWriter is nil, no policy update data is written.
+//
+// The data is written to the supplied writers before the dynamic authorization policy counter is incremented, so the caller should
+// discard anything written to them if this function returns an error.
+func SealKeyToTPMWithWriters(tpm *TPMConnection, key []byte, keyWriter, policyUpdateWriter io.Writer, params *KeyCreationParams) error {
+	return sealToTPM(tpm, key, nil, sealDestinationWriters(keyWriter, policyUpdateWriter), params)
+}
+
+// SealPayloadToTPM seals the supplied payload to the storage hierarchy of the TPM using envelope encryption. Rather than sealing
+// the payload directly, which limits its size to that supported by the TPM for sealed data objects, a randomly generated AES-256
+// wrapping key is sealed to the TPM and the payload is encrypted and authenticated with this key using AES-256-GCM. The encrypted
+// payload is stored in the key data file written to keyPath. This makes it possible to protect several disk encryption keys, a
+// recovery key escrow blob or other auxiliary secrets with a single authorization policy. The encoding of multiple secrets in to
+// the payload is the responsibility of the caller.
+//
+// The payload can be up to 16MiB in size. When the resulting sealed key object is unsealed with SealedKeyObject.UnsealFromTPM, the
+// decrypted payload is returned instead of the wrapping key. The resulting sealed key object cannot be used with
+// ActivateVolumeWithTPMSealedKey or ActivateVolumeWithMultipleTPMSealedKeys - the caller is responsible for extracting any disk
+// encryption keys from the payload and activating volumes with them.
+//
+// In all other respects, this function behaves identically to SealKeyToTPM, including the handling of the policyUpdatePath and
+// params arguments and the errors that are returned.
+func SealPayloadToTPM(tpm *TPMConnection, payload []byte, keyPath, policyUpdatePath string, params *KeyCreationParams) error {
+	return sealPayloadToTPM(tpm, payload, sealDestinationFiles(keyPath, policyUpdatePath), params)
+}
+
+// SealPayloadToTPMWithWriters behaves like SealPayloadToTPM, but writes the key data to keyWriter and the policy update data to
+// policyUpdateWriter instead of to files. If policyUpdateWriter is nil, no policy update data is written. The caller should discard
+// anything written to the supplied writers if this function returns an error.
+func SealPayloadToTPMWithWriters(tpm *TPMConnection, payload []byte, keyWriter, policyUpdateWriter io.Writer, params *KeyCreationParams) error {
+	return sealPayloadToTPM(tpm, payload, sealDestinationWriters(keyWriter, policyUpdateWriter), params)
+}
+
+func sealPayloadToTPM(tpm *TPMConnection, payload []byte, dest sealDestination, params *KeyCreationParams) error {
+	if len(payload) > maxEnvelopePayloadSize {
+		return errors.New("payload is too large")
+	}
+
+	wrappingKey := make([]byte, envelopeKeySize)
+	if _, err := rand.Read(wrappingKey); err != nil {
+		return xerrors.Errorf("cannot obtain wrapping key: %w", err)
+	}
+
+	encryptedPayload, err := encryptEnvelopePayload(wrappingKey, payload)
+	if err != nil {
+		return xerrors.Errorf("cannot encrypt payload: %w", err)
+	}
+
+	return sealToTPM(tpm, wrappingKey, encryptedPayload, dest, params)
+}
+
+// sealDestination opens the destinations for the key data and policy update data written by sealToTPM. It is called once the
+// supplied parameters and the TPM provisioning have been validated, and returns a function that must be called to release the
+// destinations, indicating whether sealing succeeded. The policy update writer is nil if no policy update data should be written.
+type sealDestination func() (keyWriter, policyUpdateWriter io.Writer, release func(succeeded bool), err error)
+
+// sealDestinationFiles returns a sealDestination that creates a key data file at keyPath and a policy update data file at
+// policyUpdatePath. If policyUpdatePath is empty, no policy update data file is created. Both files are removed if sealing fails.
+func sealDestinationFiles(keyPath, policyUpdatePath string) sealDestination {
+	return func() (io.Writer, io.Writer, func(bool), error) {
+		keyFile, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, nil, nil, xerrors.Errorf("cannot create key data file: %w", err)
+		}
+		releaseKeyFile := func(succeeded bool) {
+			keyFile.Close()
+			if succeeded {
+				return
+			}
+			os.Remove(keyPath)
+		}
+
+		if policyUpdatePath == "" {
+			return keyFile, nil, releaseKeyFile, nil
+		}
+
+		policyUpdateFile, err := os.OpenFile(policyUpdatePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			releaseKeyFile(false)
+			return nil, nil, nil, xerrors.Errorf("cannot create private data file: %w", err)
+		}
+
+		return keyFile, policyUpdateFile, func(succeeded bool) {
+			policyUpdateFile.Close()
+			if !succeeded {
+				os.Remove(policyUpdatePath)
+			}
+			releaseKeyFile(succeeded)
+		}, nil
+	}
+}
+
+// sealDestinationWriters returns a sealDestination that uses the supplied writers.
+func sealDestinationWriters(keyWriter, policyUpdateWriter io.Writer) sealDestination {
+	return func() (io.Writer, io.Writer, func(bool), error) {
+		return keyWriter, policyUpdateWriter, func(bool) {}, nil
+	}
+}
+
+// sealToTPM seals the supplied key to the storage hierarchy of the TPM and writes the key data and policy update data to the
+// destinations opened by dest. If encryptedPayload is supplied, the key is the wrapping key for it and it is stored in the key
+// data.
+func sealToTPM(tpm *TPMConnection, key, encryptedPayload []byte, dest sealDestination, params *KeyCreationParams) error {
 	// params is mandatory.
 	if params == nil {
 		return errors.New("no KeyCreationParams provided")
 	}
 
+	nameAlg := params.NameAlgorithm
+	if nameAlg == tpm2.HashAlgorithmNull {
+		nameAlg = defaultSealedKeyNameAlgorithm
+	}
+	if !nameAlg.Supported() {
+		return errors.New("unsupported name algorithm")
+	}
+	sessionAlg := params.SessionAlgorithm
+	if sessionAlg == tpm2.HashAlgorithmNull {
+		sessionAlg = defaultSessionHashAlgorithm
+	}
+	if !sessionAlg.Supported() {
+		return errors.New("unsupported session algorithm")
+	}
+
 	// Use the HMAC session created when the connection was opened rather than creating a new one.
 	session := tpm.HmacSession()
 
@@ -191,41 +390,18 @@ func SealKeyToTPM(tpm *TPMConnection, key []byte, keyPath, policyUpdatePath stri
 
 	succeeded := false
 
-	// Create destination files
-	keyFile, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	// Create destinations
+	keyWriter, policyUpdateWriter, release, err := dest()
 	if err != nil {
-		return xerrors.Errorf("cannot create key data file: %w", err)
-	}
-	defer func() {
-		keyFile.Close()
-		if succeeded {
-			return
-		}
-		os.Remove(keyPath)
-	}()
-
-	var policyUpdateFile *os.File
-	if policyUpdatePath != "" {
-		var err error
-		policyUpdateFile, err = os.OpenFile(policyUpdatePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-		if err != nil {
-			return xerrors.Errorf("cannot create private data file: %w", err)
-		}
-		defer func() {
-			policyUpdateFile.Close()
-			if succeeded {
-				return
-			}
-			os.Remove(policyUpdatePath)
-		}()
+		return err
 	}
+	defer func() { release(succeeded) }()
 
 	// Create an asymmetric key for signing authorization policy updates, and authorizing dynamic authorization policy revocations.
-	authKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	authKey, authPublicKey, err := createPolicySigningKey(params.PolicySigningKeyType)
 	if err != nil {
-		return xerrors.Errorf("cannot generate RSA key pair for signing dynamic authorization policies: %w", err)
+		return xerrors.Errorf("cannot generate key pair for signing dynamic authorization policies: %w", err)
 	}
-	authPublicKey := createPublicAreaForRSASigningKey(&authKey.PublicKey)
 	authKeyName, err := authPublicKey.Name()
 	if err != nil {
 		return xerrors.Errorf("cannot compute name of signing key for dynamic policy authorization: %w", err)
@@ -252,7 +428,7 @@ func SealKeyToTPM(tpm *TPMConnection, key []byte, keyPath, policyUpdatePath stri
 		tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
 	}()
 
-	template := makeSealedKeyTemplate()
+	template := makeSealedKeyTemplate(nameAlg)
 
 	// Compute the static policy - this never changes for the lifetime of this key file
 	staticPolicyData, authPolicy, err := computeStaticPolicy(template.NameAlg, &staticPolicyComputeParams{
@@ -269,18 +445,28 @@ func SealKeyToTPM(tpm *TPMConnection, key []byte, keyPath, policyUpdatePath stri
 	sensitive := tpm2.SensitiveCreate{Data: key}
 
 	// Have the digest of the private data recorded in the creation data for the sealed data object.
-	authKeyBytes := x509.MarshalPKCS1PrivateKey(authKey)
+	authKeyBytes, err := marshalPolicyUpdateAuthKey(currentMetadataVersion, authKey)
+	if err != nil {
+		return xerrors.Errorf("cannot marshal dynamic authorization policy signing key: %w", err)
+	}
 	h := crypto.SHA256.New()
 	if _, err := tpm2.MarshalToWriter(h, authKeyBytes); err != nil {
 		panic(fmt.Sprintf("cannot marshal dynamic authorization policy update data: %v", err))
 	}
 	creationInfo := h.Sum(nil)
 
+	// Obtain a session with the requested digest algorithm for protecting the key.
+	keySession, flushKeySession, err := tpm.hmacSessionWithAlg(sessionAlg)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain HMAC session: %w", err)
+	}
+	defer flushKeySession()
+
 	// Now create the sealed key object. The command is integrity protected so if the object at the handle we expect the SRK to reside
 	// at has a different name (ie, if we're connected via a resource manager and somebody swapped the object with another one), this
 	// command will fail. We take advantage of parameter encryption here too.
 	priv, pub, creationData, _, creationTicket, err :=
-		tpm.Create(srk, &sensitive, template, creationInfo, nil, session.IncludeAttrs(tpm2.AttrCommandEncrypt))
+		tpm.Create(srk, &sensitive, template, creationInfo, nil, keySession.IncludeAttrs(tpm2.AttrCommandEncrypt))
 	if err != nil {
 		return xerrors.Errorf("cannot create sealed data object for key: %w", err)
 	}
@@ -291,8 +477,12 @@ func SealKeyToTPM(tpm *TPMConnection, key []byte, keyPath, policyUpdatePath stri
 		pcrProfile = &PCRProtectionProfile{}
 	}
 	dynamicPolicyData, err := computeSealedKeyDynamicAuthPolicy(tpm.TPMContext, currentMetadataVersion, template.NameAlg,
-		authPublicKey.NameAlg, authKey, pinIndexPub, pinIndexAuthPolicies, pcrProfile, session)
-	if err != nil {
+		authPublicKey.NameAlg, authKey, pinIndexPub, pinIndexAuthPolicies, pcrProfile, params.PCRProfileLimits, session)
+	var limitErr PCRProtectionProfileLimitError
+	switch {
+	case xerrors.As(err, &limitErr):
+		return limitErr
+	case err != nil:
 		return xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
 	}
 
@@ -302,14 +492,16 @@ func SealKeyToTPM(tpm *TPMConnection, key []byte, keyPath, policyUpdatePath stri
 		keyPrivate:        priv,
 		keyPublic:         pub,
 		authModeHint:      AuthModeNone,
+		sessionAlg:        sessionAlg,
 		staticPolicyData:  staticPolicyData,
-		dynamicPolicyData: dynamicPolicyData}
+		dynamicPolicyData: dynamicPolicyData,
+		encryptedPayload:  encryptedPayload}
 
-	if err := data.write(keyFile); err != nil {
+	if err := data.write(keyWriter); err != nil {
 		return xerrors.Errorf("cannot write key data file: %w", err)
 	}
 
-	if policyUpdateFile != nil {
+	if policyUpdateWriter != nil {
 		policyUpdateData := keyPolicyUpdateData{
 			version:        currentMetadataVersion,
 			authKey:        authKey,
@@ -318,7 +510,7 @@ func SealKeyToTPM(tpm *TPMConnection, key []byte, keyPath, policyUpdatePath stri
 			creationTicket: creationTicket}
 
 		// Marshal the private data to disk
-		if err := policyUpdateData.write(policyUpdateFile); err != nil {
+		if err := policyUpdateData.write(policyUpdateWriter); err != nil {
 			return xerrors.Errorf("cannot write dynamic authorization policy update data file: %w", err)
 		}
 	}
@@ -342,9 +534,14 @@ func SealKeyToTPM(tpm *TPMConnection, key []byte, keyPath, policyUpdatePath stri
 // On success, the sealed key data file is updated atomically with an updated authorization policy that includes a PCR policy
 // computed from the supplied PCRProtectionProfile.
 func UpdateKeyPCRProtectionPolicy(tpm *TPMConnection, keyPath, policyUpdatePath string, pcrProfile *PCRProtectionProfile) error {
-	// Use the HMAC session created when the connection was opened rather than creating a new one.
-	session := tpm.HmacSession()
+	return UpdateKeyPCRProtectionPolicyWithLimits(tpm, keyPath, policyUpdatePath, pcrProfile, nil)
+}
 
+// UpdateKeyPCRProtectionPolicyWithLimits behaves like UpdateKeyPCRProtectionPolicy, but also enforces the supplied limits on the
+// complexity of the PCR policy computed from pcrProfile. If limits is nil, no limits are enforced. If the computed PCR policy
+// exceeds any of the limits, a PCRProtectionProfileLimitError error will be returned and the key data file is not modified.
+func UpdateKeyPCRProtectionPolicyWithLimits(tpm *TPMConnection, keyPath, policyUpdatePath string, pcrProfile *PCRProtectionProfile,
+	limits *PCRProtectionProfileLimits) error {
 	// Open the key data file
 	keyFile, err := os.Open(keyPath)
 	if err != nil {
@@ -359,7 +556,34 @@ func UpdateKeyPCRProtectionPolicy(tpm *TPMConnection, keyPath, policyUpdatePath
 	}
 	defer policyUpdateFile.Close()
 
-	data, policyUpdateData, pinIndexPublic, err := decodeAndValidateKeyData(tpm.TPMContext, keyFile, policyUpdateFile, session)
+	return updateKeyPCRProtectionPolicy(tpm, keyFile, policyUpdateFile, pcrProfile, limits, func(data *keyData) error {
+		// Atomically update the key data file
+		return data.writeToFileAtomic(keyPath)
+	})
+}
+
+// UpdateKeyPCRProtectionPolicyFromReader behaves like UpdateKeyPCRProtectionPolicyWithLimits, but reads the key data from keyReader
+// and the policy update data from policyUpdateReader, and writes the updated key data to keyWriter instead of updating a file. If
+// limits is nil, no limits are enforced.
+//
+// The updated key data is written to keyWriter before the dynamic authorization policies associated with the previous key data are
+// revoked. If an error is returned after data has been written to keyWriter, the caller should persist the updated key data, as
+// the previous key data may no longer be usable.
+func UpdateKeyPCRProtectionPolicyFromReader(tpm *TPMConnection, keyReader io.Reader, keyWriter io.Writer, policyUpdateReader io.Reader,
+	pcrProfile *PCRProtectionProfile, limits *PCRProtectionProfileLimits) error {
+	return updateKeyPCRProtectionPolicy(tpm, keyReader, policyUpdateReader, pcrProfile, limits, func(data *keyData) error {
+		return data.write(keyWriter)
+	})
+}
+
+// updateKeyPCRProtectionPolicy computes a new dynamic authorization policy for the key data read from keyReader, calls write to
+// persist the updated key data and then revokes the previous dynamic authorization policies.
+func updateKeyPCRProtectionPolicy(tpm *TPMConnection, keyReader, policyUpdateReader io.Reader, pcrProfile *PCRProtectionProfile,
+	limits *PCRProtectionProfileLimits, write func(data *keyData) error) error {
+	// Use the HMAC session created when the connection was opened rather than creating a new one.
+	session := tpm.HmacSession()
+
+	data, policyUpdateData, pinIndexPublic, err := decodeAndValidateKeyData(tpm.TPMContext, keyReader, policyUpdateReader, session)
 	if err != nil {
 		if isKeyFileError(err) {
 			return InvalidKeyFileError{err.Error()}
@@ -377,15 +601,18 @@ func UpdateKeyPCRProtectionPolicy(tpm *TPMConnection, keyPath, policyUpdatePath
 		pcrProfile = &PCRProtectionProfile{}
 	}
 	policyData, err := computeSealedKeyDynamicAuthPolicy(tpm.TPMContext, data.version, data.keyPublic.NameAlg, authPublicKey.NameAlg,
-		authKey, pinIndexPublic, pinIndexAuthPolicies, pcrProfile, session)
-	if err != nil {
+		authKey, pinIndexPublic, pinIndexAuthPolicies, pcrProfile, limits, session)
+	var limitErr PCRProtectionProfileLimitError
+	switch {
+	case xerrors.As(err, &limitErr):
+		return limitErr
+	case err != nil:
 		return xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
 	}
 
-	// Atomically update the key data file
 	data.dynamicPolicyData = policyData
 
-	if err := data.writeToFileAtomic(keyPath); err != nil {
+	if err := write(data); err != nil {
 		return xerrors.Errorf("cannot write key data file: %v", err)
 	}
 
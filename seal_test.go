@@ -30,6 +30,7 @@ import (
 	"github.com/canonical/go-tpm2"
 	. "github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
 
 	"golang.org/x/xerrors"
 )
@@ -122,6 +123,91 @@ func TestSealKeyToTPM(t *testing.T) {
 		defer closeTPM(t, tpm)
 		run(t, tpm, false, &KeyCreationParams{PINHandle: 0x01810000})
 	})
+
+	t.Run("ECCP256PolicySigningKey", func(t *testing.T) {
+		tpm := openTPMForTesting(t)
+		defer closeTPM(t, tpm)
+		run(t, tpm, true, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000, PolicySigningKeyType: PolicySigningKeyECCP256})
+	})
+
+	t.Run("ECCP384PolicySigningKey", func(t *testing.T) {
+		tpm := openTPMForTesting(t)
+		defer closeTPM(t, tpm)
+		run(t, tpm, true, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000, PolicySigningKeyType: PolicySigningKeyECCP384})
+	})
+
+	t.Run("SHA384NameAlgorithm", func(t *testing.T) {
+		tpm := openTPMForTesting(t)
+		defer closeTPM(t, tpm)
+		run(t, tpm, true, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000, NameAlgorithm: tpm2.HashAlgorithmSHA384})
+	})
+
+	t.Run("SHA1SessionAlgorithm", func(t *testing.T) {
+		tpm := openTPMForTesting(t)
+		defer closeTPM(t, tpm)
+		run(t, tpm, true, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000, SessionAlgorithm: tpm2.HashAlgorithmSHA1})
+	})
+}
+
+func TestSealKeyToTPMWithWriters(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	var keyData, policyUpdateData bytes.Buffer
+	if err := SealKeyToTPMWithWriters(tpm, key, &keyData, &policyUpdateData, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPMWithWriters failed: %v", err)
+	}
+	defer func() {
+		rc, err := tpm.CreateResourceContextFromTPM(0x01810000)
+		if err != nil {
+			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+		}
+		undefineNVSpace(t, tpm, rc, tpm.OwnerHandleContext())
+	}()
+
+	var updatedKeyData bytes.Buffer
+	if err := UpdateKeyPCRProtectionPolicyFromReader(tpm, bytes.NewReader(keyData.Bytes()), &updatedKeyData,
+		bytes.NewReader(policyUpdateData.Bytes()), getTestPCRProfile(), nil); err != nil {
+		t.Fatalf("UpdateKeyPCRProtectionPolicyFromReader failed: %v", err)
+	}
+
+	// The original key data should have been revoked.
+	k, err := ReadSealedKeyObjectFromReader(bytes.NewReader(keyData.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObjectFromReader failed: %v", err)
+	}
+	if _, err := k.UnsealFromTPM(tpm, ""); err == nil {
+		t.Errorf("UnsealFromTPM should have failed with the revoked key data")
+	}
+
+	testPIN := "1234"
+	var pinKeyData bytes.Buffer
+	if err := ChangePINFromReader(tpm, bytes.NewReader(updatedKeyData.Bytes()), &pinKeyData, "", testPIN); err != nil {
+		t.Fatalf("ChangePINFromReader failed: %v", err)
+	}
+
+	k, err = ReadSealedKeyObjectFromReader(&pinKeyData)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObjectFromReader failed: %v", err)
+	}
+	if k.AuthMode2F() != AuthModePIN {
+		t.Errorf("Unexpected AuthMode2F: %v", k.AuthMode2F())
+	}
+
+	keyUnsealed, err := k.UnsealFromTPM(tpm, testPIN)
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
 }
 
 func TestSealKeyToTPMErrorHandling(t *testing.T) {
@@ -280,6 +366,26 @@ func TestSealKeyToTPMErrorHandling(t *testing.T) {
 		}
 	})
 
+	t.Run("FileExistsNilParams", func(t *testing.T) {
+		// Make sure that an existing key data file doesn't hide errors caused by invalid parameters.
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMErrors_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		f, err := os.OpenFile(tmpDir+"/keydata", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			t.Fatalf("OpenFile failed: %v", err)
+		}
+		defer f.Close()
+		err = run(t, tmpDir, nil)
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		if err.Error() != "no KeyCreationParams provided" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
 	t.Run("PinNVIndexExists", func(t *testing.T) {
 		public := tpm2.NVPublic{
 			Index:   0x0181ffff,
@@ -323,4 +429,22 @@ func TestSealKeyToTPMErrorHandling(t *testing.T) {
 			t.Errorf("Unexpected error: %v", err)
 		}
 	})
+	t.Run("PCRProfileLimits", func(t *testing.T) {
+		pcrProfile := NewPCRProtectionProfile().
+			AddProfileOR(
+				NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")),
+				NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "bar")))
+		err := run(t, "", &KeyCreationParams{PCRProfile: pcrProfile, PINHandle: 0x01810000,
+			PCRProfileLimits: &PCRProtectionProfileLimits{MaxDigests: 1}})
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		e, ok := err.(PCRProtectionProfileLimitError)
+		if !ok {
+			t.Fatalf("Unexpected error type: %v", err)
+		}
+		if e.Limit != "MaxDigests" || e.Value != 2 || e.Max != 1 {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
 }
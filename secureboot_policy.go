@@ -20,8 +20,10 @@
 package secboot
 
 import (
-	"bufio"
 	"bytes"
+	"crypto"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/binary"
@@ -30,15 +32,11 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/chrisccoulson/tcglog-parser"
-	"github.com/snapcore/secboot/internal/efi"
 	"github.com/snapcore/secboot/internal/pe1.14"
-	"github.com/snapcore/snapd/osutil"
 
 	"golang.org/x/xerrors"
 
@@ -46,27 +44,23 @@ import (
 )
 
 const (
+	pkName      = "PK"         // Unicode variable name for the EFI platform key
 	kekName     = "KEK"        // Unicode variable name for the EFI KEK database
 	dbName      = "db"         // Unicode variable name for the EFI authorized signature database
 	dbxName     = "dbx"        // Unicode variable name for the EFI forbidden signature database
 	sbStateName = "SecureBoot" // Unicode variable name for the EFI secure boot configuration (enabled/disabled)
 
 	mokListName    = "MokList"    // Unicode variable name for the shim MOK database
+	mokListRTName  = "MokListRT"  // Unicode variable name for the runtime copy of the shim MOK database
+	mokNewName     = "MokNew"     // Unicode variable name for pending enrolments to the shim MOK database
 	mokSbStateName = "MokSBState" // Unicode variable name for the shim secure boot configuration (validation enabled/disabled)
 	shimName       = "Shim"       // Unicode variable name used for recording events when shim's vendor certificate is used for verification
 
-	kekFilename     = "KEK-8be4df61-93ca-11d2-aa0d-00e098032b8c"       // Filename in efivarfs for accessing the KEK database
-	dbFilename      = "db-d719b2cb-3d3a-4596-a3bc-dad00e67656f"        // Filename in efivarfs for accessing the EFI authorized signature database
-	dbxFilename     = "dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f"       // Filename in efivarfs for accessing the EFI forbidden signature database
-	mokListFilename = "MokListRT-605dab50-e046-4300-abb6-3dd810dd8b23" // Filename in efivarfs for accessing a runtime copy of the shim MOK database
-
 	uefiDriverPCR = 2 // UEFI Drivers and UEFI Applications PCR
 	secureBootPCR = 7 // Secure Boot Policy Measurements PCR
 
 	returningFromEfiApplicationEvent = "Returning from EFI Application from Boot Option" // EV_EFI_ACTION index 2: "Attempt to execute code from Boot Option was unsuccessful"
 
-	sbKeySyncExe = "sbkeysync"
-
 	winCertTypePKCSSignedData uint16 = 0x0002 // WIN_CERT_TYPE_PKCS_SIGNED_DATA
 	winCertTypeEfiGuid        uint16 = 0x0EF1 // WIN_CERT_TYPE_EFI_GUID
 )
@@ -76,10 +70,18 @@ var (
 	efiGlobalVariableGuid        = tcglog.NewEFIGUID(0x8be4df61, 0x93ca, 0x11d2, 0xaa0d, [...]uint8{0x00, 0xe0, 0x98, 0x03, 0x2b, 0x8c}) // EFI_GLOBAL_VARIABLE
 	efiImageSecurityDatabaseGuid = tcglog.NewEFIGUID(0xd719b2cb, 0x3d3a, 0x4596, 0xa3bc, [...]uint8{0xda, 0xd0, 0x0e, 0x67, 0x65, 0x6f}) // EFI_IMAGE_SECURITY_DATABASE_GUID
 
-	efiCertX509Guid      = tcglog.NewEFIGUID(0xa5c059a1, 0x94e4, 0x4aa7, 0x87b5, [...]uint8{0xab, 0x15, 0x5c, 0x2b, 0xf0, 0x72}) // EFI_CERT_X509_GUID
-	efiCertTypePkcs7Guid = tcglog.NewEFIGUID(0x4aafd29d, 0x68df, 0x49ee, 0x8aa9, [...]uint8{0x34, 0x7d, 0x37, 0x56, 0x65, 0xa7}) // EFI_CERT_TYPE_PKCS7_GUID
+	efiCertX509Guid       = tcglog.NewEFIGUID(0xa5c059a1, 0x94e4, 0x4aa7, 0x87b5, [...]uint8{0xab, 0x15, 0x5c, 0x2b, 0xf0, 0x72}) // EFI_CERT_X509_GUID
+	efiCertSha256Guid     = tcglog.NewEFIGUID(0xc1c41626, 0x504c, 0x4092, 0xaca9, [...]uint8{0x41, 0xf9, 0x36, 0x93, 0x43, 0x28}) // EFI_CERT_SHA256_GUID
+	efiCertSha384Guid     = tcglog.NewEFIGUID(0xff3e5307, 0x9fd0, 0x48c9, 0x85f1, [...]uint8{0x8a, 0xd5, 0x6c, 0x70, 0x1e, 0x01}) // EFI_CERT_SHA384_GUID
+	efiCertSha512Guid     = tcglog.NewEFIGUID(0x093e0fae, 0xa6c4, 0x4f50, 0x9f1b, [...]uint8{0xd4, 0x1e, 0x2b, 0x89, 0xc1, 0x9a}) // EFI_CERT_SHA512_GUID
+	efiCertX509Sha256Guid = tcglog.NewEFIGUID(0x3bd2a492, 0x96c0, 0x4079, 0xb420, [...]uint8{0xfc, 0xf9, 0x8e, 0xf1, 0x03, 0xed}) // EFI_CERT_X509_SHA256_GUID
+	efiCertX509Sha384Guid = tcglog.NewEFIGUID(0x7076876e, 0x80c2, 0x4ee6, 0xaad2, [...]uint8{0x28, 0xb3, 0x49, 0xa6, 0x86, 0x5b}) // EFI_CERT_X509_SHA384_GUID
+	efiCertX509Sha512Guid = tcglog.NewEFIGUID(0x446dbf63, 0x2502, 0x4cda, 0xbcfa, [...]uint8{0x24, 0x65, 0xd2, 0xb0, 0xfe, 0x9d}) // EFI_CERT_X509_SHA512_GUID
+	efiCertTypePkcs7Guid  = tcglog.NewEFIGUID(0x4aafd29d, 0x68df, 0x49ee, 0x8aa9, [...]uint8{0x34, 0x7d, 0x37, 0x56, 0x65, 0xa7}) // EFI_CERT_TYPE_PKCS7_GUID
 
 	oidSha256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSha384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSha512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
 
 	efivarsPath = "/sys/firmware/efi/efivars" // Default mount point for efivarfs
 )
@@ -146,47 +148,50 @@ func decodeWinCertificate(r io.Reader) (cert winCertificate, length int, err err
 
 // readShimVendorCert obtains the DER encoded built-in vendor certificate from the shim executable accessed via r.
 func readShimVendorCert(r io.ReaderAt) ([]byte, error) {
+	cert, _, err := readShimVendorData(r)
+	return cert, err
+}
+
+// readShimVendorData obtains the DER encoded built-in vendor certificate and the built-in vendor forbidden signature database from
+// the shim executable accessed via r.
+func readShimVendorData(r io.ReaderAt) (cert, dbx []byte, err error) {
 	pefile, err := pe.NewFile(r)
 	if err != nil {
-		return nil, xerrors.Errorf("cannot decode PE binary: %w", err)
+		return nil, nil, xerrors.Errorf("cannot decode PE binary: %w", err)
 	}
 
 	// Shim's vendor certificate is in the .vendor_cert section.
 	section := pefile.Section(".vendor_cert")
 	if section == nil {
-		return nil, errors.New("missing .vendor_cert section")
+		return nil, nil, errors.New("missing .vendor_cert section")
 	}
 
 	// Shim's .vendor_cert section starts with a cert_table struct (see shim.c in the shim source)
-	sr := io.NewSectionReader(section, 0, 16)
-
-	// Read vendor_cert_size field
-	var certSize uint32
-	if err := binary.Read(sr, binary.LittleEndian, &certSize); err != nil {
-		return nil, xerrors.Errorf("cannot read vendor cert size: %w", err)
+	var table struct {
+		CertSize   uint32
+		DbxSize    uint32
+		CertOffset uint32
+		DbxOffset  uint32
 	}
-
-	// A size of zero is valid
-	if certSize == 0 {
-		return nil, nil
+	if err := binary.Read(io.NewSectionReader(section, 0, 16), binary.LittleEndian, &table); err != nil {
+		return nil, nil, xerrors.Errorf("cannot read vendor cert table: %w", err)
 	}
 
-	// Skip vendor_dbx_size
-	sr.Seek(4, io.SeekCurrent)
-
-	// Read vendor_cert_offset
-	var certOffset uint32
-	if err := binary.Read(sr, binary.LittleEndian, &certOffset); err != nil {
-		return nil, xerrors.Errorf("cannot read vendor cert offset: %w", err)
+	// A size of zero is valid for both the certificate and the forbidden signature database
+	if table.CertSize > 0 {
+		cert, err = ioutil.ReadAll(io.NewSectionReader(section, int64(table.CertOffset), int64(table.CertSize)))
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot read vendor cert data: %w", err)
+		}
 	}
-
-	sr = io.NewSectionReader(section, int64(certOffset), int64(certSize))
-	certData, err := ioutil.ReadAll(sr)
-	if err != nil {
-		return nil, xerrors.Errorf("cannot read vendor cert data: %w", err)
+	if table.DbxSize > 0 {
+		dbx, err = ioutil.ReadAll(io.NewSectionReader(section, int64(table.DbxOffset), int64(table.DbxSize)))
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot read vendor dbx data: %w", err)
+		}
 	}
 
-	return certData, nil
+	return cert, dbx, nil
 }
 
 // secureBootDbIterator provides a mechanism to iterate over a set of EFI_SIGNATURE_LIST entries in a EFI signature database.
@@ -323,28 +328,22 @@ const (
 	sigDbUpdateQuirkModeDedupIgnoresOwner
 )
 
-// computeDbUpdate appends the EFI signature database update supplied via update to the signature database supplied via orig, filtering
-// out EFI_SIGNATURE_DATA entries that are already in orig and then returning the result.
+// computeDbUpdate appends the authenticated EFI signature database update supplied via update to the signature database supplied via
+// orig, filtering out EFI_SIGNATURE_DATA entries that are already in orig and then returning the result.
 func computeDbUpdate(orig io.ReaderAt, update io.ReadSeeker, quirkMode sigDbUpdateQuirkMode) ([]byte, error) {
-	// Skip over EFI_VARIABLE_AUTHENTICATION_2.TimeStamp
-	update.Seek(16, io.SeekCurrent)
-
-	var cert *winCertificateUefiGuid
-	if c, _, err := decodeWinCertificate(update); err != nil {
-		return nil, xerrors.Errorf("cannot decode EFI_VARIABLE_AUTHENTICATION_2.AuthInfo field from update: %w", err)
-	} else if c.wCertificateType() != winCertTypeEfiGuid {
-		return nil, fmt.Errorf("update has invalid EFI_VARIABLE_AUTHENTICATION_2.AuthInfo.Hdr.wCertificateType (0x%04x)", c.wCertificateType())
-	} else {
-		cert = c.(*winCertificateUefiGuid)
-	}
-
-	if cert.CertType != *efiCertTypePkcs7Guid {
-		return nil, fmt.Errorf("update has invalid value for EFI_VARIABLE_AUTHENTICATION_2.AuthInfo.CertType (%s)", &cert.CertType)
+	u, err := decodeEFIVariableAuthentication2(update)
+	if err != nil {
+		return nil, err
 	}
+	return appendDbUpdate(orig, u.Data, quirkMode)
+}
 
+// appendDbUpdate appends the EFI_SIGNATURE_LIST entries supplied via update to the signature database supplied via orig, filtering
+// out EFI_SIGNATURE_DATA entries that are already in orig and then returning the result.
+func appendDbUpdate(orig io.ReaderAt, update []byte, quirkMode sigDbUpdateQuirkMode) ([]byte, error) {
 	filteredUpdate := new(bytes.Buffer)
 
-	updateIter := &secureBootDbIterator{update}
+	updateIter := &secureBootDbIterator{bytes.NewReader(update)}
 	for i := 0; ; i++ {
 		updateSigType, updateSigHeader, updateSigs, err := updateIter.nextSignatureList()
 		if err != nil {
@@ -455,66 +454,167 @@ func computeDbUpdate(orig io.ReaderAt, update io.ReadSeeker, quirkMode sigDbUpda
 
 // secureBootDbUpdate corresponds to an on-disk EFI signature database update.
 type secureBootDbUpdate struct {
-	db   string
-	path string
+	db     string
+	path   string
+	update *EFISignatureDbUpdate
 }
 
-// buildSignatureDbUpdateList builds a list of EFI signature database updates that will be applied by sbkeysync when executed with
-// the provided key stores.
-func buildSignatureDbUpdateList(keystores []string) ([]*secureBootDbUpdate, error) {
-	if len(keystores) == 0 {
-		// Nothing to do
+// sbKeySyncDbs is the list of EFI signature databases that sbkeysync will update, in the order that updates are applied. PK is
+// omitted because sbkeysync only updates it when run with the --pk option.
+var sbKeySyncDbs = []string{kekName, dbName, dbxName}
+
+// readSignatureDbUpdates reads and decodes all of the EFI signature database updates for the specified database from a sbkeysync
+// keystore directory.
+func readSignatureDbUpdates(keystore, db string) ([]*secureBootDbUpdate, error) {
+	dir := filepath.Join(keystore, db)
+	entries, err := ioutil.ReadDir(dir)
+	switch {
+	case os.IsNotExist(err):
 		return nil, nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot read directory: %w", err)
 	}
 
-	// Run sbkeysync in dry run mode to build a list of updates it will try to append. It will only try to append an update that
-	// contains keys which don't currently exist in the firmware database.
-	// FIXME: This isn't a guarantee that the update is actually applicable because it could fail a signature check. We should
-	// probably filter updates out if they obviously won't apply.
 	var updates []*secureBootDbUpdate
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot open signature DB update: %w", err)
+		}
+		u, err := DecodeEFISignatureDbUpdate(f, db)
+		f.Close()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode signature DB update %s: %w", path, err)
+		}
+		updates = append(updates, &secureBootDbUpdate{db: db, path: path, update: u})
+	}
+
+	return updates, nil
+}
 
-	sbKeySync, err := exec.LookPath(sbKeySyncExe)
+// readSignatureDb reads the contents of the specified EFI signature database from env. A database that doesn't exist is treated as
+// empty.
+func readSignatureDb(env HostEnvironment, name string) ([]byte, error) {
+	guid, err := sigDbVariableGuid(name)
 	if err != nil {
-		return nil, xerrors.Errorf("lookup failed %s: %w", sbKeySyncExe, err)
+		return nil, err
 	}
+	db, _, err := env.ReadVar(name, guid)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return db, nil
+}
 
-	args := []string{"--dry-run", "--verbose", "--no-default-keystores", "--efivars-path", efi.EFIVarsPath}
-	for _, ks := range keystores {
-		args = append(args, "--keystore", ks)
+// buildSignatureDbUpdateList builds a list of EFI signature database updates that will be applied by sbkeysync when executed with
+// the provided key stores on the supplied host environment. Like sbkeysync, an update is only included if it contains signatures
+// that don't already exist in the current database.
+//
+// Each update is checked against the PK and KEK contents that will exist at the time it is applied. If any of the updates would be
+// rejected by the firmware, an error is returned - sbkeysync ignores these errors, and the PCR profile computed from the resulting
+// update list would be incorrect.
+func buildSignatureDbUpdateList(env HostEnvironment, keystores []string) ([]*secureBootDbUpdate, error) {
+	if len(keystores) == 0 {
+		// Nothing to do
+		return nil, nil
 	}
 
-	out, err := osutil.StreamCommand(sbKeySync, args...)
+	pk, err := readSignatureDb(env, pkName)
 	if err != nil {
-		return nil, xerrors.Errorf("cannot execute command: %v", err)
+		return nil, xerrors.Errorf("cannot read current PK: %w", err)
 	}
 
-	scanner := bufio.NewScanner(out)
-	seenNewKeysHeader := false
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "New keys in filesystem:" {
-			seenNewKeysHeader = true
-			continue
-		}
-		if !seenNewKeysHeader {
-			continue
+	current := make(map[string][]byte)
+	for _, db := range sbKeySyncDbs {
+		d, err := readSignatureDb(env, db)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read current %s: %w", db, err)
 		}
-		line = strings.TrimSpace(line)
+		current[db] = d
+	}
+	kek := current[kekName]
+
+	var updates []*secureBootDbUpdate
+
+	for _, db := range sbKeySyncDbs {
 		for _, ks := range keystores {
-			rel, err := filepath.Rel(ks, line)
+			dbUpdates, err := readSignatureDbUpdates(ks, db)
 			if err != nil {
-				continue
+				return nil, xerrors.Errorf("cannot read %s updates from keystore %s: %w", db, ks, err)
 			}
-			if strings.HasPrefix("..", rel) {
-				continue
+
+			for _, u := range dbUpdates {
+				isNew, err := u.update.IsNew(current[db])
+				if err != nil {
+					return nil, xerrors.Errorf("cannot determine if %s contains new signatures: %w", u.path, err)
+				}
+				if !isNew {
+					continue
+				}
+
+				if err := u.update.Verify(pk, kek); err != nil {
+					return nil, xerrors.Errorf("signature DB update %s cannot be applied: %w", u.path, err)
+				}
+
+				if db == kekName {
+					// Subsequent updates may be signed by a key added by this update.
+					kek, err = u.update.Apply(kek)
+					if err != nil {
+						return nil, xerrors.Errorf("cannot apply signature DB update %s: %w", u.path, err)
+					}
+				}
+
+				updates = append(updates, u)
 			}
-			updates = append(updates, &secureBootDbUpdate{db: filepath.Dir(rel), path: line})
 		}
 	}
 
 	return updates, nil
 }
 
+// readMokDatabases returns the shim MOK database contents for which to compute PCR digests for. The first entry corresponds to the
+// current MOK database, which is either supplied via mokDb or read from the MokListRT variable in the supplied host environment. If
+// there are pending MOK enrolments in the MokNew variable, a second entry is returned corresponding to the contents of the MOK
+// database once these have been enrolled by MokManager on the next boot.
+func readMokDatabases(env HostEnvironment, mokDb []byte) ([]*secureBootDb, error) {
+	if mokDb == nil {
+		db, _, err := env.ReadVar(mokListRTName, shimGuid)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, xerrors.Errorf("cannot read current MOK database: %w", err)
+		}
+		mokDb = db
+	}
+
+	pending, _, err := env.ReadVar(mokNewName, shimGuid)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, xerrors.Errorf("cannot read pending MOK enrolments: %w", err)
+	}
+
+	dbs := [][]byte{mokDb}
+	if len(pending) > 0 {
+		// MokManager appends the pending enrolments to the existing database.
+		db := make([]byte, 0, len(mokDb)+len(pending))
+		db = append(db, mokDb...)
+		db = append(db, pending...)
+		dbs = append(dbs, db)
+	}
+
+	var out []*secureBootDb
+	for _, db := range dbs {
+		sigs, err := decodeSecureBootDb(bytes.NewReader(db))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode MOK database contents: %w", err)
+		}
+		out = append(out, &secureBootDb{variableName: *shimGuid, unicodeName: mokListName, signatures: sigs})
+	}
+
+	return out, nil
+}
+
 // secureBootVerificationEvent corresponds to a EV_EFI_VARIABLE_AUTHORITY event and an indicator of whether the event
 // was recorded before the transition to OS-present.
 type secureBootVerificationEvent struct {
@@ -605,6 +705,68 @@ func isShimExecutable(r io.ReaderAt) (bool, error) {
 	return pefile.Section(".vendor_cert") != nil, nil
 }
 
+// EFISignatureIterationOrder describes the order in which a device's firmware iterates over the Authenticode signatures of an image
+// and the entries in the authorized signature database when authenticating an image.
+type EFISignatureIterationOrder int
+
+const (
+	// EFISignatureOuterIteration indicates that the firmware iterates over the image's signatures in the order in which they appear
+	// in the image in an outer loop, and over the authorized signature database in an inner loop. For each signature, the CA
+	// certificates are checked before the image digest computed with the signature's digest algorithm. This matches the behaviour
+	// of EDK2 and is the default.
+	EFISignatureOuterIteration EFISignatureIterationOrder = iota
+
+	// EFIDatabaseOuterIteration indicates that the firmware iterates over the entries in the authorized signature database in the
+	// order in which they appear in an outer loop, and over the image's signatures in an inner loop. The first entry that is a CA
+	// certificate for one of the signatures, or that matches the image digest computed with the digest algorithm of one of the
+	// signatures, is used to authenticate the image.
+	EFIDatabaseOuterIteration
+)
+
+// EFISignatureDbDedupMode describes how a device's firmware determines whether a EFI_SIGNATURE_DATA entry in an append update to a
+// signature database already exists in the database.
+type EFISignatureDbDedupMode int
+
+const (
+	// EFISignatureDbDedupUnknown indicates that the firmware's behaviour is unknown. AddEFISecureBootPolicyProfile will compute a
+	// profile that is compatible with both EFISignatureDbDedupOwnerAndData and EFISignatureDbDedupDataOnly. This is the default.
+	EFISignatureDbDedupUnknown EFISignatureDbDedupMode = iota
+
+	// EFISignatureDbDedupOwnerAndData indicates that the firmware considers an entry to already exist if there is an entry with the
+	// same SignatureOwner and SignatureData fields, as required by the UEFI specification.
+	EFISignatureDbDedupOwnerAndData
+
+	// EFISignatureDbDedupDataOnly indicates that the firmware considers an entry to already exist if there is an entry with the
+	// same SignatureData field, regardless of the SignatureOwner field.
+	EFISignatureDbDedupDataOnly
+)
+
+// EFIFirmwareModel describes the behaviour of a device's firmware that affects the computation of secure boot policy profiles. The
+// zero value describes the default behaviour, which matches EDK2 and is compatible with either signature database de-duplication
+// behaviour.
+type EFIFirmwareModel struct {
+	// SignatureIterationOrder describes the order in which the firmware iterates over signatures and the authorized signature
+	// database when authenticating an image.
+	SignatureIterationOrder EFISignatureIterationOrder
+
+	// SignatureDbDedupMode describes how the firmware de-duplicates entries when applying append updates to signature databases.
+	SignatureDbDedupMode EFISignatureDbDedupMode
+}
+
+// sigDbUpdateQuirkModes returns the signature database update modes for which to compute profiles for.
+func (m *EFIFirmwareModel) sigDbUpdateQuirkModes() ([]sigDbUpdateQuirkMode, error) {
+	switch m.SignatureDbDedupMode {
+	case EFISignatureDbDedupUnknown:
+		return []sigDbUpdateQuirkMode{sigDbUpdateQuirkModeNone, sigDbUpdateQuirkModeDedupIgnoresOwner}, nil
+	case EFISignatureDbDedupOwnerAndData:
+		return []sigDbUpdateQuirkMode{sigDbUpdateQuirkModeNone}, nil
+	case EFISignatureDbDedupDataOnly:
+		return []sigDbUpdateQuirkMode{sigDbUpdateQuirkModeDedupIgnoresOwner}, nil
+	default:
+		return nil, fmt.Errorf("invalid signature database de-duplication mode: %d", m.SignatureDbDedupMode)
+	}
+}
+
 // EFISecureBootPolicyProfileParams provide the arguments to AddEFISecureBootPolicyProfile.
 type EFISecureBootPolicyProfileParams struct {
 	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
@@ -616,8 +778,21 @@ type EFISecureBootPolicyProfileParams struct {
 	LoadSequences []*EFIImageLoadEvent
 
 	// SignatureDbUpdateKeystores is a list of directories containing EFI signature database updates for which to compute PCR digests
-	// for. These directories are passed to sbkeysync using the --keystore option.
+	// for. These are the same directories that are passed to sbkeysync using the --keystore option.
 	SignatureDbUpdateKeystores []string
+
+	// Environment is an optional parameter that allows the caller to provide a TCG event log and EFI variables from an environment
+	// other than the current one. If not set, the event log and EFI variables of the current host are used.
+	Environment HostEnvironment
+
+	// MokDatabase is an optional parameter containing the contents of shim's machine owner key (MOK) database, in the form of a
+	// sequence of EFI_SIGNATURE_LIST structures. If not set, the MOK database is read from the MokListRT variable of the host
+	// environment.
+	MokDatabase []byte
+
+	// FirmwareModel describes the behaviour of the device's firmware. The zero value is suitable for most devices, but specifying
+	// the behaviour of a known platform produces a more precise profile.
+	FirmwareModel EFIFirmwareModel
 }
 
 // secureBootDb corresponds to a EFI signature database.
@@ -629,9 +804,10 @@ type secureBootDb struct {
 
 // secureBootDbSet corresponds to a set of EFI signature databases.
 type secureBootDbSet struct {
-	uefiDb *secureBootDb
-	mokDb  *secureBootDb
-	shimDb *secureBootDb
+	uefiDb  *secureBootDb
+	uefiDbx *secureBootDb
+	mokDb   *secureBootDb
+	shimDb  *secureBootDb
 }
 
 type secureBootAuthority struct {
@@ -640,19 +816,127 @@ type secureBootAuthority struct {
 }
 
 type authenticodeSignerAndIntermediates struct {
+	digestAlg     tpm2.HashAlgorithmId
 	signer        *x509.Certificate
-	intermediates *x509.CertPool
+	intermediates []*x509.Certificate
+}
+
+// authenticodeDigestAlgorithmId returns the digest algorithm corresponding to the supplied Authenticode signature digest algorithm
+// OID. Only SHA-256, SHA-384 and SHA-512 are supported.
+func authenticodeDigestAlgorithmId(oid asn1.ObjectIdentifier) (tpm2.HashAlgorithmId, error) {
+	switch {
+	case oid.Equal(oidSha256):
+		return tpm2.HashAlgorithmSHA256, nil
+	case oid.Equal(oidSha384):
+		return tpm2.HashAlgorithmSHA384, nil
+	case oid.Equal(oidSha512):
+		return tpm2.HashAlgorithmSHA512, nil
+	default:
+		return tpm2.HashAlgorithmNull, errors.New("signature has unexpected digest algorithm")
+	}
+}
+
+// imageDigestSignatureType returns the EFI_SIGNATURE_LIST type used for image digests computed with the specified algorithm.
+func imageDigestSignatureType(alg tpm2.HashAlgorithmId) *tcglog.EFIGUID {
+	switch alg {
+	case tpm2.HashAlgorithmSHA256:
+		return efiCertSha256Guid
+	case tpm2.HashAlgorithmSHA384:
+		return efiCertSha384Guid
+	case tpm2.HashAlgorithmSHA512:
+		return efiCertSha512Guid
+	default:
+		return nil
+	}
+}
+
+// efiImageDigests contains the Authenticode digests of an EFI image, indexed by digest algorithm. It always contains the SHA-256
+// digest, and the digests for the algorithms of each of the image's signatures.
+type efiImageDigests map[tpm2.HashAlgorithmId]tpm2.Digest
+
+// issuers returns the certificates from the intermediates embedded in this signature that issued the supplied certificate.
+func (s *authenticodeSignerAndIntermediates) issuers(cert *x509.Certificate) (out []*x509.Certificate) {
+	for _, c := range s.intermediates {
+		if bytes.Equal(c.Raw, cert.Raw) {
+			continue
+		}
+		if cert.CheckSignatureFrom(c) == nil {
+			out = append(out, c)
+		}
+	}
+	return
+}
+
+// chainsTo determines whether there is a chain of trust between the signer certificate of this signature and the supplied CA
+// certificate, using the intermediate certificates embedded in the signature to complete the chain where necessary. This doesn't
+// use x509.Certificate.Verify because there is no way to turn off time checking, and UEFI doesn't consider expired certificates to
+// be invalid.
+//
+// The supplied CA certificate is treated as a trust anchor, so its basic constraints and key usage aren't checked. This is
+// consistent with the firmware, which accepts signatures from certificates that are issued by a trusted certificate that isn't a
+// CA (eg, a KEK that is a leaf certificate).
+func (s *authenticodeSignerAndIntermediates) chainsTo(ca *x509.Certificate) bool {
+	visited := make(map[*x509.Certificate]bool)
+
+	var chainsTo func(cert *x509.Certificate) bool
+	chainsTo = func(cert *x509.Certificate) bool {
+		if visited[cert] {
+			return false
+		}
+		visited[cert] = true
+
+		if bytes.Equal(cert.Raw, ca.Raw) {
+			// This certificate is the CA
+			return true
+		}
+		if ca.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil {
+			// This certificate is directly trusted by the CA
+			return true
+		}
+		for _, issuer := range s.issuers(cert) {
+			if chainsTo(issuer) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return chainsTo(s.signer)
+}
+
+// chain returns the signer certificate of this signature and all of the intermediate certificates embedded in the signature that
+// are part of a chain of trust from the signer certificate.
+func (s *authenticodeSignerAndIntermediates) chain() []*x509.Certificate {
+	out := []*x509.Certificate{s.signer}
+	for i := 0; i < len(out); i++ {
+		for _, issuer := range s.issuers(out[i]) {
+			seen := false
+			for _, c := range out {
+				if c == issuer {
+					seen = true
+					break
+				}
+			}
+			if !seen {
+				out = append(out, issuer)
+			}
+		}
+	}
+	return out
 }
 
 // secureBootPolicyGen is the main structure involved with computing secure boot policy PCR digests. It is essentially just
 // a container for EFISecureBootPolicyProfileParams - per-branch context is maintained in secureBootPolicyGenBranch instead.
 type secureBootPolicyGen struct {
-	pcrAlgorithm  tpm2.HashAlgorithmId
-	loadSequences []*EFIImageLoadEvent
+	pcrAlgorithm      tpm2.HashAlgorithmId
+	loadSequences     []*EFIImageLoadEvent
+	sigIterationOrder EFISignatureIterationOrder
+	env               HostEnvironment
 
 	events                     []*tcglog.Event
 	initialOSVerificationEvent *secureBootVerificationEvent
 	sigDbUpdates               []*secureBootDbUpdate
+	mokDbs                     []*secureBootDb
 }
 
 // secureBootPolicyGenBranch represents a branch of a PCRProtectionProfile. It contains its own PCRProtectionProfile in to which
@@ -664,6 +948,8 @@ type secureBootPolicyGenBranch struct {
 	subBranches []*secureBootPolicyGenBranch // Sub-branches, if this has been branched
 
 	dbUpdateLevel              int             // The number of EFI signature database updates applied in this branch
+	mokUpdateLevel             int             // The number of pending MOK enrolments applied in this branch
+	mokDb                      *secureBootDb   // The MOK database that will be used by shim in this branch
 	dbSet                      secureBootDbSet // The signature database set associated with this branch
 	firmwareVerificationEvents tpm2.DigestList // The verification events recorded by firmware in this branch
 	shimVerificationEvents     tpm2.DigestList // The verification events recorded by shim in this branch
@@ -678,6 +964,8 @@ func (b *secureBootPolicyGenBranch) branch() *secureBootPolicyGenBranch {
 
 	// Preserve the context associated with this branch
 	c.dbUpdateLevel = b.dbUpdateLevel
+	c.mokUpdateLevel = b.mokUpdateLevel
+	c.mokDb = b.mokDb
 	c.dbSet = b.dbSet
 	c.firmwareVerificationEvents = make(tpm2.DigestList, len(b.firmwareVerificationEvents))
 	copy(c.firmwareVerificationEvents, b.firmwareVerificationEvents)
@@ -732,30 +1020,21 @@ func (b *secureBootPolicyGenBranch) computeAndExtendVariableMeasurement(varName
 
 // processSignatureDbMeasurementEvent computes a EFI signature database measurement for the specified database and with the supplied
 // updates, and then extends that in to this branch.
-func (b *secureBootPolicyGenBranch) processSignatureDbMeasurementEvent(guid *tcglog.EFIGUID, name, filename string, updates []*secureBootDbUpdate, updateQuirkMode sigDbUpdateQuirkMode) ([]byte, error) {
-	db, err := ioutil.ReadFile(filepath.Join(efi.EFIVarsPath, filename))
+func (b *secureBootPolicyGenBranch) processSignatureDbMeasurementEvent(guid *tcglog.EFIGUID, name string, updates []*secureBootDbUpdate, updateQuirkMode sigDbUpdateQuirkMode) ([]byte, error) {
+	db, _, err := b.gen.env.ReadVar(name, guid)
 	if err != nil && !os.IsNotExist(err) {
 		return nil, xerrors.Errorf("cannot read current variable: %w", err)
 	}
-	if len(db) > 0 {
-		if len(db) < 4 {
-			return nil, errors.New("current variable data is too short")
-		}
-		// Skip over the 4-byte attribute field
-		db = db[4:]
-	}
 
 	for _, u := range updates {
 		if u.db != name {
 			continue
 		}
-		if f, err := os.Open(u.path); err != nil {
-			return nil, xerrors.Errorf("cannot open signature DB update: %w", err)
-		} else if d, err := computeDbUpdate(bytes.NewReader(db), f, updateQuirkMode); err != nil {
+		d, err := u.update.apply(db, updateQuirkMode)
+		if err != nil {
 			return nil, xerrors.Errorf("cannot compute signature DB update for %s: %w", u.path, err)
-		} else {
-			db = d
 		}
+		db = d
 	}
 
 	if err := b.computeAndExtendVariableMeasurement(guid, name, db); err != nil {
@@ -768,7 +1047,7 @@ func (b *secureBootPolicyGenBranch) processSignatureDbMeasurementEvent(guid *tcg
 // processKEKMeasurementEvent computes a measurement of KEK with the supplied udates applied and then extends that in to
 // this branch.
 func (b *secureBootPolicyGenBranch) processKEKMeasurementEvent(updates []*secureBootDbUpdate, updateQuirkMode sigDbUpdateQuirkMode) error {
-	if _, err := b.processSignatureDbMeasurementEvent(efiGlobalVariableGuid, kekName, kekFilename, updates, updateQuirkMode); err != nil {
+	if _, err := b.processSignatureDbMeasurementEvent(efiGlobalVariableGuid, kekName, updates, updateQuirkMode); err != nil {
 		return err
 	}
 	return nil
@@ -779,7 +1058,7 @@ func (b *secureBootPolicyGenBranch) processKEKMeasurementEvent(updates []*secure
 // resulting authorized signature database contents, which is used later on when computing verification events in
 // secureBootPolicyGen.computeAndExtendVerificationMeasurement.
 func (b *secureBootPolicyGenBranch) processDbMeasurementEvent(updates []*secureBootDbUpdate, updateQuirkMode sigDbUpdateQuirkMode) error {
-	db, err := b.processSignatureDbMeasurementEvent(efiImageSecurityDatabaseGuid, dbName, dbFilename, updates, updateQuirkMode)
+	db, err := b.processSignatureDbMeasurementEvent(efiImageSecurityDatabaseGuid, dbName, updates, updateQuirkMode)
 	if err != nil {
 		return err
 	}
@@ -795,11 +1074,22 @@ func (b *secureBootPolicyGenBranch) processDbMeasurementEvent(updates []*secureB
 }
 
 // processDbxMeasurementEvent computes a measurement of the EFI forbidden signature database with the supplied updates applied and
-// then extends that in to this branch.
+// then extends that in to this branch. The branch context is then updated to contain a list of signatures associated with the
+// resulting forbidden signature database contents, which is used later on when computing verification events in
+// secureBootPolicyGen.computeAndExtendVerificationMeasurement.
 func (b *secureBootPolicyGenBranch) processDbxMeasurementEvent(updates []*secureBootDbUpdate, updateQuirkMode sigDbUpdateQuirkMode) error {
-	if _, err := b.processSignatureDbMeasurementEvent(efiImageSecurityDatabaseGuid, dbxName, dbxFilename, updates, updateQuirkMode); err != nil {
+	dbx, err := b.processSignatureDbMeasurementEvent(efiImageSecurityDatabaseGuid, dbxName, updates, updateQuirkMode)
+	if err != nil {
 		return err
 	}
+
+	sigs, err := decodeSecureBootDb(bytes.NewReader(dbx))
+	if err != nil {
+		return xerrors.Errorf("cannot decode dbx contents: %w", err)
+	}
+
+	b.dbSet.uefiDbx = &secureBootDb{variableName: *efiImageSecurityDatabaseGuid, unicodeName: dbxName, signatures: sigs}
+
 	return nil
 }
 
@@ -848,13 +1138,29 @@ func (b *secureBootPolicyGenBranch) processPreOSEvents(events []*tcglog.Event, i
 	return nil
 }
 
-// processShimExecutableLaunch updates the context in this branch with the supplied shim vendor certificate so that it can be used
-// later on when computing verification events in secureBootPolicyGenBranch.computeAndExtendVerificationMeasurement.
+// processShimExecutableLaunch updates the context in this branch with the supplied shim vendor certificate and the MOK database
+// associated with this branch so that they can be used later on when computing verification events in
+// secureBootPolicyGenBranch.computeAndExtendVerificationMeasurement.
 func (b *secureBootPolicyGenBranch) processShimExecutableLaunch(vendorCert []byte) {
 	b.dbSet.shimDb = &secureBootDb{variableName: *shimGuid, unicodeName: shimName}
 	if vendorCert != nil {
 		b.dbSet.shimDb.signatures = append(b.dbSet.shimDb.signatures, &efiSignatureData{signatureType: *efiCertX509Guid, data: vendorCert})
 	}
+
+	b.dbSet.mokDb = nil
+	if b.mokDb != nil {
+		// Newer versions of shim mirror their vendor certificate in to MokListRT, but it isn't part of the MOK database that is used
+		// for verification. Filter it out so that images authenticated by the vendor certificate aren't measured as being
+		// authenticated by a MOK.
+		b.dbSet.mokDb = &secureBootDb{variableName: b.mokDb.variableName, unicodeName: b.mokDb.unicodeName}
+		for _, sig := range b.mokDb.signatures {
+			if sig.signatureType == *efiCertX509Guid && bytes.Equal(sig.data, vendorCert) {
+				continue
+			}
+			b.dbSet.mokDb.signatures = append(b.dbSet.mokDb.signatures, sig)
+		}
+	}
+
 	b.shimVerificationEvents = nil
 }
 
@@ -876,35 +1182,13 @@ func (b *secureBootPolicyGenBranch) hasVerificationEventBeenMeasuredBy(digest tp
 	return false
 }
 
-// computeAndExtendVerificationMeasurement computes a measurement for the the authentication of an EFI image using the supplied
-// signatures and extends that in to this branch. If the computed measurement has already been measured by the specified source, then
-// it will not be measured again.
-//
-// In order to compute the measurement, the CA certificate that will be used to authenticate the image using the supplied signatures,
-// and the source of that certificate, needs to be determined. If the image is not signed with an authority that is trusted by a CA
-// certificate that exists in this branch, then this branch will be marked as unbootable and it will be omitted from the final PCR
-// profile.
-func (b *secureBootPolicyGenBranch) computeAndExtendVerificationMeasurement(sigs []*authenticodeSignerAndIntermediates, source EFIImageLoadEventSource) error {
-	if b.profile == nil {
-		// This branch is going to be excluded because it is unbootable.
-		return nil
-	}
-
-	dbs := []*secureBootDb{b.dbSet.uefiDb}
-	if source == Shim {
-		if b.dbSet.shimDb == nil {
-			return errors.New("shim specified as event source without a shim executable appearing in preceding events")
-		}
-		dbs = append(dbs, b.dbSet.mokDb, b.dbSet.shimDb)
-	}
-
-	var authority *secureBootAuthority
-
+// findCertificateAuthority determines the CA certificate from the supplied signature databases that will be used to authenticate an
+// image with the supplied signatures, returning nil if none of the signatures has a chain of trust to a CA certificate.
+func findCertificateAuthority(sigs []*authenticodeSignerAndIntermediates, dbs []*secureBootDb) *secureBootAuthority {
 	// To determine what CA certificate will be used to authenticate this image, iterate over the signatures in the order in which they
 	// appear in the binary in this outer loop. Iterating over the CA certificates occurs in an inner loop. This behaviour isn't defined
 	// in the UEFI specification but it matches EDK2 and the firmware on the Intel NUC. If an implementation iterates over the CA
 	// certificates in an outer loop and the signatures in an inner loop, then this may produce the wrong result.
-Outer:
 	for _, sig := range sigs {
 		for _, db := range dbs {
 			if db == nil {
@@ -922,22 +1206,216 @@ Outer:
 					continue
 				}
 
-				// XXX: This doesn't work if there isn't a direct relationship between the
-				// signing certificate and the CA (ie, there are intermediates). Ideally we
-				// would use x509.Certificate.Verify here, but there is no way to turn off
-				// time checking and UEFI doesn't consider expired certificates invalid.
-				if bytes.Equal(ca.Raw, sig.signer.Raw) {
-					// The signer certificate is the CA
-					authority = &secureBootAuthority{signature: caSig, source: db}
-					break Outer
+				if sig.chainsTo(ca) {
+					// The signer certificate has a chain of trust to the CA
+					return &secureBootAuthority{signature: caSig, source: db}
 				}
-				if err := sig.signer.CheckSignatureFrom(ca); err == nil {
-					// The signer certificate is directly trusted by the CA
-					authority = &secureBootAuthority{signature: caSig, source: db}
-					break Outer
+			}
+		}
+	}
+
+	return nil
+}
+
+// findImageDigestAuthority returns the entry from the supplied signature databases that matches the Authenticode digest of an image
+// computed with the specified algorithm, or nil if there isn't one.
+func findImageDigestAuthority(imageDigests efiImageDigests, alg tpm2.HashAlgorithmId, dbs []*secureBootDb) *secureBootAuthority {
+	sigType := imageDigestSignatureType(alg)
+	imageDigest, ok := imageDigests[alg]
+	if sigType == nil || !ok {
+		return nil
+	}
+
+	for _, db := range dbs {
+		if db == nil {
+			continue
+		}
+		for _, sig := range db.signatures {
+			if sig.signatureType == *sigType && bytes.Equal(sig.data, imageDigest) {
+				return &secureBootAuthority{signature: sig, source: db}
+			}
+		}
+	}
+	return nil
+}
+
+// findFirmwareAuthority determines the entry from the UEFI authorized signature database that the firmware will use to authenticate
+// an image with the supplied signatures and Authenticode digest in this branch, according to the configured signature iteration
+// order.
+//
+// With EFISignatureOuterIteration, this matches the behaviour of EDK2, which checks each signature against the CA certificates in the
+// authorized signature database and then checks for the image digest, before moving on to the next signature. An image digest in the
+// authorized signature database therefore takes priority over all but the first signature. The image digest is computed using the
+// digest algorithm of the signature being checked.
+//
+// With EFIDatabaseOuterIteration, the first entry in the authorized signature database that authenticates any of the signatures or
+// the image digest computed with any of the signature digest algorithms is used.
+func (b *secureBootPolicyGenBranch) findFirmwareAuthority(sigs []*authenticodeSignerAndIntermediates, imageDigests efiImageDigests) *secureBootAuthority {
+	dbs := []*secureBootDb{b.dbSet.uefiDb}
+
+	if b.gen.sigIterationOrder == EFIDatabaseOuterIteration {
+		if b.dbSet.uefiDb == nil {
+			return nil
+		}
+		for _, caSig := range b.dbSet.uefiDb.signatures {
+			if caSig.signatureType == *efiCertX509Guid {
+				ca, err := x509.ParseCertificate(caSig.data)
+				if err != nil {
+					continue
+				}
+				for _, sig := range sigs {
+					if sig.chainsTo(ca) {
+						return &secureBootAuthority{signature: caSig, source: b.dbSet.uefiDb}
+					}
+				}
+				continue
+			}
+
+			for _, sig := range sigs {
+				if caSig.signatureType == *imageDigestSignatureType(sig.digestAlg) && bytes.Equal(caSig.data, imageDigests[sig.digestAlg]) {
+					return &secureBootAuthority{signature: caSig, source: b.dbSet.uefiDb}
 				}
 			}
 		}
+		return nil
+	}
+
+	for _, sig := range sigs {
+		if authority := findCertificateAuthority([]*authenticodeSignerAndIntermediates{sig}, dbs); authority != nil {
+			return authority
+		}
+		if authority := findImageDigestAuthority(imageDigests, sig.digestAlg, dbs); authority != nil {
+			return authority
+		}
+	}
+
+	return nil
+}
+
+// findShimAuthority determines the signature database entry that shim will use to authenticate an image with the supplied signatures
+// and Authenticode digest in this branch. Shim searches the UEFI authorized signature database for the image digest and then for a
+// certificate that the signatures chain to, before doing the same with the MOK database and then finally checking the signatures
+// against its vendor certificate. Shim only uses SHA-256 image digests, and so it can't authenticate signatures with any other digest
+// algorithm.
+func (b *secureBootPolicyGenBranch) findShimAuthority(sigs []*authenticodeSignerAndIntermediates, imageDigests efiImageDigests) *secureBootAuthority {
+	var sha256Sigs []*authenticodeSignerAndIntermediates
+	for _, sig := range sigs {
+		if sig.digestAlg == tpm2.HashAlgorithmSHA256 {
+			sha256Sigs = append(sha256Sigs, sig)
+		}
+	}
+
+	for _, db := range []*secureBootDb{b.dbSet.uefiDb, b.dbSet.mokDb} {
+		dbs := []*secureBootDb{db}
+		if authority := findImageDigestAuthority(imageDigests, tpm2.HashAlgorithmSHA256, dbs); authority != nil {
+			return authority
+		}
+		if authority := findCertificateAuthority(sha256Sigs, dbs); authority != nil {
+			return authority
+		}
+	}
+
+	return findCertificateAuthority(sha256Sigs, []*secureBootDb{b.dbSet.shimDb})
+}
+
+// isSignatureRevokedBy determines whether the supplied Authenticode signature is revoked by the supplied EFI_SIGNATURE_DATA entry
+// from the forbidden signature database. The signature is revoked if the entry is a X.509 certificate that forms part of the chain
+// of trust for the signer certificate, or if the entry is a digest of the TBSCertificate of any certificate in the signer's chain.
+//
+// The time of revocation associated with EFI_CERT_X509_SHA256, EFI_CERT_X509_SHA384 and EFI_CERT_X509_SHA512 entries is ignored,
+// and the certificate is considered to be revoked regardless of when the image was signed.
+func isSignatureRevokedBy(sig *authenticodeSignerAndIntermediates, dbxSig *efiSignatureData) bool {
+	var h crypto.Hash
+	switch dbxSig.signatureType {
+	case *efiCertX509Guid:
+		revoked, err := x509.ParseCertificate(dbxSig.data)
+		if err != nil {
+			return false
+		}
+		return sig.chainsTo(revoked)
+	case *efiCertX509Sha256Guid:
+		h = crypto.SHA256
+	case *efiCertX509Sha384Guid:
+		h = crypto.SHA384
+	case *efiCertX509Sha512Guid:
+		h = crypto.SHA512
+	default:
+		return false
+	}
+
+	// EFI_CERT_X509_SHA* entries consist of the digest of the TBSCertificate followed by the time of revocation.
+	if len(dbxSig.data) < h.Size() {
+		return false
+	}
+	for _, cert := range sig.chain() {
+		hh := h.New()
+		hh.Write(cert.RawTBSCertificate)
+		if bytes.Equal(hh.Sum(nil), dbxSig.data[:h.Size()]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isImageForbidden determines whether the EFI image with the supplied signatures and Authenticode digests will be rejected because
+// of the contents of the forbidden signature database in this branch. An image is rejected if any of its digests are in the forbidden
+// signature database, or if any of its signing certificates have been revoked.
+func (b *secureBootPolicyGenBranch) isImageForbidden(sigs []*authenticodeSignerAndIntermediates, imageDigests efiImageDigests) bool {
+	if b.dbSet.uefiDbx == nil {
+		return false
+	}
+
+	for _, dbxSig := range b.dbSet.uefiDbx.signatures {
+		for alg, digest := range imageDigests {
+			if dbxSig.signatureType == *imageDigestSignatureType(alg) && bytes.Equal(dbxSig.data, digest) {
+				return true
+			}
+		}
+		for _, sig := range sigs {
+			if isSignatureRevokedBy(sig, dbxSig) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// computeAndExtendVerificationMeasurement computes a measurement for the the authentication of an EFI image using the supplied
+// signatures and extends that in to this branch. If the computed measurement has already been measured by the specified source, then
+// it will not be measured again.
+//
+// If the image is forbidden by the contents of the forbidden signature database in this branch, either because the supplied
+// Authenticode digest of the image is present or because one of the signers has been revoked, then this branch will be marked as
+// unbootable and it will be omitted from the final PCR profile. This matches the behaviour of EDK2, which rejects an image if any
+// of its signatures are forbidden, even if another signature would otherwise authorize it.
+//
+// In order to compute the measurement, the CA certificate or image digest entry that will be used to authenticate the image using
+// the supplied signatures and Authenticode digest, and the source of that entry, needs to be determined. If the image is not signed
+// with an authority that is trusted by a CA certificate that exists in this branch and its digest isn't present in any of the
+// signature databases in this branch, then this branch will be marked as unbootable and it will be omitted from the final PCR
+// profile.
+func (b *secureBootPolicyGenBranch) computeAndExtendVerificationMeasurement(sigs []*authenticodeSignerAndIntermediates, imageDigests efiImageDigests, source EFIImageLoadEventSource) error {
+	if b.profile == nil {
+		// This branch is going to be excluded because it is unbootable.
+		return nil
+	}
+
+	if b.isImageForbidden(sigs, imageDigests) {
+		// Mark this branch as unbootable by clearing its PCR profile
+		b.profile = nil
+		return nil
+	}
+
+	var authority *secureBootAuthority
+	switch source {
+	case Firmware:
+		authority = b.findFirmwareAuthority(sigs, imageDigests)
+	case Shim:
+		if b.dbSet.shimDb == nil {
+			return errors.New("shim specified as event source without a shim executable appearing in preceding events")
+		}
+		authority = b.findShimAuthority(sigs, imageDigests)
 	}
 
 	if authority == nil {
@@ -956,7 +1434,7 @@ Outer:
 			return xerrors.Errorf("cannot encode EFI_SIGNATURE_DATA for authority: %w", err)
 		}
 	case Shim:
-		// Shim measures the certificate data, rather than the entire EFI_SIGNATURE_DATA
+		// Shim measures the certificate or image digest data, rather than the entire EFI_SIGNATURE_DATA
 		varData = bytes.NewBuffer(authority.signature.data)
 	}
 
@@ -1004,7 +1482,10 @@ func (e *sbLoadEventAndBranches) branch(event *EFIImageLoadEvent) *sbLoadEventAn
 // source of that certificate needs to be determined. If the image is not signed with an authority that is trusted by a CA
 // certificate for a particular branch, then that branch will be marked as unbootable and it will be omitted from the final PCR
 // profile.
-func (g *secureBootPolicyGen) computeAndExtendVerificationMeasurement(branches []*secureBootPolicyGenBranch, r io.ReaderAt, source EFIImageLoadEventSource) error {
+//
+// The Authenticode digests of the supplied image are computed for SHA-256 and for the digest algorithm of each signature, and these
+// are used to determine whether the image is authorized or forbidden by an image digest in the signature databases in each branch.
+func (g *secureBootPolicyGen) computeAndExtendVerificationMeasurement(branches []*secureBootPolicyGenBranch, image EFIImage, r io.ReaderAt, source EFIImageLoadEventSource) error {
 	pefile, err := pe.NewFile(r)
 	if err != nil {
 		return xerrors.Errorf("cannot decode PE binary: %w", err)
@@ -1066,27 +1547,39 @@ func (g *secureBootPolicyGen) computeAndExtendVerificationMeasurement(branches [
 			return errors.New("cannot obtain signer certificate from signature")
 		}
 
-		// Reject any signature with a digest algorithm other than SHA256, as that's the only algorithm used for binaries we're
-		// expected to support, and therefore required by the UEFI implementation.
-		if !p7.Signers[0].DigestAlgorithm.Algorithm.Equal(oidSha256) {
-			return errors.New("signature has unexpected digest algorithm")
-		}
-
-		// Grab all of the certificates in the signature and populate an intermediates pool
-		intermediates := x509.NewCertPool()
-		for _, c := range p7.Certificates {
-			intermediates.AddCert(c)
+		// Reject any signature with a digest algorithm other than SHA256, SHA384 or SHA512, as these are the only algorithms used for
+		// binaries we're expected to support, and therefore required by the UEFI implementation.
+		digestAlg, err := authenticodeDigestAlgorithmId(p7.Signers[0].DigestAlgorithm.Algorithm)
+		if err != nil {
+			return err
 		}
 
-		sigs = append(sigs, &authenticodeSignerAndIntermediates{signer: p7.GetOnlySigner(), intermediates: intermediates})
+		// Grab all of the certificates in the signature, which are used to complete the chain of trust between the signer and a CA
+		sigs = append(sigs, &authenticodeSignerAndIntermediates{digestAlg: digestAlg, signer: signer, intermediates: p7.Certificates})
 	}
 
 	if len(sigs) == 0 {
 		return errors.New("no Authenticode signatures")
 	}
 
+	imageDigests := make(efiImageDigests)
+	algs := []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}
+	for _, sig := range sigs {
+		algs = append(algs, sig.digestAlg)
+	}
+	for _, alg := range algs {
+		if _, ok := imageDigests[alg]; ok {
+			continue
+		}
+		digest, err := computePeImageDigest(alg, image)
+		if err != nil {
+			return xerrors.Errorf("cannot compute image digest: %w", err)
+		}
+		imageDigests[alg] = digest
+	}
+
 	for _, b := range branches {
-		if err := b.computeAndExtendVerificationMeasurement(sigs, source); err != nil {
+		if err := b.computeAndExtendVerificationMeasurement(sigs, imageDigests, source); err != nil {
 			return err
 		}
 	}
@@ -1126,7 +1619,7 @@ func (g *secureBootPolicyGen) processOSLoadEvent(branches []*secureBootPolicyGen
 		return xerrors.Errorf("cannot determine image type: %w", err)
 	}
 
-	if err := g.computeAndExtendVerificationMeasurement(branches, r, event.Source); err != nil {
+	if err := g.computeAndExtendVerificationMeasurement(branches, event.Image, r, event.Source); err != nil {
 		return xerrors.Errorf("cannot compute load verification event: %w", err)
 	}
 
@@ -1147,11 +1640,14 @@ func (g *secureBootPolicyGen) run(profile *PCRProtectionProfile, sigDbUpdateQuir
 	// in turn.
 	var roots []*secureBootPolicyGenBranch
 	for i := 0; i <= len(g.sigDbUpdates); i++ {
-		branch := &secureBootPolicyGenBranch{gen: g, profile: NewPCRProtectionProfile(), dbUpdateLevel: i}
-		if err := branch.processPreOSEvents(g.events, g.initialOSVerificationEvent, g.sigDbUpdates[0:i], sigDbUpdateQuirkMode); err != nil {
-			return xerrors.Errorf("cannot process pre-OS events from event log: %w", err)
+		// Process the pre-OS events for the current MOK database and then with any pending MOK enrolments applied.
+		for j, mokDb := range g.mokDbs {
+			branch := &secureBootPolicyGenBranch{gen: g, profile: NewPCRProtectionProfile(), dbUpdateLevel: i, mokUpdateLevel: j, mokDb: mokDb}
+			if err := branch.processPreOSEvents(g.events, g.initialOSVerificationEvent, g.sigDbUpdates[0:i], sigDbUpdateQuirkMode); err != nil {
+				return xerrors.Errorf("cannot process pre-OS events from event log: %w", err)
+			}
+			roots = append(roots, branch)
 		}
-		roots = append(roots, branch)
 	}
 
 	allBranches := make([]*secureBootPolicyGenBranch, len(roots))
@@ -1230,7 +1726,7 @@ func (g *secureBootPolicyGen) run(profile *PCRProtectionProfile, sigDbUpdateQuir
 			// This branch has no bootable paths
 			continue
 		}
-		if b.dbUpdateLevel == 0 {
+		if b.dbUpdateLevel == 0 && b.mokUpdateLevel == 0 {
 			validPathsForCurrentDb = true
 		}
 		subProfiles = append(subProfiles, b.profile)
@@ -1259,20 +1755,23 @@ func (g *secureBootPolicyGen) run(profile *PCRProtectionProfile, sigDbUpdateQuir
 // function will compute the measurements associated with the authentication of these load sequences. Each of the EFIImage instances
 // reachable from the LoadSequences field of params must correspond to an EFI image with one or more Authenticode signatures. These
 // signatures are used to determine the CA certificate that will be used to authenticate them in order to compute authentication
-// meausurement events. The digest algorithm of the Authenticode signatures must be SHA256. If there are no signatures, or the
-// binary's certificate table contains non-Authenticode entries, or contains any Authenticode signatures with a digest algorithm other
-// than SHA256, then an error will be returned. Note that this function assumes that any signatures are correct and does not ensure
-// that they are so - it only determines if there is a chain of trust beween the signing certificate and a CA certificate in order to
-// determine which certificate will be used for authentication, and what the source of that certificate is (for UEFI images that are
-// loaded by shim).
+// meausurement events. The digest algorithm of the Authenticode signatures must be SHA256, SHA384 or SHA512. If there are no
+// signatures, or the binary's certificate table contains non-Authenticode entries, or contains any Authenticode signatures with
+// another digest algorithm, then an error will be returned. Shim can only authenticate signatures with a SHA256 digest algorithm,
+// so signatures with other digest algorithms are ignored when computing measurements for images that are loaded by shim. Note that
+// this function assumes that any signatures are correct and does not ensure that they are so - it only determines if there is a
+// chain of trust beween the signing certificate and a CA certificate in order to determine which certificate will be used for
+// authentication, and what the source of that certificate is (for UEFI images that are loaded by shim).
 //
 // If none of the sequences in the LoadSequences field of params can be authenticated by the current authorized signature database
 // contents, then an error will be returned.
 //
-// This function does not support computing measurements for images that are authenticated by an image digest rather than an
-// Authenticode signature. If an image has a signature where the signer has a chain of trust to a CA certificate in the authorized
-// signature database (or shim's vendor certificate) but that image is authenticated because an image digest is present in the
-// authorized signature database instead, then this function will generate a PCR profile that is incorrect.
+// Images can also be authenticated because their Authenticode digest is present in the authorized signature database as a
+// EFI_CERT_SHA256_GUID, EFI_CERT_SHA384_GUID or EFI_CERT_SHA512_GUID entry, in which case the matching EFI_SIGNATURE_DATA entry is
+// the measured authority. This function assumes that the firmware checks each signature against the CA certificates in the
+// authorized signature database and then checks for the image digest computed with the signature's digest algorithm before moving
+// on to the next signature, which matches the behaviour of EDK2. Shim only checks for SHA-256 image digests. Images must still have
+// at least one Authenticode signature.
 //
 // If an image has a signature that can be authenticated by multiple CA certificates in the authorized signature database, this
 // function assumes that the firmware will try the CA certificates in the order in which they appear in the database and authenticate
@@ -1280,26 +1779,42 @@ func (g *secureBootPolicyGen) run(profile *PCRProtectionProfile, sigDbUpdateQuir
 // incorrect for binaries that have a signature that can be authenticated by more than one CA certificate. Note that the structure of
 // the signature database means that it can only really be iterated in one direction anyway.
 //
-// For images with multiple Authenticode signatures, this function assumes that the device's firmware will iterate over the signatures
-// in the order in which they appear in the binary's certificate table in an outer loop during image authentication (ie, for each
-// signature, attempt to authenticate the binary using one of the CA certificates). If a device's firmware iterates over the
+// For images with multiple Authenticode signatures, this function assumes by default that the device's firmware will iterate over the
+// signatures in the order in which they appear in the binary's certificate table in an outer loop during image authentication (ie,
+// for each signature, attempt to authenticate the binary using one of the CA certificates). If a device's firmware iterates over the
 // authorized signature database in an outer loop instead (ie, for each CA certificate, attempt to authenticate the binary using one
-// of its signatures), then this function may generate a PCR profile that is incorrect for binaries that have multiple signatures
-// where both signers have a chain of trust to a different CA certificate but the signatures appear in a different order to which
-// their CA certificates are enrolled.
+// of its signatures), then EFIDatabaseOuterIteration should be specified via the FirmwareModel field of params. Otherwise, this
+// function may generate a PCR profile that is incorrect for binaries that have multiple signatures where both signers have a chain
+// of trust to a different CA certificate but the signatures appear in a different order to which their CA certificates are enrolled.
 //
-// This function does not consider the contents of the forbidden signature database. This is most relevant for images with multiple
-// signatures. If an image has more than one signature where the signing certificates have chains of trust to different CA
-// certificates, but the first signature is not used to authenticate the image because one of the certificates in its chain is
-// blacklisted, then this function will generate a PCR profile that is incorrect.
+// Some firmware implementations don't consider the SignatureOwner field when determining whether an entry in an append update to a
+// signature database already exists in the database. Because of this, the PCR profile generated by default is compatible with
+// both behaviours, which doubles the number of branches when there are pending signature database updates. If the firmware's
+// behaviour is known, it can be specified via the FirmwareModel field of params in order to avoid this.
 //
-// In determining whether a signing certificate has a chain of trust to a CA certificate, this function expects there to be a direct
-// relationship between the CA certificate and signing certificate. It does not currently detect that there is a chain of trust if
-// intermediate certificates form part of the chain. This is most relevant for images with multiple signatures. If an image has more
-// than one signature where the signing certificate have chains of trust to different CA certificate, but the first signature's chain
-// involves intermediate certificates, then this function will generate a PCR profile that is incorrect.
+// The contents of the forbidden signature database (including any pending updates to it) are considered when computing the
+// measurements associated with the authentication of each image. An image is considered to be unbootable if its Authenticode
+// digest is present in the forbidden signature database as a EFI_CERT_SHA256_GUID entry (or a EFI_CERT_SHA384_GUID or
+// EFI_CERT_SHA512_GUID entry for the digest algorithm of one of its signatures), or if the signing certificate of any of
+// its signatures is revoked by a EFI_CERT_X509_GUID, EFI_CERT_X509_SHA256_GUID, EFI_CERT_X509_SHA384_GUID or
+// EFI_CERT_X509_SHA512_GUID entry. This matches the behaviour of EDK2, which rejects an image with a revoked signature even if
+// another signature could be used to authenticate it. Branches of the profile containing unbootable images are omitted. The time of
+// revocation associated with EFI_CERT_X509_SHA* entries is ignored.
 //
-// This function does not support computing measurements for images that are authenticated by shim using a machine owner key (MOK).
+// In determining whether a signing certificate has a chain of trust to a CA certificate, this function uses the intermediate
+// certificates embedded in each Authenticode signature to complete the chain where there isn't a direct relationship between the
+// signing certificate and the CA certificate. The measured authority is the CA certificate from the signature database, even if
+// the chain of trust involves intermediate certificates. The validity period of each certificate in the chain is not checked, as
+// UEFI doesn't consider expired certificates to be invalid.
+//
+// Images that are loaded by shim can be authenticated using shim's machine owner key (MOK) database. The MOK database is read from
+// the MokListRT variable, or can be supplied via the MokDatabase field of params. Shim searches for the image digest in the
+// authorized signature database and then the MOK database before attempting to authenticate the image's signature using the CA
+// certificates in the authorized signature database, then the MOK database, and then its vendor certificate. The authority recorded
+// by shim for an image authenticated by the MOK database is the certificate data or image digest, without the SignatureOwner. Only
+// EFI_CERT_X509_GUID and EFI_CERT_SHA256_GUID entries in the MOK database are considered. If there are pending MOK enrolments in
+// the MokNew variable, then this function will generate a PCR policy that is compatible with the current MOK database contents and
+// the contents once the pending enrolments have been applied by MokManager.
 //
 // The secure boot policy measurements include the secure boot configuration, which includes the contents of the UEFI signature
 // databases. In order to support atomic updates of these databases with the sbkeysync tool, it is possible to generate a PCR policy
@@ -1307,18 +1822,38 @@ func (g *secureBootPolicyGen) run(profile *PCRProtectionProfile, sigDbUpdateQuir
 // the SignatureDbUpdateKeystores field of the params argument. This function assumes that sbkeysync is executed with the
 // "--no-default-keystores" option. When there are pending updates in the specified directories, this function will generate a PCR
 // policy that is compatible with the current database contents and the database contents computed for each individual update.
-// Note that sbkeysync ignores errors when applying updates - if any of the pending updates don't apply for some reason, the generated
-// PCR profile will be invalid.
+// Note that sbkeysync ignores errors when applying updates, so this function verifies that each pending update is signed by a key
+// that will be authorized to apply it. If any of the pending updates would be rejected by the firmware, an error will be returned.
+//
+// By default, the TCG event log and EFI variables are read from the current host. A PCR profile can be computed for a different
+// environment, such as for a device image on a build server, by supplying a HostEnvironment via the Environment field of params
+// (see FileHostEnvironment).
 //
 // For the most common case where there are no signature database updates pending in the specified keystore directories and each image
 // load event sequence corresponds to loads of images that are all verified with the same chain of trust, this is a complicated way of
 // adding a single PCR digest to the provided PCRProtectionProfile.
 func AddEFISecureBootPolicyProfile(profile *PCRProtectionProfile, params *EFISecureBootPolicyProfileParams) error {
+	switch params.FirmwareModel.SignatureIterationOrder {
+	case EFISignatureOuterIteration, EFIDatabaseOuterIteration:
+	default:
+		return fmt.Errorf("invalid signature iteration order: %d", params.FirmwareModel.SignatureIterationOrder)
+	}
+	quirkModes, err := params.FirmwareModel.sigDbUpdateQuirkModes()
+	if err != nil {
+		return err
+	}
+
+	env := params.Environment
+	if env == nil {
+		env = defaultHostEnvironment()
+	}
+
 	// Load event log
-	eventLog, err := os.Open(efi.EventLogPath)
+	eventLog, err := env.OpenEventLog()
 	if err != nil {
 		return xerrors.Errorf("cannot open TCG event log: %w", err)
 	}
+	defer eventLog.Close()
 	log, err := tcglog.NewLog(eventLog, tcglog.LogOptions{})
 	if err != nil {
 		return xerrors.Errorf("cannot parse TCG event log header: %w", err)
@@ -1384,7 +1919,7 @@ func AddEFISecureBootPolicyProfile(profile *PCRProtectionProfile, params *EFISec
 	profile.AddPCRValue(params.PCRAlgorithm, secureBootPCR, make(tpm2.Digest, params.PCRAlgorithm.Size()))
 
 	// Compute a list of pending EFI signature DB updates.
-	sigDbUpdates, err := buildSignatureDbUpdateList(params.SignatureDbUpdateKeystores)
+	sigDbUpdates, err := buildSignatureDbUpdateList(env, params.SignatureDbUpdateKeystores)
 	if err != nil {
 		return xerrors.Errorf("cannot build list of UEFI signature DB updates: %w", err)
 	}
@@ -1395,18 +1930,24 @@ func AddEFISecureBootPolicyProfile(profile *PCRProtectionProfile, params *EFISec
 		return xerrors.Errorf("cannot identify initial OS launch verification event: %w", err)
 	}
 
-	gen := &secureBootPolicyGen{params.PCRAlgorithm, params.LoadSequences, events, initialOSVerificationEvent, sigDbUpdates}
-
-	profile1 := NewPCRProtectionProfile()
-	if err := gen.run(profile1, sigDbUpdateQuirkModeNone); err != nil {
-		return xerrors.Errorf("cannot compute secure boot policy profile: %w", err)
+	// Obtain the current MOK database and the database with any pending enrolments applied.
+	mokDbs, err := readMokDatabases(env, params.MokDatabase)
+	if err != nil {
+		return xerrors.Errorf("cannot read MOK database: %w", err)
 	}
 
-	profile2 := NewPCRProtectionProfile()
-	if err := gen.run(profile2, sigDbUpdateQuirkModeDedupIgnoresOwner); err != nil {
-		return xerrors.Errorf("cannot compute secure boot policy profile: %w", err)
+	gen := &secureBootPolicyGen{params.PCRAlgorithm, params.LoadSequences, params.FirmwareModel.SignatureIterationOrder, env, events,
+		initialOSVerificationEvent, sigDbUpdates, mokDbs}
+
+	var profiles []*PCRProtectionProfile
+	for _, quirkMode := range quirkModes {
+		p := NewPCRProtectionProfile()
+		if err := gen.run(p, quirkMode); err != nil {
+			return xerrors.Errorf("cannot compute secure boot policy profile: %w", err)
+		}
+		profiles = append(profiles, p)
 	}
 
-	profile.AddProfileOR(profile1, profile2)
+	profile.AddProfileOR(profiles...)
 	return nil
 }
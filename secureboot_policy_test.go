@@ -22,16 +22,23 @@ package secboot_test
 import (
 	"bytes"
 	"crypto"
+	"crypto/rsa"
 	_ "crypto/sha1"
 	_ "crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/binary"
+	"encoding/pem"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/chrisccoulson/tcglog-parser"
@@ -549,6 +556,41 @@ func TestAddEFISecureBootPolicyProfile(t *testing.T) {
 				},
 			},
 		},
+		{
+			// Test that the event log and EFI variables are read from the supplied environment rather than the current host
+			desc:    "ClassicWithEnvironment",
+			logPath: "testdata/nonexistent",
+			efivars: "testdata/nonexistent",
+			params: EFISecureBootPolicyProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+				LoadSequences: []*EFIImageLoadEvent{
+					{
+						Source: Firmware,
+						Image:  FileEFIImage("testdata/mockshim1.efi.signed.1"),
+						Next: []*EFIImageLoadEvent{
+							{
+								Source: Shim,
+								Image:  FileEFIImage("testdata/mockgrub1.efi.signed.shim"),
+								Next: []*EFIImageLoadEvent{
+									{
+										Source: Shim,
+										Image:  FileEFIImage("testdata/mockkernel1.efi.signed.shim"),
+									},
+								},
+							},
+						},
+					},
+				},
+				Environment: &FileHostEnvironment{EventLogPath: "testdata/eventlog1.bin", EFIVarsPath: "testdata/efivars2"},
+			},
+			values: []tpm2.PCRValues{
+				{
+					tpm2.HashAlgorithmSHA256: {
+						7: decodeHexStringT(t, "d9ea13718ff09d8ade8e570656f4ac3d93d121d4fe784dee966b38e3fcddaf87"),
+					},
+				},
+			},
+		},
 		{
 			// Test with a UC20 style bootchain with normal and recovery systems, and the normal path booting via a chainloaded GRUB. All
 			// components are authenticated using a certificate in the UEFI signature db.
@@ -1456,3 +1498,812 @@ func TestAddEFISecureBootPolicyProfile(t *testing.T) {
 		})
 	}
 }
+
+var mockSignatureOwner = tcglog.NewEFIGUID(0x84b1ef98, 0x9f13, 0x4c6e, 0x9e8a, [...]uint8{0x6d, 0x22, 0x05, 0x6d, 0x97, 0x4e})
+
+// makeMockSignatureList creates a EFI_SIGNATURE_LIST containing the supplied signatures, which must all be the same length.
+func makeMockSignatureList(sigType *tcglog.EFIGUID, sigs ...[]byte) []byte {
+	var sigData bytes.Buffer
+	for _, sig := range sigs {
+		binary.Write(&sigData, binary.LittleEndian, mockSignatureOwner)
+		sigData.Write(sig)
+	}
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, sigType)
+	binary.Write(&out, binary.LittleEndian, uint32(28+sigData.Len()))
+	binary.Write(&out, binary.LittleEndian, uint32(0))
+	binary.Write(&out, binary.LittleEndian, uint32(16+len(sigs[0])))
+	out.Write(sigData.Bytes())
+	return out.Bytes()
+}
+
+func TestAddEFISecureBootPolicyProfileWithForbiddenImages(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.SkipNow()
+	}
+
+	grubDigest, err := ComputePeImageDigest(tpm2.HashAlgorithmSHA256, FileEFIImage("testdata/mockgrub1.efi.signed.shim"))
+	if err != nil {
+		t.Fatalf("ComputePeImageDigest failed: %v", err)
+	}
+
+	vendorCertPEM, err := ioutil.ReadFile("testdata/certs/TestShimVendorCA.crt")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	vendorCert, _ := pem.Decode(vendorCertPEM)
+	if vendorCert == nil {
+		t.Fatalf("cannot decode vendor certificate")
+	}
+
+	for _, data := range []struct {
+		desc string
+		dbx  []byte
+	}{
+		{
+			desc: "ImageDigest",
+			dbx:  makeMockSignatureList(EFICertSha256Guid, grubDigest),
+		},
+		{
+			desc: "RevokedCA",
+			dbx:  makeMockSignatureList(EFICertX509Guid, vendorCert.Bytes),
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			efivars, err := ioutil.TempDir("", "secboot-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %v", err)
+			}
+			defer os.RemoveAll(efivars)
+
+			for _, name := range []string{"KEK-8be4df61-93ca-11d2-aa0d-00e098032b8c", "db-d719b2cb-3d3a-4596-a3bc-dad00e67656f"} {
+				d, err := ioutil.ReadFile(filepath.Join("testdata/efivars2", name))
+				if err != nil {
+					t.Fatalf("ReadFile failed: %v", err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(efivars, name), d, 0644); err != nil {
+					t.Fatalf("WriteFile failed: %v", err)
+				}
+			}
+			dbx := append([]byte{0x27, 0x00, 0x00, 0x00}, data.dbx...)
+			if err := ioutil.WriteFile(filepath.Join(efivars, "dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f"), dbx, 0644); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+
+			params := EFISecureBootPolicyProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+				LoadSequences: []*EFIImageLoadEvent{
+					{
+						Source: Firmware,
+						Image:  FileEFIImage("testdata/mockshim1.efi.signed.1"),
+						Next: []*EFIImageLoadEvent{
+							{
+								Source: Shim,
+								Image:  FileEFIImage("testdata/mockgrub1.efi.signed.shim"),
+							},
+						},
+					},
+				},
+				Environment: &FileHostEnvironment{EventLogPath: "testdata/eventlog1.bin", EFIVarsPath: efivars},
+			}
+
+			err = AddEFISecureBootPolicyProfile(NewPCRProtectionProfile(), &params)
+			if err == nil {
+				t.Fatalf("Expected AddEFISecureBootPolicyProfile to fail")
+			}
+			if err.Error() != "cannot compute secure boot policy profile: no bootable paths with current EFI signature database" {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestAuthenticodeSignerChainsTo(t *testing.T) {
+	makeCert := func(subject string, serial int64, isCA bool, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+		key, err := rsa.GenerateKey(testutil.RandReader, 2048)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: subject},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			BasicConstraintsValid: true,
+			IsCA:                  isCA,
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign}
+		if parent == nil {
+			parent = template
+			parentKey = key
+		}
+		der, err := x509.CreateCertificate(testutil.RandReader, template, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatalf("CreateCertificate failed: %v", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("ParseCertificate failed: %v", err)
+		}
+		return cert, key
+	}
+
+	root, rootKey := makeCert("Root CA", 1, true, nil, nil)
+	intermediate, intermediateKey := makeCert("Intermediate CA", 2, true, root, rootKey)
+	leaf, _ := makeCert("Signer", 3, false, intermediate, intermediateKey)
+	other, _ := makeCert("Other CA", 4, true, nil, nil)
+
+	for _, data := range []struct {
+		desc          string
+		intermediates []*x509.Certificate
+		ca            *x509.Certificate
+		expected      bool
+	}{
+		{
+			desc:     "Self",
+			ca:       leaf,
+			expected: true,
+		},
+		{
+			desc:     "DirectIssuer",
+			ca:       intermediate,
+			expected: true,
+		},
+		{
+			desc:     "MissingIntermediate",
+			ca:       root,
+			expected: false,
+		},
+		{
+			desc:          "WithIntermediate",
+			intermediates: []*x509.Certificate{leaf, intermediate},
+			ca:            root,
+			expected:      true,
+		},
+		{
+			desc:          "Untrusted",
+			intermediates: []*x509.Certificate{leaf, intermediate},
+			ca:            other,
+			expected:      false,
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			if AuthenticodeSignerChainsTo(leaf, data.intermediates, data.ca) != data.expected {
+				t.Errorf("Unexpected result")
+			}
+		})
+	}
+
+	t.Run("NonCATrustAnchor", func(t *testing.T) {
+		// Firmware accepts signers that are issued by a trusted certificate that isn't a CA, such as a KEK that is a leaf
+		// certificate.
+		kek, kekKey := makeCert("KEK", 5, false, nil, nil)
+		signer, _ := makeCert("Signer", 6, false, kek, kekKey)
+		if !AuthenticodeSignerChainsTo(signer, nil, kek) {
+			t.Errorf("Unexpected result")
+		}
+		if AuthenticodeSignerChainsTo(signer, nil, other) {
+			t.Errorf("Unexpected result")
+		}
+	})
+}
+
+func TestAddEFISecureBootPolicyProfileWithMOK(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.SkipNow()
+	}
+
+	grubDigest, err := ComputePeImageDigest(tpm2.HashAlgorithmSHA256, FileEFIImage("testdata/mockgrub1.efi.signed.shim"))
+	if err != nil {
+		t.Fatalf("ComputePeImageDigest failed: %v", err)
+	}
+	kernelDigest, err := ComputePeImageDigest(tpm2.HashAlgorithmSHA256, FileEFIImage("testdata/mockkernel1.efi.signed.shim"))
+	if err != nil {
+		t.Fatalf("ComputePeImageDigest failed: %v", err)
+	}
+
+	vendorCertPEM, err := ioutil.ReadFile("testdata/certs/TestShimVendorCA.crt")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	vendorCert, _ := pem.Decode(vendorCertPEM)
+	if vendorCert == nil {
+		t.Fatalf("cannot decode vendor certificate")
+	}
+
+	computeVerificationDigest := func(name string, data []byte) tpm2.Digest {
+		h := crypto.SHA256.New()
+		eventData := tcglog.EFIVariableEventData{VariableName: *ShimGuid, UnicodeName: name, VariableData: data}
+		if err := eventData.EncodeMeasuredBytes(h); err != nil {
+			t.Fatalf("EncodeMeasuredBytes failed: %v", err)
+		}
+		return h.Sum(nil)
+	}
+	shimVendorCertEvent := computeVerificationDigest("Shim", vendorCert.Bytes)
+	mokCertEvent := computeVerificationDigest("MokList", vendorCert.Bytes)
+	mokGrubDigestEvent := computeVerificationDigest("MokList", grubDigest)
+	mokKernelDigestEvent := computeVerificationDigest("MokList", kernelDigest)
+
+	var dbCertData bytes.Buffer
+	binary.Write(&dbCertData, binary.LittleEndian, mockSignatureOwner)
+	dbCertData.Write(vendorCert.Bytes)
+	h := crypto.SHA256.New()
+	dbEventData := tcglog.EFIVariableEventData{VariableName: *EFIImageSecurityDatabaseGuid, UnicodeName: "db", VariableData: dbCertData.Bytes()}
+	if err := dbEventData.EncodeMeasuredBytes(h); err != nil {
+		t.Fatalf("EncodeMeasuredBytes failed: %v", err)
+	}
+	dbCertEvent := tpm2.Digest(h.Sum(nil))
+
+	for _, data := range []struct {
+		desc      string
+		efivars   string
+		shim      string
+		extraDb   []byte
+		mokDb     []byte
+		mokListRT []byte
+		mokNew    []byte
+		paths     [][]tpm2.Digest
+		err       string
+	}{
+		{
+			// Test with grub and the kernel authenticated by a MOK certificate supplied via the parameters
+			desc:    "MokDatabase",
+			efivars: "testdata/efivars3",
+			shim:    "testdata/mockshim.efi.signed.2",
+			mokDb:   makeMockSignatureList(EFICertX509Guid, vendorCert.Bytes),
+			paths:   [][]tpm2.Digest{{mokCertEvent}},
+		},
+		{
+			// Test with grub and the kernel authenticated by a MOK certificate read from MokListRT
+			desc:      "MokListRT",
+			efivars:   "testdata/efivars3",
+			shim:      "testdata/mockshim.efi.signed.2",
+			mokListRT: makeMockSignatureList(EFICertX509Guid, vendorCert.Bytes),
+			paths:     [][]tpm2.Digest{{mokCertEvent}},
+		},
+		{
+			// Test with grub and the kernel authenticated by image digests in the MOK database
+			desc:      "MokImageDigests",
+			efivars:   "testdata/efivars3",
+			shim:      "testdata/mockshim.efi.signed.2",
+			mokListRT: makeMockSignatureList(EFICertSha256Guid, grubDigest, kernelDigest),
+			paths:     [][]tpm2.Digest{{mokGrubDigestEvent, mokKernelDigestEvent}},
+		},
+		{
+			// Test that a certificate in the UEFI signature db is preferred over image digests in the MOK database, as shim
+			// checks both hashes and certificates in db before checking MokList
+			desc:      "DbCertBeforeMokImageDigests",
+			efivars:   "testdata/efivars3",
+			shim:      "testdata/mockshim.efi.signed.2",
+			extraDb:   makeMockSignatureList(EFICertX509Guid, vendorCert.Bytes),
+			mokListRT: makeMockSignatureList(EFICertSha256Guid, grubDigest, kernelDigest),
+			paths:     [][]tpm2.Digest{{dbCertEvent}},
+		},
+		{
+			// Test that shim's vendor certificate mirrored in to MokListRT isn't treated as a MOK
+			desc:      "MokListRTWithVendorCert",
+			efivars:   "testdata/efivars2",
+			shim:      "testdata/mockshim1.efi.signed.1",
+			mokListRT: makeMockSignatureList(EFICertX509Guid, vendorCert.Bytes),
+			paths:     [][]tpm2.Digest{{shimVendorCertEvent}},
+		},
+		{
+			// Test that a pending MOK enrolment produces a profile for the current and updated MOK databases
+			desc:    "PendingEnrolment",
+			efivars: "testdata/efivars2",
+			shim:    "testdata/mockshim1.efi.signed.1",
+			mokNew:  makeMockSignatureList(EFICertSha256Guid, grubDigest),
+			paths:   [][]tpm2.Digest{{shimVendorCertEvent}, {mokGrubDigestEvent, shimVendorCertEvent}},
+		},
+		{
+			// Test that an error is returned if the images are only authenticated by a pending MOK enrolment
+			desc:    "OnlyPendingEnrolment",
+			efivars: "testdata/efivars3",
+			shim:    "testdata/mockshim.efi.signed.2",
+			mokNew:  makeMockSignatureList(EFICertX509Guid, vendorCert.Bytes),
+			err:     "cannot compute secure boot policy profile: no bootable paths with current EFI signature database",
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			efivars, err := ioutil.TempDir("", "secboot-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %v", err)
+			}
+			defer os.RemoveAll(efivars)
+
+			for _, name := range []string{"KEK-8be4df61-93ca-11d2-aa0d-00e098032b8c", "db-d719b2cb-3d3a-4596-a3bc-dad00e67656f", "dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f"} {
+				d, err := ioutil.ReadFile(filepath.Join(data.efivars, name))
+				if err != nil {
+					t.Fatalf("ReadFile failed: %v", err)
+				}
+				if name == "db-d719b2cb-3d3a-4596-a3bc-dad00e67656f" {
+					d = append(d, data.extraDb...)
+				}
+				if err := ioutil.WriteFile(filepath.Join(efivars, name), d, 0644); err != nil {
+					t.Fatalf("WriteFile failed: %v", err)
+				}
+			}
+			if data.mokListRT != nil {
+				d := append([]byte{0x06, 0x00, 0x00, 0x00}, data.mokListRT...)
+				if err := ioutil.WriteFile(filepath.Join(efivars, "MokListRT-605dab50-e046-4300-abb6-3dd810dd8b23"), d, 0644); err != nil {
+					t.Fatalf("WriteFile failed: %v", err)
+				}
+			}
+			if data.mokNew != nil {
+				d := append([]byte{0x07, 0x00, 0x00, 0x00}, data.mokNew...)
+				if err := ioutil.WriteFile(filepath.Join(efivars, "MokNew-605dab50-e046-4300-abb6-3dd810dd8b23"), d, 0644); err != nil {
+					t.Fatalf("WriteFile failed: %v", err)
+				}
+			}
+
+			env := &FileHostEnvironment{EventLogPath: "testdata/eventlog1.bin", EFIVarsPath: efivars}
+
+			// Compute the PCR value after shim has been authenticated, which all of the expected values are computed from.
+			shimProfile := NewPCRProtectionProfile()
+			if err := AddEFISecureBootPolicyProfile(shimProfile, &EFISecureBootPolicyProfileParams{
+				PCRAlgorithm:  tpm2.HashAlgorithmSHA256,
+				LoadSequences: []*EFIImageLoadEvent{{Source: Firmware, Image: FileEFIImage(data.shim)}},
+				Environment:   env}); err != nil {
+				t.Fatalf("AddEFISecureBootPolicyProfile failed: %v", err)
+			}
+			shimValues, err := shimProfile.ComputePCRValues(nil)
+			if err != nil {
+				t.Fatalf("ComputePCRValues failed: %v", err)
+			}
+
+			var expected tpm2.DigestList
+			for _, path := range data.paths {
+				v := shimValues[0][tpm2.HashAlgorithmSHA256][7]
+				for _, d := range path {
+					h := crypto.SHA256.New()
+					h.Write(v)
+					h.Write(d)
+					v = h.Sum(nil)
+				}
+				expected = append(expected, v)
+			}
+
+			params := EFISecureBootPolicyProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+				LoadSequences: []*EFIImageLoadEvent{
+					{
+						Source: Firmware,
+						Image:  FileEFIImage(data.shim),
+						Next: []*EFIImageLoadEvent{
+							{
+								Source: Shim,
+								Image:  FileEFIImage("testdata/mockgrub1.efi.signed.shim"),
+								Next: []*EFIImageLoadEvent{
+									{
+										Source: Shim,
+										Image:  FileEFIImage("testdata/mockkernel1.efi.signed.shim"),
+									},
+								},
+							},
+						},
+					},
+				},
+				Environment: env,
+				MokDatabase: data.mokDb,
+			}
+
+			profile := NewPCRProtectionProfile()
+			err = AddEFISecureBootPolicyProfile(profile, &params)
+			if data.err != "" {
+				if err == nil {
+					t.Fatalf("Expected AddEFISecureBootPolicyProfile to fail")
+				}
+				if err.Error() != data.err {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AddEFISecureBootPolicyProfile failed: %v", err)
+			}
+
+			values, err := profile.ComputePCRValues(nil)
+			if err != nil {
+				t.Fatalf("ComputePCRValues failed: %v", err)
+			}
+			seen := make(map[int]bool)
+			for _, v := range values {
+				found := false
+				for i, e := range expected {
+					if bytes.Equal(v[tpm2.HashAlgorithmSHA256][7], e) {
+						seen[i] = true
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("Unexpected PCR value: %x", v[tpm2.HashAlgorithmSHA256][7])
+				}
+			}
+			if len(seen) != len(expected) {
+				t.Errorf("Missing expected PCR values")
+				t.Logf("Profile:\n%s", profile)
+				t.Logf("Values:\n%s", profile.DumpValues(nil))
+			}
+		})
+	}
+}
+
+// computeMockDbVerificationDigest computes the digest of the verification event recorded by firmware when an image is authenticated
+// by an entry in db created by makeMockSignatureList.
+func computeMockDbVerificationDigest(t *testing.T, sig []byte) tpm2.Digest {
+	var sigData bytes.Buffer
+	binary.Write(&sigData, binary.LittleEndian, mockSignatureOwner)
+	sigData.Write(sig)
+
+	h := crypto.SHA256.New()
+	eventData := tcglog.EFIVariableEventData{VariableName: *EFIImageSecurityDatabaseGuid, UnicodeName: "db", VariableData: sigData.Bytes()}
+	if err := eventData.EncodeMeasuredBytes(h); err != nil {
+		t.Fatalf("EncodeMeasuredBytes failed: %v", err)
+	}
+	return h.Sum(nil)
+}
+
+func TestAddEFISecureBootPolicyProfileWithImageDigestInDb(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.SkipNow()
+	}
+
+	caPEM, err := ioutil.ReadFile("testdata/certs/TestUefiCA2.crt")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	ca, _ := pem.Decode(caPEM)
+	if ca == nil {
+		t.Fatalf("cannot decode CA certificate")
+	}
+
+	origDb, err := ioutil.ReadFile("testdata/efivars2/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	for _, data := range []struct {
+		desc       string
+		image      string
+		makeDb     func(digest tpm2.Digest) []byte
+		authorized bool
+	}{
+		{
+			// Test with an image that is only authorized by its digest
+			desc:  "ImageDigest",
+			image: "testdata/mockshim1.efi.signed.2",
+			makeDb: func(digest tpm2.Digest) []byte {
+				return append(origDb, makeMockSignatureList(EFICertSha256Guid, digest)...)
+			},
+			authorized: true,
+		},
+		{
+			// Test that the image digest takes priority over a CA certificate that authorizes the second signature
+			desc:  "ImageDigestBeforeSecondSignature",
+			image: "testdata/mockshim2.efi.signed.21",
+			makeDb: func(digest tpm2.Digest) []byte {
+				db := append([]byte{0x27, 0x00, 0x00, 0x00}, makeMockSignatureList(EFICertX509Guid, ca.Bytes)...)
+				return append(db, makeMockSignatureList(EFICertSha256Guid, digest)...)
+			},
+			authorized: true,
+		},
+		{
+			// Test that an image that isn't authorized by a CA certificate or its digest is rejected
+			desc:  "NotAuthorized",
+			image: "testdata/mockshim1.efi.signed.2",
+			makeDb: func(digest tpm2.Digest) []byte {
+				return origDb
+			},
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			digest, err := ComputePeImageDigest(tpm2.HashAlgorithmSHA256, FileEFIImage(data.image))
+			if err != nil {
+				t.Fatalf("ComputePeImageDigest failed: %v", err)
+			}
+
+			efivars, err := ioutil.TempDir("", "secboot-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %v", err)
+			}
+			defer os.RemoveAll(efivars)
+
+			for _, name := range []string{"KEK-8be4df61-93ca-11d2-aa0d-00e098032b8c", "dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f"} {
+				d, err := ioutil.ReadFile(filepath.Join("testdata/efivars2", name))
+				if err != nil {
+					t.Fatalf("ReadFile failed: %v", err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(efivars, name), d, 0644); err != nil {
+					t.Fatalf("WriteFile failed: %v", err)
+				}
+			}
+			if err := ioutil.WriteFile(filepath.Join(efivars, "db-d719b2cb-3d3a-4596-a3bc-dad00e67656f"), data.makeDb(digest), 0644); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+
+			env := &FileHostEnvironment{EventLogPath: "testdata/eventlog1.bin", EFIVarsPath: efivars}
+
+			// Compute the PCR value before any OS images are loaded.
+			preOSProfile := NewPCRProtectionProfile()
+			if err := AddEFISecureBootPolicyProfile(preOSProfile, &EFISecureBootPolicyProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+				Environment:  env}); err != nil {
+				t.Fatalf("AddEFISecureBootPolicyProfile failed: %v", err)
+			}
+			preOSValues, err := preOSProfile.ComputePCRValues(nil)
+			if err != nil {
+				t.Fatalf("ComputePCRValues failed: %v", err)
+			}
+
+			profile := NewPCRProtectionProfile()
+			err = AddEFISecureBootPolicyProfile(profile, &EFISecureBootPolicyProfileParams{
+				PCRAlgorithm:  tpm2.HashAlgorithmSHA256,
+				LoadSequences: []*EFIImageLoadEvent{{Source: Firmware, Image: FileEFIImage(data.image)}},
+				Environment:   env})
+			if !data.authorized {
+				if err == nil {
+					t.Fatalf("Expected AddEFISecureBootPolicyProfile to fail")
+				}
+				if err.Error() != "cannot compute secure boot policy profile: no bootable paths with current EFI signature database" {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AddEFISecureBootPolicyProfile failed: %v", err)
+			}
+
+			h := crypto.SHA256.New()
+			h.Write(preOSValues[0][tpm2.HashAlgorithmSHA256][7])
+			h.Write(computeMockDbVerificationDigest(t, digest))
+			expected := tpm2.Digest(h.Sum(nil))
+
+			values, err := profile.ComputePCRValues(nil)
+			if err != nil {
+				t.Fatalf("ComputePCRValues failed: %v", err)
+			}
+			for _, v := range values {
+				if !bytes.Equal(v[tpm2.HashAlgorithmSHA256][7], expected) {
+					t.Errorf("Unexpected PCR value: %x", v[tpm2.HashAlgorithmSHA256][7])
+					t.Logf("Profile:\n%s", profile)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticodeDigestAlgorithmId(t *testing.T) {
+	for _, data := range []struct {
+		desc    string
+		oid     asn1.ObjectIdentifier
+		alg     tpm2.HashAlgorithmId
+		sigType *tcglog.EFIGUID
+		err     string
+	}{
+		{
+			desc:    "SHA256",
+			oid:     asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1},
+			alg:     tpm2.HashAlgorithmSHA256,
+			sigType: EFICertSha256Guid,
+		},
+		{
+			desc:    "SHA384",
+			oid:     asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2},
+			alg:     tpm2.HashAlgorithmSHA384,
+			sigType: EFICertSha384Guid,
+		},
+		{
+			desc:    "SHA512",
+			oid:     asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3},
+			alg:     tpm2.HashAlgorithmSHA512,
+			sigType: EFICertSha512Guid,
+		},
+		{
+			desc: "SHA1",
+			oid:  asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26},
+			err:  "signature has unexpected digest algorithm",
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			alg, err := AuthenticodeDigestAlgorithmId(data.oid)
+			if data.err != "" {
+				if err == nil {
+					t.Fatalf("Expected AuthenticodeDigestAlgorithmId to fail")
+				}
+				if err.Error() != data.err {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AuthenticodeDigestAlgorithmId failed: %v", err)
+			}
+			if alg != data.alg {
+				t.Errorf("Unexpected algorithm: %v", alg)
+			}
+			if *ImageDigestSignatureType(alg) != *data.sigType {
+				t.Errorf("Unexpected signature type: %v", ImageDigestSignatureType(alg))
+			}
+		})
+	}
+}
+
+func TestAddEFISecureBootPolicyProfileWithSignatureIterationOrder(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.SkipNow()
+	}
+
+	readCert := func(path string) []byte {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			t.Fatalf("cannot decode certificate")
+		}
+		return block.Bytes
+	}
+	ca1 := readCert("testdata/certs/TestUefiCA.crt")
+	ca2 := readCert("testdata/certs/TestUefiCA2.crt")
+
+	efivars, err := ioutil.TempDir("", "secboot-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(efivars)
+
+	for _, name := range []string{"KEK-8be4df61-93ca-11d2-aa0d-00e098032b8c", "dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f"} {
+		d, err := ioutil.ReadFile(filepath.Join("testdata/efivars2", name))
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(efivars, name), d, 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	// Enroll the CA for the second signature of mockshim2.efi.signed.21 before the CA for the first signature.
+	db := append([]byte{0x27, 0x00, 0x00, 0x00}, makeMockSignatureList(EFICertX509Guid, ca2)...)
+	db = append(db, makeMockSignatureList(EFICertX509Guid, ca1)...)
+	if err := ioutil.WriteFile(filepath.Join(efivars, "db-d719b2cb-3d3a-4596-a3bc-dad00e67656f"), db, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	env := &FileHostEnvironment{EventLogPath: "testdata/eventlog1.bin", EFIVarsPath: efivars}
+
+	preOSProfile := NewPCRProtectionProfile()
+	if err := AddEFISecureBootPolicyProfile(preOSProfile, &EFISecureBootPolicyProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		Environment:  env}); err != nil {
+		t.Fatalf("AddEFISecureBootPolicyProfile failed: %v", err)
+	}
+	preOSValues, err := preOSProfile.ComputePCRValues(nil)
+	if err != nil {
+		t.Fatalf("ComputePCRValues failed: %v", err)
+	}
+
+	for _, data := range []struct {
+		desc  string
+		order EFISignatureIterationOrder
+		ca    []byte
+	}{
+		{
+			desc:  "SignatureOuter",
+			order: EFISignatureOuterIteration,
+			ca:    ca1,
+		},
+		{
+			desc:  "DatabaseOuter",
+			order: EFIDatabaseOuterIteration,
+			ca:    ca2,
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			profile := NewPCRProtectionProfile()
+			if err := AddEFISecureBootPolicyProfile(profile, &EFISecureBootPolicyProfileParams{
+				PCRAlgorithm:  tpm2.HashAlgorithmSHA256,
+				LoadSequences: []*EFIImageLoadEvent{{Source: Firmware, Image: FileEFIImage("testdata/mockshim2.efi.signed.21")}},
+				Environment:   env,
+				FirmwareModel: EFIFirmwareModel{SignatureIterationOrder: data.order}}); err != nil {
+				t.Fatalf("AddEFISecureBootPolicyProfile failed: %v", err)
+			}
+
+			h := crypto.SHA256.New()
+			h.Write(preOSValues[0][tpm2.HashAlgorithmSHA256][7])
+			h.Write(computeMockDbVerificationDigest(t, data.ca))
+			expected := tpm2.Digest(h.Sum(nil))
+
+			values, err := profile.ComputePCRValues(nil)
+			if err != nil {
+				t.Fatalf("ComputePCRValues failed: %v", err)
+			}
+			for _, v := range values {
+				if !bytes.Equal(v[tpm2.HashAlgorithmSHA256][7], expected) {
+					t.Errorf("Unexpected PCR value: %x", v[tpm2.HashAlgorithmSHA256][7])
+					t.Logf("Profile:\n%s", profile)
+				}
+			}
+		})
+	}
+}
+
+func TestAddEFISecureBootPolicyProfileWithSignatureDbDedupMode(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.SkipNow()
+	}
+
+	restoreEventLogPath := testutil.MockEventLogPath("testdata/eventlog1.bin")
+	defer restoreEventLogPath()
+	restoreEfivarsPath := testutil.MockEFIVarsPath("testdata/efivars4")
+	defer restoreEfivarsPath()
+
+	computeValues := func(mode EFISignatureDbDedupMode) map[string]bool {
+		profile := NewPCRProtectionProfile()
+		if err := AddEFISecureBootPolicyProfile(profile, &EFISecureBootPolicyProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			LoadSequences: []*EFIImageLoadEvent{
+				{
+					Source: Firmware,
+					Image:  FileEFIImage("testdata/mockshim1.efi.signed.1"),
+					Next: []*EFIImageLoadEvent{
+						{
+							Source: Shim,
+							Image:  FileEFIImage("testdata/mockgrub1.efi.signed.shim"),
+						},
+					},
+				},
+			},
+			SignatureDbUpdateKeystores: []string{"testdata/updates3"},
+			FirmwareModel:              EFIFirmwareModel{SignatureDbDedupMode: mode}}); err != nil {
+			t.Fatalf("AddEFISecureBootPolicyProfile failed: %v", err)
+		}
+		values, err := profile.ComputePCRValues(nil)
+		if err != nil {
+			t.Fatalf("ComputePCRValues failed: %v", err)
+		}
+		out := make(map[string]bool)
+		for _, v := range values {
+			out[string(v[tpm2.HashAlgorithmSHA256][7])] = true
+		}
+		return out
+	}
+
+	all := computeValues(EFISignatureDbDedupUnknown)
+	ownerAndData := computeValues(EFISignatureDbDedupOwnerAndData)
+	dataOnly := computeValues(EFISignatureDbDedupDataOnly)
+
+	// The update contains a signature that only differs from an existing signature by SignatureOwner, so there should be a value
+	// for the current dbx and one for the updated dbx for each mode.
+	if len(all) != 3 {
+		t.Errorf("Unexpected number of values for unknown mode: %d", len(all))
+	}
+	if len(ownerAndData) != 2 {
+		t.Errorf("Unexpected number of values for owner and data mode: %d", len(ownerAndData))
+	}
+	if len(dataOnly) != 2 {
+		t.Errorf("Unexpected number of values for data only mode: %d", len(dataOnly))
+	}
+	for v := range ownerAndData {
+		if !all[v] {
+			t.Errorf("Unexpected value for owner and data mode: %x", v)
+		}
+	}
+	for v := range dataOnly {
+		if !all[v] {
+			t.Errorf("Unexpected value for data only mode: %x", v)
+		}
+	}
+	if reflect.DeepEqual(ownerAndData, dataOnly) {
+		t.Errorf("Owner and data mode and data only mode should produce different values")
+	}
+
+	err := AddEFISecureBootPolicyProfile(NewPCRProtectionProfile(), &EFISecureBootPolicyProfileParams{
+		PCRAlgorithm:  tpm2.HashAlgorithmSHA256,
+		FirmwareModel: EFIFirmwareModel{SignatureDbDedupMode: 10}})
+	if err == nil {
+		t.Fatalf("Expected AddEFISecureBootPolicyProfile to fail")
+	}
+	if err.Error() != "invalid signature database de-duplication mode: 10" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	shimMOKPCR = 14 // PCR that shim measures the MOK state variables to
+
+	mokListXRTName   = "MokListXRT"   // Unicode variable name for the runtime copy of the shim MOK forbidden database
+	mokSBStateRTName = "MokSBStateRT" // Unicode variable name for the runtime copy of the shim validation state
+	mokXNewName      = "MokXNew"      // Unicode variable name for pending enrolments to the shim MOK forbidden database
+)
+
+// shimMOKState corresponds to the contents of the MOK state variables that shim measures to PCR 14.
+type shimMOKState struct {
+	mokList    []byte
+	mokListX   []byte
+	mokSBState []byte
+}
+
+// ShimMOKProfileParams provide the arguments to AddShimMOKProfile.
+type ShimMOKProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// Environment is an optional parameter that allows the caller to provide EFI variables from an environment other than the
+	// current one. If not set, the EFI variables of the current host are used.
+	Environment HostEnvironment
+
+	// MokList is the expected contents of the MOK database, as measured by shim. If this is nil, the contents of the MokListRT
+	// variable are used. An empty slice indicates that the MOK database is not expected to exist.
+	MokList []byte
+
+	// MokListX is the expected contents of the MOK forbidden database, as measured by shim. If this is nil, the contents of the
+	// MokListXRT variable are used. An empty slice indicates that the MOK forbidden database is not expected to exist.
+	MokListX []byte
+
+	// MokSBState is the expected contents of the shim validation state variable, as measured by shim. If this is nil, the
+	// contents of the MokSBStateRT variable are used. An empty slice indicates that the variable is not expected to exist.
+	MokSBState []byte
+
+	// IncludePendingEnrolments indicates that PCR digests should also be computed for the MOK state after any enrolments pending
+	// in the MokNew and MokXNew variables have been applied by MokManager.
+	IncludePendingEnrolments bool
+
+	// ShimImage is an optional parameter that identifies the shim executable that will measure the MOK state. It is used when
+	// IncludePendingEnrolments is true to identify the entries that shim appends to the data it measures from its built-in vendor
+	// certificate and vendor forbidden signature database.
+	ShimImage EFIImage
+}
+
+// findShimVendorCertInMokList returns the offset of the EFI_SIGNATURE_LIST in the supplied MOK database that contains the shim
+// vendor certificate, which shim appends after the contents of MokList. If the certificate is not found, the length of the
+// database is returned.
+func findShimVendorCertInMokList(db, vendorCert []byte) (int, error) {
+	if len(vendorCert) == 0 {
+		return len(db), nil
+	}
+
+	r := bytes.NewReader(db)
+	iter := &secureBootDbIterator{r}
+	for i := 0; ; i++ {
+		start, _ := r.Seek(0, io.SeekCurrent)
+		sigType, _, sigs, err := iter.nextSignatureList()
+		switch {
+		case err == io.EOF:
+			return len(db), nil
+		case err != nil:
+			return 0, xerrors.Errorf("cannot obtain signature list at %d: %w", i, err)
+		}
+		if *sigType != *efiCertX509Guid || len(sigs) != 1 {
+			continue
+		}
+		// Skip EFI_SIGNATURE_DATA.SignatureOwner
+		if bytes.Equal(sigs[0][16:], vendorCert) {
+			return int(start), nil
+		}
+	}
+}
+
+// insertPendingEnrolments returns a copy of the supplied MOK database with the supplied pending enrolments inserted at the
+// specified offset.
+func insertPendingEnrolments(db []byte, offset int, pending []byte) []byte {
+	out := append([]byte(nil), db[:offset]...)
+	out = append(out, pending...)
+	return append(out, db[offset:]...)
+}
+
+// AddShimMOKProfile adds the shim MOK state profile to the provided PCR protection profile, in order to generate a PCR policy that
+// restricts access to a sealed key to a specific set of MOK databases and shim validation state, which shim measures to PCR 14.
+//
+// When shim starts, it measures the contents of the MokList, MokListX and MokSBState variables to PCR 14 using EV_IPL events, in
+// that order. Variables that don't exist are not measured. The runtime copies of these variables (MokListRT, MokListXRT and
+// MokSBStateRT) contain the data that shim measured during the current boot, and these are used by default. The expected
+// contents of each variable can be supplied via the MokList, MokListX and MokSBState fields of params instead.
+//
+// If the IncludePendingEnrolments field of params is true and there are enrolments pending in the MokNew or MokXNew variables,
+// the generated PCR profile will permit access to the sealed key with the current MOK state or with the pending enrolments
+// applied, so that keys remain accessible after MokManager has processed the pending requests on the next boot. MokManager appends
+// pending enrolments to the end of MokList and MokListX. Newer versions of shim append their built-in vendor certificate to the
+// data that they measure for MokList, and their built-in vendor forbidden signature database to the data that they measure for
+// MokListX, so the pending enrolments are inserted before these entries. These are identified using the shim executable supplied
+// via the ShimImage field of params. If ShimImage is not set, pending enrolments are appended to the end of the measured data,
+// which is only correct for versions of shim that don't add entries of their own.
+//
+// By default, EFI variables are read from the current host. A PCR profile can be computed for a different environment by supplying
+// a HostEnvironment via the Environment field of params (see FileHostEnvironment).
+func AddShimMOKProfile(profile *PCRProtectionProfile, params *ShimMOKProfileParams) error {
+	env := params.Environment
+	if env == nil {
+		env = defaultHostEnvironment()
+	}
+
+	readVar := func(name string) ([]byte, error) {
+		data, _, err := env.ReadVar(name, shimGuid)
+		switch {
+		case os.IsNotExist(err):
+			return nil, nil
+		case err != nil:
+			return nil, xerrors.Errorf("cannot read %s: %w", name, err)
+		}
+		return data, nil
+	}
+
+	current := &shimMOKState{mokList: params.MokList, mokListX: params.MokListX, mokSBState: params.MokSBState}
+	for _, v := range []struct {
+		name string
+		data *[]byte
+	}{
+		{name: mokListRTName, data: &current.mokList},
+		{name: mokListXRTName, data: &current.mokListX},
+		{name: mokSBStateRTName, data: &current.mokSBState},
+	} {
+		if *v.data != nil {
+			continue
+		}
+		data, err := readVar(v.name)
+		if err != nil {
+			return err
+		}
+		*v.data = data
+	}
+
+	states := []*shimMOKState{current}
+
+	if params.IncludePendingEnrolments {
+		mokNew, err := readVar(mokNewName)
+		if err != nil {
+			return err
+		}
+		mokXNew, err := readVar(mokXNewName)
+		if err != nil {
+			return err
+		}
+
+		if len(mokNew) > 0 || len(mokXNew) > 0 {
+			mokListOffset := len(current.mokList)
+			mokListXOffset := len(current.mokListX)
+
+			if params.ShimImage != nil {
+				vendorCert, vendorDbx, err := func() ([]byte, []byte, error) {
+					r, err := params.ShimImage.Open()
+					if err != nil {
+						return nil, nil, xerrors.Errorf("cannot open image: %w", err)
+					}
+					defer r.Close()
+					return readShimVendorData(r)
+				}()
+				if err != nil {
+					return xerrors.Errorf("cannot read vendor data from shim executable: %w", err)
+				}
+
+				mokListOffset, err = findShimVendorCertInMokList(current.mokList, vendorCert)
+				if err != nil {
+					return xerrors.Errorf("cannot decode MOK database: %w", err)
+				}
+				if len(vendorDbx) > 0 && bytes.HasSuffix(current.mokListX, vendorDbx) {
+					mokListXOffset -= len(vendorDbx)
+				}
+			}
+
+			pending := &shimMOKState{mokSBState: current.mokSBState}
+			pending.mokList = insertPendingEnrolments(current.mokList, mokListOffset, mokNew)
+			pending.mokListX = insertPendingEnrolments(current.mokListX, mokListXOffset, mokXNew)
+			states = append(states, pending)
+		}
+	}
+
+	var branches []*PCRProtectionProfile
+	for _, state := range states {
+		branch := NewPCRProtectionProfile()
+		branch.AddPCRValue(params.PCRAlgorithm, shimMOKPCR, make(tpm2.Digest, params.PCRAlgorithm.Size()))
+		for _, data := range [][]byte{state.mokList, state.mokListX, state.mokSBState} {
+			if len(data) == 0 {
+				// shim doesn't measure variables that don't exist
+				continue
+			}
+			h := params.PCRAlgorithm.NewHash()
+			h.Write(data)
+			branch.ExtendPCR(params.PCRAlgorithm, shimMOKPCR, h.Sum(nil))
+		}
+		branches = append(branches, branch)
+	}
+
+	profile.AddProfileOR(branches...)
+	return nil
+}
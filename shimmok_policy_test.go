@@ -0,0 +1,226 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type shimMOKPolicySuite struct{}
+
+var _ = Suite(&shimMOKPolicySuite{})
+
+// makeMockShimVars creates a directory laid out like efivarfs containing the supplied shim variables.
+func (s *shimMOKPolicySuite) makeMockShimVars(c *C, vars map[string][]byte) string {
+	dir := c.MkDir()
+	for name, data := range vars {
+		// Variables are prefixed by a 4-byte attributes field (EFI_VARIABLE_BOOTSERVICE_ACCESS | EFI_VARIABLE_RUNTIME_ACCESS)
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name+"-605dab50-e046-4300-abb6-3dd810dd8b23"),
+			append([]byte{0x06, 0x00, 0x00, 0x00}, data...), 0644), IsNil)
+	}
+	return dir
+}
+
+type testAddShimMOKProfileData struct {
+	vars   map[string][]byte
+	params ShimMOKProfileParams
+	values []tpm2.PCRValues
+}
+
+func (s *shimMOKPolicySuite) testAddShimMOKProfile(c *C, data *testAddShimMOKProfileData) {
+	expectedPcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{14}}}
+	var expectedDigests tpm2.DigestList
+	for _, v := range data.values {
+		d, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, expectedPcrs, v)
+		expectedDigests = append(expectedDigests, d)
+	}
+
+	params := data.params
+	params.PCRAlgorithm = tpm2.HashAlgorithmSHA256
+	params.Environment = &FileHostEnvironment{EFIVarsPath: s.makeMockShimVars(c, data.vars)}
+
+	profile := NewPCRProtectionProfile()
+	c.Assert(AddShimMOKProfile(profile, &params), IsNil)
+	pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	c.Check(pcrs.Equal(expectedPcrs), Equals, true)
+	c.Check(digests, DeepEquals, expectedDigests)
+	if c.Failed() {
+		c.Logf("Profile:\n%s", profile)
+		c.Logf("Values:\n%s", profile.DumpValues(nil))
+	}
+}
+
+func (s *shimMOKPolicySuite) TestAddShimMOKProfileFromRTVars(c *C) {
+	// This corresponds to the PCR 14 measurements in eventlog2.bin, where only MokSBState exists.
+	s.testAddShimMOKProfile(c, &testAddShimMOKProfileData{
+		vars: map[string][]byte{"MokSBStateRT": {0x01}},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					14: testutil.DecodeHexString(c, "632959f31641075aa6848d91649123edb324aca48206c605ea0bbe43590dceec"),
+				},
+			},
+		},
+	})
+}
+
+func (s *shimMOKPolicySuite) TestAddShimMOKProfileSupplied(c *C) {
+	s.testAddShimMOKProfile(c, &testAddShimMOKProfileData{
+		vars: map[string][]byte{"MokListRT": []byte("foo")},
+		params: ShimMOKProfileParams{
+			MokList:    []byte("mock MokList contents"),
+			MokListX:   []byte("mock MokListX contents"),
+			MokSBState: []byte{0x01}},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					14: testutil.DecodeHexString(c, "42807f929e2a098b79e35fa78bf4be9af0b15822c6c4efb248326e53e19aa473"),
+				},
+			},
+		},
+	})
+}
+
+func (s *shimMOKPolicySuite) TestAddShimMOKProfileSuppliedEmpty(c *C) {
+	// An empty MokSBState overrides the runtime variable and indicates that it doesn't exist.
+	s.testAddShimMOKProfile(c, &testAddShimMOKProfileData{
+		vars: map[string][]byte{
+			"MokListRT":    []byte("mock MokList contents"),
+			"MokSBStateRT": {0x01}},
+		params: ShimMOKProfileParams{MokSBState: []byte{}},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					14: testutil.DecodeHexString(c, "4195b9dcf29eb2f8226465679e142806967df82ead107b2e8710b6f9e02ce5d2"),
+				},
+			},
+		},
+	})
+}
+
+func (s *shimMOKPolicySuite) TestAddShimMOKProfileIgnorePending(c *C) {
+	s.testAddShimMOKProfile(c, &testAddShimMOKProfileData{
+		vars: map[string][]byte{
+			"MokListRT": []byte("mock MokList contents"),
+			"MokNew":    []byte(" and a pending enrolment")},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					14: testutil.DecodeHexString(c, "4195b9dcf29eb2f8226465679e142806967df82ead107b2e8710b6f9e02ce5d2"),
+				},
+			},
+		},
+	})
+}
+
+func (s *shimMOKPolicySuite) TestAddShimMOKProfilePendingMokNew(c *C) {
+	s.testAddShimMOKProfile(c, &testAddShimMOKProfileData{
+		vars: map[string][]byte{
+			"MokListRT": []byte("mock MokList contents"),
+			"MokNew":    []byte(" and a pending enrolment")},
+		params: ShimMOKProfileParams{IncludePendingEnrolments: true},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					14: testutil.DecodeHexString(c, "4195b9dcf29eb2f8226465679e142806967df82ead107b2e8710b6f9e02ce5d2"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					14: testutil.DecodeHexString(c, "f25307596fa99909b433c82f904ecc466b89b8ef08fdd767dbf9c7b9f54ec645"),
+				},
+			},
+		},
+	})
+}
+
+func (s *shimMOKPolicySuite) TestAddShimMOKProfilePendingMokXNew(c *C) {
+	s.testAddShimMOKProfile(c, &testAddShimMOKProfileData{
+		vars: map[string][]byte{
+			"MokListRT": []byte("mock MokList contents"),
+			"MokXNew":   []byte("mock MokXNew contents")},
+		params: ShimMOKProfileParams{IncludePendingEnrolments: true},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					14: testutil.DecodeHexString(c, "4195b9dcf29eb2f8226465679e142806967df82ead107b2e8710b6f9e02ce5d2"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					14: testutil.DecodeHexString(c, "e7daeb1b2e201075f2efcb019ef20250bb75a1c004ab6f697800f51c2bee9bff"),
+				},
+			},
+		},
+	})
+}
+
+func (s *shimMOKPolicySuite) TestAddShimMOKProfilePendingWithMirroredVendorCert(c *C) {
+	// Newer versions of shim append their vendor certificate to MokListRT after the contents of MokList, so pending enrolments
+	// need to be inserted before it.
+	vendorCertPEM, err := ioutil.ReadFile("testdata/certs/TestShimVendorCA.crt")
+	c.Assert(err, IsNil)
+	vendorCert, _ := pem.Decode(vendorCertPEM)
+	c.Assert(vendorCert, NotNil)
+
+	mokList := makeMockSignatureList(EFICertSha256Guid, make([]byte, 32))
+	mirroredVendorCert := makeMockSignatureList(EFICertX509Guid, vendorCert.Bytes)
+	mokNew := makeMockSignatureList(EFICertSha256Guid, bytes.Repeat([]byte{0xff}, 32))
+
+	computePCRValue := func(data []byte) tpm2.PCRValues {
+		h := crypto.SHA256.New()
+		h.Write(data)
+		digest := h.Sum(nil)
+
+		h = crypto.SHA256.New()
+		h.Write(make([]byte, 32))
+		h.Write(digest)
+		return tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {14: h.Sum(nil)}}
+	}
+
+	var pendingMokList []byte
+	pendingMokList = append(pendingMokList, mokList...)
+	pendingMokList = append(pendingMokList, mokNew...)
+	pendingMokList = append(pendingMokList, mirroredVendorCert...)
+
+	s.testAddShimMOKProfile(c, &testAddShimMOKProfileData{
+		vars: map[string][]byte{
+			"MokListRT": append(append([]byte(nil), mokList...), mirroredVendorCert...),
+			"MokNew":    mokNew},
+		params: ShimMOKProfileParams{
+			IncludePendingEnrolments: true,
+			ShimImage:                FileEFIImage("testdata/mockshim1.efi.signed.1")},
+		values: []tpm2.PCRValues{
+			computePCRValue(append(append([]byte(nil), mokList...), mirroredVendorCert...)),
+			computePCRValue(pendingMokList),
+		},
+	})
+}
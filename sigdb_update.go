@@ -0,0 +1,326 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+	"unicode/utf16"
+
+	"github.com/chrisccoulson/tcglog-parser"
+
+	"golang.org/x/xerrors"
+
+	"go.mozilla.org/pkcs7"
+)
+
+const (
+	efiVariableNonVolatile                       uint32 = 0x00000001 // EFI_VARIABLE_NON_VOLATILE
+	efiVariableBootserviceAccess                 uint32 = 0x00000002 // EFI_VARIABLE_BOOTSERVICE_ACCESS
+	efiVariableRuntimeAccess                     uint32 = 0x00000004 // EFI_VARIABLE_RUNTIME_ACCESS
+	efiVariableTimeBasedAuthenticatedWriteAccess uint32 = 0x00000020 // EFI_VARIABLE_TIME_BASED_AUTHENTICATED_WRITE_ACCESS
+	efiVariableAppendWrite                       uint32 = 0x00000040 // EFI_VARIABLE_APPEND_WRITE
+
+	// sigDbVariableAttrs are the attributes of the EFI signature database variables.
+	sigDbVariableAttrs = efiVariableNonVolatile | efiVariableBootserviceAccess | efiVariableRuntimeAccess |
+		efiVariableTimeBasedAuthenticatedWriteAccess
+)
+
+var oidPkcs7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+// efiTime corresponds to the EFI_TIME type.
+type efiTime struct {
+	Year       uint16
+	Month      uint8
+	Day        uint8
+	Hour       uint8
+	Minute     uint8
+	Second     uint8
+	Pad1       uint8
+	Nanosecond uint32
+	TimeZone   int16
+	Daylight   uint8
+	Pad2       uint8
+}
+
+func (t *efiTime) goTime() time.Time {
+	return time.Date(int(t.Year), time.Month(t.Month), int(t.Day), int(t.Hour), int(t.Minute), int(t.Second), int(t.Nanosecond), time.UTC)
+}
+
+// EFISignatureDbUpdate corresponds to an authenticated update to one of the EFI signature databases (PK, KEK, db or dbx), in the
+// format consumed by sbkeysync. This consists of a EFI_VARIABLE_AUTHENTICATION_2 structure followed by one or more
+// EFI_SIGNATURE_LIST structures.
+type EFISignatureDbUpdate struct {
+	Name      string         // The unicode name of the variable that this update applies to
+	GUID      tcglog.EFIGUID // The vendor GUID of the variable that this update applies to
+	TimeStamp time.Time      // The time associated with this update
+	Data      []byte         // The EFI_SIGNATURE_LIST structures contained in this update
+
+	timeStamp efiTime
+	signature *pkcs7.PKCS7
+}
+
+// decodeEFIVariableAuthentication2Signature decodes the PKCS#7 signature from the supplied WIN_CERTIFICATE_UEFI_GUID. The UEFI
+// specification says that this is a SignedData structure without the ContentInfo wrapper, but not every implementation produces
+// signatures in this form, so both forms are accepted here.
+func decodeEFIVariableAuthentication2Signature(cert *winCertificateUefiGuid) (*pkcs7.PKCS7, error) {
+	if p7, err := pkcs7.Parse(cert.Data); err == nil {
+		return p7, nil
+	}
+
+	// The content is wrapped in an explicit [0] tag. This is encoded in the RawValue rather than with a struct tag, as
+	// encoding/asn1 ignores struct tags for RawValue fields.
+	wrapped, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{
+		ContentType: oidPkcs7SignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert.Data}})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create ContentInfo: %w", err)
+	}
+	return pkcs7.Parse(wrapped)
+}
+
+// decodeEFIVariableAuthentication2 decodes an authenticated variable update from r, returning a EFISignatureDbUpdate without the
+// Name and GUID fields populated.
+func decodeEFIVariableAuthentication2(r io.Reader) (*EFISignatureDbUpdate, error) {
+	var timeStamp efiTime
+	if err := binary.Read(r, binary.LittleEndian, &timeStamp); err != nil {
+		return nil, xerrors.Errorf("cannot read EFI_VARIABLE_AUTHENTICATION_2.TimeStamp: %w", err)
+	}
+
+	var cert *winCertificateUefiGuid
+	if c, _, err := decodeWinCertificate(r); err != nil {
+		return nil, xerrors.Errorf("cannot decode EFI_VARIABLE_AUTHENTICATION_2.AuthInfo field from update: %w", err)
+	} else if c.wCertificateType() != winCertTypeEfiGuid {
+		return nil, fmt.Errorf("update has invalid EFI_VARIABLE_AUTHENTICATION_2.AuthInfo.Hdr.wCertificateType (0x%04x)", c.wCertificateType())
+	} else {
+		cert = c.(*winCertificateUefiGuid)
+	}
+
+	if cert.CertType != *efiCertTypePkcs7Guid {
+		return nil, fmt.Errorf("update has invalid value for EFI_VARIABLE_AUTHENTICATION_2.AuthInfo.CertType (%s)", &cert.CertType)
+	}
+
+	p7, err := decodeEFIVariableAuthentication2Signature(cert)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode EFI_VARIABLE_AUTHENTICATION_2.AuthInfo.CertData: %w", err)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read signature lists: %w", err)
+	}
+
+	// Make sure that the payload is well formed.
+	if _, err := decodeSecureBootDb(bytes.NewReader(data)); err != nil {
+		return nil, xerrors.Errorf("cannot decode signature lists: %w", err)
+	}
+
+	return &EFISignatureDbUpdate{
+		TimeStamp: timeStamp.goTime(),
+		Data:      data,
+		timeStamp: timeStamp,
+		signature: p7}, nil
+}
+
+// sigDbVariableGuid returns the vendor GUID for the EFI signature database with the specified name.
+func sigDbVariableGuid(name string) (*tcglog.EFIGUID, error) {
+	switch name {
+	case pkName, kekName:
+		return efiGlobalVariableGuid, nil
+	case dbName, dbxName:
+		return efiImageSecurityDatabaseGuid, nil
+	default:
+		return nil, fmt.Errorf("unrecognized signature database %s", name)
+	}
+}
+
+// DecodeEFISignatureDbUpdate decodes an authenticated update for the EFI signature database with the specified name (one of "PK",
+// "KEK", "db" or "dbx") from r. The update must consist of a EFI_VARIABLE_AUTHENTICATION_2 structure followed by one or more
+// EFI_SIGNATURE_LIST structures, such as the files produced by sign-efi-sig-list and consumed by sbkeysync.
+//
+// The signature on the update is not checked by this function. Use EFISignatureDbUpdate.Verify for that.
+func DecodeEFISignatureDbUpdate(r io.Reader, name string) (*EFISignatureDbUpdate, error) {
+	guid, err := sigDbVariableGuid(name)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := decodeEFIVariableAuthentication2(r)
+	if err != nil {
+		return nil, err
+	}
+	u.Name = name
+	u.GUID = *guid
+	return u, nil
+}
+
+// attrs returns the attributes that this update is applied with.
+func (u *EFISignatureDbUpdate) attrs() uint32 {
+	if u.Name == pkName {
+		return sigDbVariableAttrs
+	}
+	return sigDbVariableAttrs | efiVariableAppendWrite
+}
+
+// signedData returns the data that is signed by the author of this update, as defined in section 8.2.2 ("Variable Services -
+// Using the EFI_VARIABLE_AUTHENTICATION_2 descriptor") of the UEFI Specification, version 2.8.
+func (u *EFISignatureDbUpdate) signedData() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, utf16.Encode([]rune(u.Name)))
+	binary.Write(&buf, binary.LittleEndian, u.GUID)
+	binary.Write(&buf, binary.LittleEndian, u.attrs())
+	binary.Write(&buf, binary.LittleEndian, u.timeStamp)
+	buf.Write(u.Data)
+	return buf.Bytes()
+}
+
+// Signers returns the certificates of the signers of this update.
+func (u *EFISignatureDbUpdate) Signers() []*x509.Certificate {
+	var out []*x509.Certificate
+	for _, s := range u.signature.Signers {
+		for _, c := range u.signature.Certificates {
+			if c.SerialNumber.Cmp(s.IssuerAndSerialNumber.SerialNumber) == 0 && bytes.Equal(c.RawIssuer, s.IssuerAndSerialNumber.IssuerName.FullBytes) {
+				out = append(out, c)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// authorizedSigningCerts returns the X.509 certificates from the supplied PK and KEK contents that are permitted to sign an update to
+// this database. Updates to db and dbx can be signed by a key in either PK or KEK, and updates to PK and KEK can only be signed by the
+// key in PK.
+func (u *EFISignatureDbUpdate) authorizedSigningCerts(pk, kek []byte) ([]*x509.Certificate, error) {
+	dbs := [][]byte{pk}
+	if u.Name == dbName || u.Name == dbxName {
+		dbs = append(dbs, kek)
+	}
+
+	var out []*x509.Certificate
+	for _, db := range dbs {
+		sigs, err := decodeSecureBootDb(bytes.NewReader(db))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode signature database: %w", err)
+		}
+		for _, sig := range sigs {
+			if sig.signatureType != *efiCertX509Guid {
+				continue
+			}
+			cert, err := x509.ParseCertificate(sig.data)
+			if err != nil {
+				continue
+			}
+			out = append(out, cert)
+		}
+	}
+	return out, nil
+}
+
+// Verify checks that this update has a valid signature from a key that is authorized to update the database that this update applies
+// to, using the supplied contents of PK and KEK. The firmware will reject updates that fail this check.
+//
+// The certificates in PK and KEK are treated as trust anchors, so an update is accepted if it is signed by a certificate that is
+// issued by one of them even if it isn't a CA certificate, as the firmware does.
+//
+// This does not check the time stamp of the update against the time stamp of the current variable, as that isn't exposed by
+// efivarfs. This only matters for updates to PK, which is not appended to.
+func (u *EFISignatureDbUpdate) Verify(pk, kek []byte) error {
+	if u.signature == nil {
+		return errors.New("update has no signature")
+	}
+
+	// The signature is detached, so verify it against a copy with the signed data attached.
+	p7 := *u.signature
+	p7.Content = u.signedData()
+	if err := p7.Verify(); err != nil {
+		return xerrors.Errorf("invalid signature: %w", err)
+	}
+
+	cas, err := u.authorizedSigningCerts(pk, kek)
+	if err != nil {
+		return err
+	}
+
+	for _, signer := range u.Signers() {
+		sig := &authenticodeSignerAndIntermediates{signer: signer, intermediates: u.signature.Certificates}
+		for _, ca := range cas {
+			if sig.chainsTo(ca) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("update is not signed by a key that is authorized to update %s", u.Name)
+}
+
+// IsNew indicates whether this update contains any signatures that are not already present in the supplied database contents. This
+// is the test that sbkeysync uses to decide whether to apply an update.
+func (u *EFISignatureDbUpdate) IsNew(current []byte) (bool, error) {
+	currentSigs, err := decodeSecureBootDb(bytes.NewReader(current))
+	if err != nil {
+		return false, xerrors.Errorf("cannot decode current database: %w", err)
+	}
+	updateSigs, err := decodeSecureBootDb(bytes.NewReader(u.Data))
+	if err != nil {
+		return false, xerrors.Errorf("cannot decode update: %w", err)
+	}
+
+	for _, us := range updateSigs {
+		found := false
+		for _, cs := range currentSigs {
+			if us.signatureType == cs.signatureType && bytes.Equal(us.data, cs.data) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Apply computes the contents of the database that this update applies to, after the update has been applied to the supplied
+// current contents. Updates to KEK, db and dbx are appended to the current contents, skipping any EFI_SIGNATURE_DATA entries that
+// already exist. Updates to PK replace the current contents.
+func (u *EFISignatureDbUpdate) Apply(current []byte) ([]byte, error) {
+	return u.apply(current, sigDbUpdateQuirkModeNone)
+}
+
+func (u *EFISignatureDbUpdate) apply(current []byte, quirkMode sigDbUpdateQuirkMode) ([]byte, error) {
+	if u.attrs()&efiVariableAppendWrite == 0 {
+		out := make([]byte, len(u.Data))
+		copy(out, u.Data)
+		return out, nil
+	}
+	return appendDbUpdate(bytes.NewReader(current), u.Data, quirkMode)
+}
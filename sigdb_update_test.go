@@ -0,0 +1,141 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+type sigDbUpdateSuite struct{}
+
+var _ = Suite(&sigDbUpdateSuite{})
+
+func (s *sigDbUpdateSuite) readVar(c *C, path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(len(data) >= 4, Equals, true)
+	return data[4:]
+}
+
+func (s *sigDbUpdateSuite) decodeUpdate(c *C, path, name string) *EFISignatureDbUpdate {
+	f, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	u, err := DecodeEFISignatureDbUpdate(f, name)
+	c.Assert(err, IsNil)
+	return u
+}
+
+func (s *sigDbUpdateSuite) TestDecodeInvalidName(c *C) {
+	f, err := os.Open("testdata/updates2/db/1.bin")
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	_, err = DecodeEFISignatureDbUpdate(f, "foo")
+	c.Check(err, ErrorMatches, "unrecognized signature database foo")
+}
+
+func (s *sigDbUpdateSuite) TestDecodeSignedData(c *C) {
+	// The updates in testdata contain a SignedData structure without the ContentInfo wrapper, as specified by the UEFI specification.
+	for _, data := range []struct {
+		path string
+		name string
+	}{
+		{path: "testdata/updates1/dbx/MS-2016-08-08.bin", name: "dbx"},
+		{path: "testdata/updates2/db/1.bin", name: "db"},
+		{path: "testdata/updates3/dbx/1.bin", name: "dbx"},
+		{path: "testdata/updates4/db/1.bin", name: "db"},
+		{path: "testdata/updates4/dbx/MS-2016-08-08.bin", name: "dbx"},
+	} {
+		u := s.decodeUpdate(c, data.path, data.name)
+		c.Check(u.NumSignerInfos() > 0, Equals, true, Commentf("%s has no signers", data.path))
+		c.Check(u.Signers(), Not(HasLen), 0, Commentf("%s has no signer certificates", data.path))
+	}
+}
+
+type testVerifySigDbUpdateData struct {
+	path string
+	name string
+	kek  string
+}
+
+func (s *sigDbUpdateSuite) testVerify(c *C, data *testVerifySigDbUpdateData) {
+	u := s.decodeUpdate(c, data.path, data.name)
+	c.Check(u.Name, Equals, data.name)
+	c.Check(u.Signers(), Not(HasLen), 0)
+	c.Check(u.Verify(nil, s.readVar(c, data.kek)), IsNil)
+}
+
+func (s *sigDbUpdateSuite) TestVerifyDbUpdate(c *C) {
+	s.testVerify(c, &testVerifySigDbUpdateData{
+		path: "testdata/updates2/db/1.bin",
+		name: "db",
+		kek:  "testdata/efivars2/KEK-8be4df61-93ca-11d2-aa0d-00e098032b8c"})
+}
+
+func (s *sigDbUpdateSuite) TestVerifyMsDbxUpdate(c *C) {
+	s.testVerify(c, &testVerifySigDbUpdateData{
+		path: "testdata/updates1/dbx/MS-2016-08-08.bin",
+		name: "dbx",
+		kek:  "testdata/efivars1/KEK-8be4df61-93ca-11d2-aa0d-00e098032b8c"})
+}
+
+func (s *sigDbUpdateSuite) TestVerifyNoAuthority(c *C) {
+	u := s.decodeUpdate(c, "testdata/updates2/db/1.bin", "db")
+	c.Check(u.Verify(nil, nil), ErrorMatches, "update is not signed by a key that is authorized to update db")
+}
+
+func (s *sigDbUpdateSuite) TestVerifyWrongVariable(c *C) {
+	// The signature covers the variable name, so an update for db won't verify as an update for dbx.
+	u := s.decodeUpdate(c, "testdata/updates2/db/1.bin", "dbx")
+	c.Check(u.Verify(nil, s.readVar(c, "testdata/efivars2/KEK-8be4df61-93ca-11d2-aa0d-00e098032b8c")), ErrorMatches, "invalid signature: .*")
+}
+
+func (s *sigDbUpdateSuite) TestIsNew(c *C) {
+	u := s.decodeUpdate(c, "testdata/updates2/db/1.bin", "db")
+
+	isNew, err := u.IsNew(s.readVar(c, "testdata/efivars3/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f"))
+	c.Check(err, IsNil)
+	c.Check(isNew, Equals, true)
+
+	isNew, err = u.IsNew(s.readVar(c, "testdata/efivars5/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f"))
+	c.Check(err, IsNil)
+	c.Check(isNew, Equals, false)
+}
+
+func (s *sigDbUpdateSuite) TestApply(c *C) {
+	orig := s.readVar(c, "testdata/efivars2/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f")
+
+	u := s.decodeUpdate(c, "testdata/updates2/db/1.bin", "db")
+	db, err := u.Apply(orig)
+	c.Assert(err, IsNil)
+	c.Check(db[:len(orig)], DeepEquals, orig)
+
+	// Applying the update a second time shouldn't add anything.
+	db2, err := u.Apply(db)
+	c.Assert(err, IsNil)
+	c.Check(db2, DeepEquals, db)
+}
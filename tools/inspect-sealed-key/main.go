@@ -0,0 +1,153 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// inspect-sealed-key describes the contents of sealed key data files, or of the sealed key objects stored in the tokens of a LUKS2
+// container. It doesn't require access to a TPM.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/secboot"
+)
+
+var (
+	luks2 bool
+)
+
+func init() {
+	flag.BoolVar(&luks2, "luks2", false, "Read sealed key objects from the tokens of the specified LUKS2 containers")
+}
+
+func formatPCRSelection(selection tpm2.PCRSelectionList) string {
+	if len(selection) == 0 {
+		return "none"
+	}
+	var s []string
+	for _, p := range selection {
+		s = append(s, fmt.Sprintf("%v:%v", p.Hash, p.Select))
+	}
+	return strings.Join(s, ", ")
+}
+
+func formatAuthMode(mode secboot.AuthMode) string {
+	switch mode {
+	case secboot.AuthModeNone:
+		return "none"
+	case secboot.AuthModePIN:
+		return "PIN"
+	default:
+		return fmt.Sprintf("unknown (%d)", mode)
+	}
+}
+
+func describe(w io.Writer, k *secboot.SealedKeyObject) error {
+	fmt.Fprintf(w, "\tversion: %d\n", k.Version())
+	fmt.Fprintf(w, "\tname algorithm: %v\n", k.NameAlgorithm())
+	fmt.Fprintf(w, "\tsession algorithm: %v\n", k.SessionAlgorithm())
+	fmt.Fprintf(w, "\tenvelope: %t\n", k.IsEnvelope())
+	fmt.Fprintf(w, "\t2nd factor authentication: %s\n", formatAuthMode(k.AuthMode2F()))
+
+	fmt.Fprintf(w, "\tstatic policy:\n")
+	fmt.Fprintf(w, "\t\tPIN index handle: %v\n", k.PINIndexHandle())
+	fmt.Fprintf(w, "\t\tlock index handle: %v (name can only be verified with a TPM)\n", k.LockIndexHandle())
+	authKey := k.AuthPublicKey()
+	if authKey == nil {
+		return errors.New("key data has no auth public key")
+	}
+	authKeyName, err := authKey.Name()
+	if err != nil {
+		return fmt.Errorf("cannot compute name of auth public key: %v", err)
+	}
+	fmt.Fprintf(w, "\t\tauth public key: type=%v nameAlg=%v name=%x\n", authKey.Type, authKey.NameAlg, []byte(authKeyName))
+
+	fmt.Fprintf(w, "\tdynamic policy:\n")
+	fmt.Fprintf(w, "\t\tPCR selection: %s\n", formatPCRSelection(k.PCRSelection()))
+	fmt.Fprintf(w, "\t\tOR branches: %d\n", k.PCRPolicyBranches())
+	fmt.Fprintf(w, "\t\tpolicy count: %d\n", k.PCRPolicyCount())
+	return nil
+}
+
+func inspectFile(path string) error {
+	k, err := secboot.ReadSealedKeyObject(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s:\n", path)
+	return describe(os.Stdout, k)
+}
+
+func inspectLUKS2Container(path string) error {
+	tokens, err := secboot.ReadLUKS2KeyDataTokens(path)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		fmt.Printf("%s: no sealed key data tokens\n", path)
+		return nil
+	}
+	for _, token := range tokens {
+		fmt.Printf("%s token %d (keyslot %d):\n", path, token.ID, token.Keyslot)
+		k, err := secboot.ReadSealedKeyObjectFromReader(bytes.NewReader(token.KeyData))
+		if err != nil {
+			fmt.Printf("\t%v\n", err)
+			continue
+		}
+		if err := describe(os.Stdout, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func run() int {
+	args := flag.Args()
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-luks2] PATH...\n", os.Args[0])
+		return 1
+	}
+
+	ret := 0
+	for _, path := range args {
+		var err error
+		if luks2 {
+			err = inspectLUKS2Container(path)
+		} else {
+			err = inspectFile(path)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot inspect %s: %v\n", path, err)
+			ret = 1
+		}
+	}
+
+	return ret
+}
+
+func main() {
+	flag.Parse()
+	os.Exit(run())
+}
@@ -112,6 +112,34 @@ func (t *TPMConnection) HmacSession() tpm2.SessionContext {
 	return t.hmacSession.WithAttrs(tpm2.AttrContinueSession)
 }
 
+// hmacSessionWithAlg returns a HMAC session with the specified digest algorithm that is suitable for parameter encryption. If alg
+// is tpm2.HashAlgorithmNull or is the algorithm of the session returned from HmacSession, then that session is returned. Otherwise,
+// a new session is started, salted with a value protected by the endorsement key if it exists, or by the storage root key if it
+// doesn't. The returned function must be called to flush the session once it is no longer required.
+func (t *TPMConnection) hmacSessionWithAlg(alg tpm2.HashAlgorithmId) (tpm2.SessionContext, func(), error) {
+	if alg == tpm2.HashAlgorithmNull || alg == defaultSessionHashAlgorithm {
+		return t.HmacSession(), func() {}, nil
+	}
+	if !alg.Supported() {
+		return nil, nil, fmt.Errorf("unsupported session digest algorithm %v", alg)
+	}
+
+	saltKey := t.ek
+	if saltKey == nil {
+		srk, err := t.CreateResourceContextFromTPM(tcg.SRKHandle)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot create context for SRK: %w", err)
+		}
+		saltKey = srk
+	}
+
+	session, err := t.StartAuthSession(saltKey, nil, tpm2.SessionTypeHMAC, &paramEncryptionSymmetric, alg)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot create HMAC session: %w", err)
+	}
+	return session.WithAttrs(tpm2.AttrContinueSession), func() { t.FlushContext(session) }, nil
+}
+
 func (t *TPMConnection) Close() error {
 	t.FlushContext(t.hmacSession)
 	return t.TPMContext.Close()
@@ -282,11 +310,7 @@ func (t *TPMConnection) init() error {
 	// creating a session that's salted with a value protected by the public part of the endorsement key, using that to integrity protect
 	// a command and verifying we get a valid response. The salt (and therefore the session key) can only be recovered on and used by the
 	// TPM for which the endorsement certificate was issued, so a correct response means we're communicating with that TPM.
-	symmetric := tpm2.SymDef{
-		Algorithm: tpm2.SymAlgorithmAES,
-		KeyBits:   tpm2.SymKeyBitsU{Data: uint16(128)},
-		Mode:      tpm2.SymModeU{Data: tpm2.SymModeCFB}}
-	session, err := t.StartAuthSession(ek, nil, tpm2.SessionTypeHMAC, &symmetric, defaultSessionHashAlgorithm, nil)
+	session, err := t.StartAuthSession(ek, nil, tpm2.SessionTypeHMAC, &paramEncryptionSymmetric, defaultSessionHashAlgorithm, nil)
 	if err != nil {
 		return xerrors.Errorf("cannot create HMAC session: %w", err)
 	}
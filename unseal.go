@@ -20,6 +20,8 @@
 package secboot
 
 import (
+	"fmt"
+
 	"github.com/canonical/go-tpm2"
 	"github.com/snapcore/secboot/internal/tcg"
 
@@ -68,7 +70,9 @@ import (
 // condition can also occur as the result of an incorrectly provisioned TPM, which will be detected during a subsequent call to
 // SealKeyToTPM.
 //
-// On success, the unsealed cleartext key is returned.
+// On success, the unsealed cleartext key is returned. If the sealed key object was created with SealPayloadToTPM or
+// SealPayloadToTPMWithWriters, the decrypted payload is returned instead. If the payload cannot be decrypted and authenticated, a
+// InvalidKeyFileError error will be returned.
 func (k *SealedKeyObject) UnsealFromTPM(tpm *TPMConnection, pin string) ([]byte, error) {
 	// Check if the TPM is in lockout mode
 	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
@@ -140,8 +144,15 @@ func (k *SealedKeyObject) UnsealFromTPM(tpm *TPMConnection, pin string) ([]byte,
 		return nil, err
 	}
 
+	// Obtain a session with the digest algorithm recorded in the key data file for protecting the unsealed key.
+	unsealSession, flushUnsealSession, err := tpm.hmacSessionWithAlg(k.data.sessionAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain HMAC session: %w", err)
+	}
+	defer flushUnsealSession()
+
 	// Unseal
-	keyData, err := tpm.Unseal(key, policySession, hmacSession.IncludeAttrs(tpm2.AttrResponseEncrypt))
+	keyData, err := tpm.Unseal(key, policySession, unsealSession.IncludeAttrs(tpm2.AttrResponseEncrypt))
 	switch {
 	case tpm2.IsTPMSessionError(err, tpm2.ErrorPolicyFail, tpm2.CommandUnseal, 1):
 		return nil, InvalidKeyFileError{"the authorization policy check failed during unsealing"}
@@ -149,5 +160,14 @@ func (k *SealedKeyObject) UnsealFromTPM(tpm *TPMConnection, pin string) ([]byte,
 		return nil, xerrors.Errorf("cannot unseal key: %w", err)
 	}
 
-	return keyData, nil
+	if !k.data.isEnvelope() {
+		return keyData, nil
+	}
+
+	// The sealed object contains the wrapping key for the encrypted payload.
+	payload, err := decryptEnvelopePayload(keyData, k.data.encryptedPayload)
+	if err != nil {
+		return nil, InvalidKeyFileError{fmt.Sprintf("cannot decrypt payload: %v", err)}
+	}
+	return payload, nil
 }
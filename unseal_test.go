@@ -21,6 +21,7 @@ package secboot_test
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -78,6 +79,177 @@ func TestUnsealWithNo2FA(t *testing.T) {
 	t.Run("NilPCRProfile", func(t *testing.T) {
 		run(t, &KeyCreationParams{PINHandle: 0x0181fff0})
 	})
+
+	t.Run("ECCP256PolicySigningKey", func(t *testing.T) {
+		run(t, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0, PolicySigningKeyType: PolicySigningKeyECCP256})
+	})
+
+	t.Run("ECCP384PolicySigningKey", func(t *testing.T) {
+		run(t, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0, PolicySigningKeyType: PolicySigningKeyECCP384})
+	})
+
+	t.Run("SHA384NameAlgorithm", func(t *testing.T) {
+		run(t, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0, NameAlgorithm: tpm2.HashAlgorithmSHA384})
+	})
+
+	t.Run("SHA1SessionAlgorithm", func(t *testing.T) {
+		run(t, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0, SessionAlgorithm: tpm2.HashAlgorithmSHA1})
+	})
+}
+
+func TestUnsealPreVersion1KeyData(t *testing.T) {
+	// Key data files created before version 1 don't record the session algorithm, and must be unsealed with the default one.
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealPreVersion1KeyData_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	for _, version := range []uint32{0} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			oldKeyFile := fmt.Sprintf("%s/keydata.v%d", tmpDir, version)
+			if err := WriteKeyDataFileWithVersion(keyFile, oldKeyFile, version); err != nil {
+				t.Fatalf("WriteKeyDataFileWithVersion failed: %v", err)
+			}
+
+			if err := ValidateKeyDataFile(tpm.TPMContext, oldKeyFile, "", tpm.HmacSession()); err != nil {
+				t.Errorf("ValidateKeyDataFile failed: %v", err)
+			}
+
+			k, err := ReadSealedKeyObject(oldKeyFile)
+			if err != nil {
+				t.Fatalf("ReadSealedKeyObject failed: %v", err)
+			}
+
+			keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+			if err != nil {
+				t.Fatalf("UnsealFromTPM failed: %v", err)
+			}
+			if !bytes.Equal(key, keyUnsealed) {
+				t.Errorf("TPM returned the wrong key")
+			}
+		})
+	}
+}
+
+func TestUnsealPayload(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	run := func(t *testing.T, payload []byte) {
+		tmpDir, err := ioutil.TempDir("", "_TestUnsealPayload_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		keyFile := tmpDir + "/keydata"
+		policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+		if err := SealPayloadToTPM(tpm, payload, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0}); err != nil {
+			t.Fatalf("SealPayloadToTPM failed: %v", err)
+		}
+		defer undefineKeyNVSpace(t, tpm, keyFile)
+
+		if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+			t.Errorf("ValidateKeyDataFile failed: %v", err)
+		}
+
+		// Make sure that the encrypted payload is preserved when the key data file is updated.
+		if err := UpdateKeyPCRProtectionPolicy(tpm, keyFile, policyUpdateFile, getTestPCRProfile()); err != nil {
+			t.Fatalf("UpdateKeyPCRProtectionPolicy failed: %v", err)
+		}
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+
+		unsealed, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+
+		if !bytes.Equal(payload, unsealed) {
+			t.Errorf("UnsealFromTPM returned the wrong payload")
+		}
+	}
+
+	t.Run("Small", func(t *testing.T) {
+		payload := make([]byte, 64)
+		rand.Read(payload)
+		run(t, payload)
+	})
+
+	t.Run("MultipleKeys", func(t *testing.T) {
+		// Larger than can be sealed directly by the TPM
+		payload := make([]byte, 4*64+4096)
+		rand.Read(payload)
+		run(t, payload)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		run(t, []byte{})
+	})
+}
+
+func TestUnsealPayloadWithWriters(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	payload := make([]byte, 4*64+4096)
+	rand.Read(payload)
+
+	var keyData bytes.Buffer
+	if err := SealPayloadToTPMWithWriters(tpm, payload, &keyData, nil, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0}); err != nil {
+		t.Fatalf("SealPayloadToTPMWithWriters failed: %v", err)
+	}
+	defer func() {
+		rc, err := tpm.CreateResourceContextFromTPM(0x0181fff0)
+		if err != nil {
+			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+		}
+		undefineNVSpace(t, tpm, rc, tpm.OwnerHandleContext())
+	}()
+
+	k, err := ReadSealedKeyObjectFromReader(&keyData)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObjectFromReader failed: %v", err)
+	}
+
+	unsealed, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+
+	if !bytes.Equal(payload, unsealed) {
+		t.Errorf("UnsealFromTPM returned the wrong payload")
+	}
 }
 
 func TestUnsealWithPIN(t *testing.T) {
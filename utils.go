@@ -21,6 +21,8 @@ package secboot
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"fmt"
 	"os"
@@ -134,6 +136,43 @@ func createPublicAreaForRSASigningKey(key *rsa.PublicKey) *tpm2.Public {
 		Unique: tpm2.PublicIDU{Data: tpm2.PublicKeyRSA(key.N.Bytes())}}
 }
 
+// eccCurves maps TPM ECC curve identifiers to the corresponding go elliptic curves, for the curves supported by this package.
+var eccCurves = map[tpm2.ECCCurve]elliptic.Curve{
+	tpm2.ECCCurveNIST_P256: elliptic.P256(),
+	tpm2.ECCCurveNIST_P384: elliptic.P384()}
+
+// createPublicAreaForECDSASigningKey creates a *tpm2.Public from a go *ecdsa.PublicKey on the specified curve, which is suitable
+// for loading in to a TPM with TPMContext.LoadExternal. The name algorithm should have a digest size that is appropriate for the
+// size of the curve.
+func createPublicAreaForECDSASigningKey(key *ecdsa.PublicKey, curve tpm2.ECCCurve, nameAlg tpm2.HashAlgorithmId) *tpm2.Public {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return &tpm2.Public{
+		Type:    tpm2.ObjectTypeECC,
+		NameAlg: nameAlg,
+		Attrs:   tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrSign,
+		Params: tpm2.PublicParamsU{
+			Data: &tpm2.ECCParams{
+				Symmetric: tpm2.SymDefObject{Algorithm: tpm2.SymObjectAlgorithmNull},
+				Scheme:    tpm2.ECCScheme{Scheme: tpm2.ECCSchemeNull},
+				CurveID:   curve,
+				KDF:       tpm2.KDFScheme{Scheme: tpm2.KDFAlgorithmNull}}},
+		Unique: tpm2.PublicIDU{
+			Data: &tpm2.ECCPoint{
+				X: zeroExtendBytes(key.X.Bytes(), size),
+				Y: zeroExtendBytes(key.Y.Bytes(), size)}}}
+}
+
+// zeroExtendBytes returns data with leading zero bytes added so that it is at least size bytes long. This is used for encoding big
+// integers as fixed size TPM parameters.
+func zeroExtendBytes(data []byte, size int) []byte {
+	if len(data) >= size {
+		return data
+	}
+	out := make([]byte, size)
+	copy(out[size-len(data):], data)
+	return out
+}
+
 // digestListContains indicates whether the specified digest is present in the list of digests.
 func digestListContains(list tpm2.DigestList, digest tpm2.Digest) bool {
 	for _, d := range list {